@@ -8,7 +8,8 @@
 // a small wrapper to hold our dynamic Runnable
 struct State <'a> {
     ident: i32,
-    runnable: &'a dyn runnable::Runnable
+    runnable: &'a dyn runnable::Runnable,
+    error: Option<runnable::RunErr>
 }
 
 // something to hold down the fort until a real Runnable is set
@@ -23,6 +24,7 @@ impl runnable::Runnable for DefaultRunnable {
 static mut STATE: State = State {
     ident: 0,
     runnable: &DefaultRunnable{},
+    error: None,
 };
 
 pub mod runnable {
@@ -31,17 +33,43 @@ pub mod runnable {
 
     extern {
         fn return_result(result_pointer: *const u8, result_size: i32, ident: i32);
+        #[link_name = "return_error"]
+        fn return_error_ffi(code: i32, message_pointer: *const u8, message_size: i32, ident: i32);
     }
 
     pub trait Runnable {
         fn run(&self, input: Vec<u8>) -> Option<Vec<u8>>;
     }
 
+    // an error reported by a Runnable, the code can be used by the host to
+    // determine how to handle the failure (for example, as an HTTP status code)
+    pub struct RunErr {
+        pub code: i32,
+        pub message: String,
+    }
+
+    impl RunErr {
+        pub fn new(code: i32, message: &str) -> Self {
+            RunErr {
+                code: code,
+                message: String::from(message),
+            }
+        }
+    }
+
     pub fn set(runnable: &'static dyn Runnable) {
         unsafe {
             super::STATE.runnable = runnable;
         }
     }
+
+    // return_error causes the current run to fail with the given code and message once
+    // the Runnable's run function returns, and the data it returns will be discarded
+    pub fn return_error(code: i32, message: &str) {
+        unsafe {
+            super::STATE.error = Some(RunErr::new(code, message));
+        }
+    }
     
     #[no_mangle]
     pub extern fn allocate(size: i32) -> *const u8 {
@@ -77,6 +105,17 @@ pub mod runnable {
             None => Vec::from("run returned no data"), 
         } };
     
+        // if the Runnable reported an error, return that instead of the result
+        if let Some(err) = unsafe { super::STATE.error.take() } {
+            let message_slice = err.message.as_bytes();
+
+            unsafe {
+                return_error_ffi(err.code, message_slice.as_ptr() as *const u8, message_slice.len() as i32, ident);
+            }
+
+            return;
+        }
+
         let result_slice = result.as_slice();
         let result_size = result_slice.len();
     
@@ -90,117 +129,157 @@ pub mod runnable {
 
 pub mod http {
     use std::collections::BTreeMap;
-	use std::slice;
 
-    static METHOD_GET: i32 = 1;
-    static METHOD_POST: i32 = 2;
-    static METHOD_PATCH: i32 = 3;
-    static METHOD_DELETE: i32 = 4;
+    static METHOD_GET: &str = "GET";
+    static METHOD_POST: &str = "POST";
+    static METHOD_PATCH: &str = "PATCH";
+    static METHOD_DELETE: &str = "DELETE";
+    static METHOD_PUT: &str = "PUT";
+    static METHOD_HEAD: &str = "HEAD";
+    static METHOD_OPTIONS: &str = "OPTIONS";
+
+    static REQUEST_ENCODING_VERSION: u8 = 1;
 
     extern {
-        fn fetch_url(method: i32, url_pointer: *const u8, url_size: i32, body_pointer: *const u8, body_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+        fn fetch_request(request_pointer: *const u8, request_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+        fn fetch_status(ident: i32) -> i32;
+        fn fetch_header(key_pointer: *const u8, key_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
     }
 
     pub fn get(url: &str, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
-		return do_request(METHOD_GET, url, None, headers);
+		return do_request(METHOD_GET, url, None, header_pairs(headers));
 	}
     
     pub fn post(url: &str, body: Option<Vec<u8>>, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
-		return do_request(METHOD_POST, url, body, headers);
+		return do_request(METHOD_POST, url, body, header_pairs(headers));
 	}
     
     pub fn patch(url: &str, body: Option<Vec<u8>>, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
-		return do_request(METHOD_PATCH, url, body, headers);
+		return do_request(METHOD_PATCH, url, body, header_pairs(headers));
 	}
     
     pub fn delete(url: &str, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
-		return do_request(METHOD_DELETE, url, None, headers);
+		return do_request(METHOD_DELETE, url, None, header_pairs(headers));
 	}
 
-	fn do_request(method: i32, url: &str, body: Option<Vec<u8>>, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
-        // the URL gets encoded with headers added on the end, seperated by ::
-	    // eg. https://google.com/somepage::authorization:bearer qdouwrnvgoquwnrg::anotherheader:nicetomeetyou
-        let header_string = render_header_string(headers);
-        
-        let url_string = match header_string {
-            Some(h) => format!("{}::{}", url, h),
-            None => String::from(url)
-        };
-        
-        let mut dest_pointer: *const u8;
-        let mut dest_size: i32;
-        let mut capacity: i32 = 256000;
-
-        let body_pointer: *const u8;
-        let mut body_size: i32 = 0;
-
-        match body {
-            Some(b) => {
-                let body_slice = b.as_slice();
-                body_pointer = body_slice.as_ptr();
-                body_size = b.len() as i32;
-            },
-            None => body_pointer = 0 as *const u8
+    pub fn put(url: &str, body: Option<Vec<u8>>, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
+		return do_request(METHOD_PUT, url, body, header_pairs(headers));
+	}
+
+    pub fn head(url: &str, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
+		return do_request(METHOD_HEAD, url, None, header_pairs(headers));
+	}
+
+    pub fn options(url: &str, headers: Option<BTreeMap<&str, &str>>) -> Vec<u8> {
+		return do_request(METHOD_OPTIONS, url, None, header_pairs(headers));
+	}
+
+    // the _with_headers variants take headers as key/value pairs rather than a map, so that a header can be sent more than once
+    pub fn get_with_headers(url: &str, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_GET, url, None, Some(headers));
+	}
+
+    pub fn post_with_headers(url: &str, body: Option<Vec<u8>>, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_POST, url, body, Some(headers));
+	}
+
+    pub fn patch_with_headers(url: &str, body: Option<Vec<u8>>, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_PATCH, url, body, Some(headers));
+	}
+
+    pub fn delete_with_headers(url: &str, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_DELETE, url, None, Some(headers));
+	}
+
+    pub fn put_with_headers(url: &str, body: Option<Vec<u8>>, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_PUT, url, body, Some(headers));
+	}
+
+    pub fn head_with_headers(url: &str, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_HEAD, url, None, Some(headers));
+	}
+
+    pub fn options_with_headers(url: &str, headers: Vec<(&str, &str)>) -> Vec<u8> {
+		return do_request(METHOD_OPTIONS, url, None, Some(headers));
+	}
+
+    // status returns the status code of the response to the last successful request, or None if there wasn't one
+    pub fn status() -> Option<i32> {
+        let status = unsafe { fetch_status(super::STATE.ident) };
+
+        if status < 0 {
+            return None;
         }
-        
-        // make the request, and if the response size is greater than that of capacity, increase the capacity and try again
-        loop {
-            let cap = &mut capacity;
-            
-            let mut dest_bytes = Vec::with_capacity(*cap as usize);
-            let dest_slice = dest_bytes.as_mut_slice();
-            dest_pointer = dest_slice.as_mut_ptr() as *const u8;
-            
-            // do the request over FFI
-            dest_size = unsafe { fetch_url(method, url_string.as_str().as_ptr(), url_string.len() as i32, body_pointer, body_size, dest_pointer, *cap, super::STATE.ident) };
-
-            if dest_size < 0 {
-                return Vec::from(format!("request_failed:{}", dest_size))
-            } else if dest_size > *cap {
-                *cap = dest_size;
-            } else {
-                break;
-            }
+
+        Some(status)
+    }
+
+    // header returns the value of a header from the response to the last successful request, if it was set
+    pub fn header(key: &str) -> Option<String> {
+        // get the header, and if its size is greater than the buffer, get it again with a larger one
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            fetch_header(key.as_ptr(), key.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        result.ok().map(super::util::to_string)
+    }
+
+	fn do_request(method: &str, url: &str, body: Option<Vec<u8>>, headers: Option<Vec<(&str, &str)>>) -> Vec<u8> {
+        let request = encode_request(method, url, body, headers);
+
+        // make the request, and if the response size is greater than the buffer, read it again with a larger one
+        // (the host keeps the response, so the request is not sent again)
+        let result = super::util::read_into_buffer(256000, |dest_pointer, cap| unsafe {
+            fetch_request(request.as_ptr(), request.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        match result {
+            Ok(response) => response,
+            Err(code) => Vec::from(format!("request_failed:{}", code))
         }
+    }
 
-        let result: &[u8] = unsafe {
-            slice::from_raw_parts(dest_pointer, dest_size as usize)
-        };
+    // encode_request encodes a request for fetch_request: a version byte followed by the method, URL, headers and body,
+    // where each field is a little-endian u32 length followed by its bytes, and the headers are a u32 count of key/value field pairs
+    // (a header can be repeated by passing the same key more than once, and each pair is sent in order)
+    fn encode_request(method: &str, url: &str, body: Option<Vec<u8>>, headers: Option<Vec<(&str, &str)>>) -> Vec<u8> {
+        let mut encoded: Vec<u8> = vec![REQUEST_ENCODING_VERSION];
 
-        return Vec::from(result)
-	}
-	
-	fn render_header_string(headers: Option<BTreeMap<&str, &str>>) -> Option<String> {
-        let mut rendered: String = String::from("");
-        
-        match headers {
-            Some(h) => {
-                for key in h.keys() {
-                    rendered.push_str(key);
-                    rendered.push_str(":");
-        
-                    let val: &str = match h.get(key) {
-                        Some(v) => v,
-                        None => "",
-                    };
-        
-                    rendered.push_str(val);
-                    rendered.push_str("::")
-                }
-            },
-            None => return None,
+        encode_field(&mut encoded, method.as_bytes());
+        encode_field(&mut encoded, url.as_bytes());
+
+        let headers = headers.unwrap_or_default();
+        encoded.extend_from_slice(&(headers.len() as u32).to_le_bytes());
+
+        for (key, val) in headers.iter() {
+            encode_field(&mut encoded, key.as_bytes());
+            encode_field(&mut encoded, val.as_bytes());
         }
 
-		return Some(String::from(rendered.trim_end_matches("::")));
-	}
+        encode_field(&mut encoded, body.unwrap_or_default().as_slice());
+
+        encoded
+    }
+
+    fn encode_field(encoded: &mut Vec<u8>, field: &[u8]) {
+        encoded.extend_from_slice(&(field.len() as u32).to_le_bytes());
+        encoded.extend_from_slice(field);
+    }
+
+    fn header_pairs<'a>(headers: Option<BTreeMap<&'a str, &'a str>>) -> Option<Vec<(&'a str, &'a str)>> {
+        headers.map(|h| h.into_iter().collect())
+    }
 }
 
 pub mod cache {
-    use std::slice;
-
     extern {
         fn cache_set(key_pointer: *const u8, key_size: i32, value_pointer: *const u8, value_size: i32, ttl: i32, ident: i32) -> i32;
         fn cache_get(key_pointer: *const u8, key_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+        fn cache_delete(key_pointer: *const u8, key_size: i32, ident: i32) -> i32;
+        fn cache_exists(key_pointer: *const u8, key_size: i32, ident: i32) -> i32;
+        fn cache_incr(key_pointer: *const u8, key_size: i32, delta: i64, ttl: i32, dest_pointer: *const u8, ident: i32) -> i32;
+        fn cache_cas(key_pointer: *const u8, key_size: i32, old_pointer: *const u8, old_size: i32, value_pointer: *const u8, value_size: i32, ttl: i32, ident: i32) -> i32;
+        fn cache_keys(prefix_pointer: *const u8, prefix_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
     }
 
     pub fn set(key: &str, val: Vec<u8>, ttl: i32) {
@@ -213,41 +292,165 @@ pub mod cache {
     }
 
     pub fn get(key: &str) -> Option<Vec<u8>> {
-        let mut dest_pointer: *const u8;
-        let mut result_size: i32;
-        let mut capacity: i32 = 1024;
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            cache_get(key.as_ptr(), key.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
 
-        // make the request, and if the response size is greater than that of capacity, increase the capacity and try again
-        loop {
-            let cap = &mut capacity;
+        result.ok()
+    }
 
-            let mut dest_bytes = Vec::with_capacity(*cap as usize);
-            let dest_slice = dest_bytes.as_mut_slice();
-            dest_pointer = dest_slice.as_mut_ptr() as *const u8;
-    
-            // do the request over FFI
-            result_size = unsafe { cache_get(key.as_ptr(), key.len() as i32, dest_pointer, *cap, super::STATE.ident) };
-
-            if result_size < 0 {
-                return None;
-            } else if result_size > *cap {
-                super::log::info(format!("increasing capacity, need {}", result_size).as_str());
-                *cap = result_size;
-            } else {
-                break;
-            }
+    // delete removes a key from the cache, returning false if it did not exist
+    pub fn delete(key: &str) -> bool {
+        let result = unsafe { cache_delete(key.as_ptr(), key.len() as i32, super::STATE.ident) };
+
+        result == 0
+    }
+
+    pub fn exists(key: &str) -> bool {
+        let result = unsafe { cache_exists(key.as_ptr(), key.len() as i32, super::STATE.ident) };
+
+        result == 1
+    }
+
+    // incr atomically adds delta to the integer stored at key (treating a missing key as 0) and returns the result,
+    // or None if the existing value is not an integer. Values are stored as decimal strings
+    pub fn incr(key: &str, delta: i64, ttl: i32) -> Option<i64> {
+        let mut dest: [u8; 8] = [0; 8];
+
+        let result = unsafe { cache_incr(key.as_ptr(), key.len() as i32, delta, ttl, dest.as_mut_ptr() as *const u8, super::STATE.ident) };
+
+        if result < 0 {
+            return None;
         }
 
-        let result: &[u8] = unsafe {
-            slice::from_raw_parts(dest_pointer, result_size as usize)
+        Some(i64::from_le_bytes(dest))
+    }
+
+    // compare_and_set atomically sets key to val if its current value is old (or if it does not exist, when old is None),
+    // returning true if the value was set
+    pub fn compare_and_set(key: &str, old: Option<Vec<u8>>, val: Vec<u8>, ttl: i32) -> bool {
+        let (old_pointer, old_size) = match &old {
+            Some(o) => (o.as_ptr(), o.len() as i32),
+            None => (0 as *const u8, -1)
         };
 
-        Some(Vec::from(result))
+        let result = unsafe { cache_cas(key.as_ptr(), key.len() as i32, old_pointer, old_size, val.as_ptr(), val.len() as i32, ttl, super::STATE.ident) };
+
+        result == 1
+    }
+
+    // keys returns the keys in the cache beginning with prefix, sorted
+    pub fn keys(prefix: &str) -> Vec<String> {
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            cache_keys(prefix.as_ptr(), prefix.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        match result {
+            Ok(encoded) => super::util::decode_list(encoded.as_slice()),
+            Err(_) => Vec::new()
+        }
+    }
+}
+
+pub mod kv {
+    extern {
+        fn kv_get(key_pointer: *const u8, key_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+        fn kv_put(key_pointer: *const u8, key_size: i32, value_pointer: *const u8, value_size: i32, ident: i32) -> i32;
+        fn kv_delete(key_pointer: *const u8, key_size: i32, ident: i32) -> i32;
+        fn kv_scan(prefix_pointer: *const u8, prefix_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+    }
+
+    // get returns the value stored at key in the persistent key-value store, or None if it does not exist
+    pub fn get(key: &str) -> Option<Vec<u8>> {
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            kv_get(key.as_ptr(), key.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        result.ok()
+    }
+
+    // put stores val at key in the persistent key-value store, returning false if it could not be stored
+    pub fn put(key: &str, val: Vec<u8>) -> bool {
+        let result = unsafe { kv_put(key.as_ptr(), key.len() as i32, val.as_ptr(), val.len() as i32, super::STATE.ident) };
+
+        result == 0
+    }
+
+    // delete removes a key from the persistent key-value store, returning false if it did not exist
+    pub fn delete(key: &str) -> bool {
+        let result = unsafe { kv_delete(key.as_ptr(), key.len() as i32, super::STATE.ident) };
+
+        result == 0
+    }
+
+    // scan returns the keys in the persistent key-value store beginning with prefix, sorted
+    pub fn scan(prefix: &str) -> Vec<String> {
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            kv_scan(prefix.as_ptr(), prefix.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        match result {
+            Ok(encoded) => super::util::decode_list(encoded.as_slice()),
+            Err(_) => Vec::new()
+        }
+    }
+}
+
+pub mod secret {
+    extern {
+        fn get_secret(name_pointer: *const u8, name_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+    }
+
+    // get returns the value of the named secret, or None if it does not exist or the Runnable has not been granted
+    // access to it. The value is redacted from any message a Runnable logs afterwards
+    pub fn get(name: &str) -> Option<String> {
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            get_secret(name.as_ptr(), name.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        result.ok().map(super::util::to_string)
+    }
+}
+
+pub mod config {
+    extern {
+        fn get_config(key_pointer: *const u8, key_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+    }
+
+    // get returns the app's configuration value for key, or None if it is not set
+    pub fn get(key: &str) -> Option<String> {
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            get_config(key.as_ptr(), key.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        result.ok().map(super::util::to_string)
+    }
+}
+
+pub mod invoke {
+    extern {
+        fn invoke_fn(name_pointer: *const u8, name_size: i32, input_pointer: *const u8, input_size: i32, dest_pointer: *const u8, dest_max_size: i32, ident: i32) -> i32;
+    }
+
+    // run invokes the function with the given name (or FQFN) with input, waits for it to complete and returns its
+    // output, or None if it failed, timed out or was not permitted (such as the function being the Runnable itself or
+    // one that led to it, or the limit on nested invocations being reached)
+    pub fn run(name: &str, input: Vec<u8>) -> Option<Vec<u8>> {
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one.
+        // the output is kept by the host, so the function is not invoked again
+        let result = super::util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            invoke_fn(name.as_ptr(), name.len() as i32, input.as_ptr(), input.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
+
+        result.ok()
     }
 }
 
 pub mod req {
-    use std::slice;
     use super::util;
 
     extern {
@@ -259,6 +462,7 @@ pub mod req {
     static FIELD_TYPE_HEADER: i32 = 2 as i32;
     static FIELD_TYPE_PARAMS: i32 = 3 as i32;
     static FIELD_TYPE_STATE: i32 = 4 as i32;
+    static FIELD_TYPE_BODY_PATH: i32 = 5 as i32;
 
     pub fn method() -> String {
         match get_field(FIELD_TYPE_META, "method") {
@@ -295,6 +499,15 @@ pub mod req {
         }
     }
     
+    // body_path returns the value in the JSON body at path, which is either a JSON pointer (/user/emails/0)
+    // or a dotted path (user.emails.0). Strings are returned as their contents, and other values as raw JSON
+    pub fn body_path(path: &str) -> Option<String> {
+        match get_field(FIELD_TYPE_BODY_PATH, path) {
+            Some(bytes) => return Some(util::to_string(bytes)),
+            None => return None
+        }
+    }
+    
     pub fn header(key: &str) -> String {
         match get_field(FIELD_TYPE_HEADER, key) {
             Some(bytes) => return util::to_string(bytes),
@@ -317,36 +530,54 @@ pub mod req {
     }
     
     fn get_field(field_type: i32, key: &str) -> Option<Vec<u8>> {
-        let mut dest_pointer: *const u8;
-        let mut result_size: i32;
-        let mut capacity: i32 = 1024;
+        // make the request, and if the response size is greater than the buffer, the request is made again with a larger one
+        let result = util::read_into_buffer(1024, |dest_pointer, cap| unsafe {
+            request_get_field(field_type, key.as_ptr(), key.len() as i32, dest_pointer, cap, super::STATE.ident)
+        });
 
-        // make the request, and if the response size is greater than that of capacity, increase the capacity and try again
-        loop {
-            let cap = &mut capacity;
+        result.ok()
+    }
+}
 
-            let mut dest_bytes = Vec::with_capacity(*cap as usize);
-            let dest_slice = dest_bytes.as_mut_slice();
-            dest_pointer = dest_slice.as_mut_ptr() as *const u8;
-    
-            // do the request over FFI
-            result_size = unsafe { request_get_field(field_type, key.as_ptr(), key.len() as i32, dest_pointer, *cap, super::STATE.ident) };
-
-            if result_size < 0 {
-                return None;
-            } else if result_size > *cap {
-                super::log::info(format!("increasing capacity, need {}", result_size).as_str());
-                *cap = result_size;
-            } else {
-                break;
-            }
-        }
+pub mod resp {
+    extern {
+        fn response_set_status(status: i32, ident: i32) -> i32;
+        fn response_set_header(key_pointer: *const u8, key_size: i32, value_pointer: *const u8, value_size: i32, ident: i32) -> i32;
+        fn response_add_header(key_pointer: *const u8, key_size: i32, value_pointer: *const u8, value_size: i32, ident: i32) -> i32;
+    }
 
-        let result: &[u8] = unsafe {
-            slice::from_raw_parts(dest_pointer, result_size as usize)
-        };
+    pub fn set_status(status: i32) {
+        unsafe { response_set_status(status, super::STATE.ident) };
+    }
+
+    pub fn set_header(key: &str, val: &str) {
+        unsafe { response_set_header(key.as_ptr(), key.len() as i32, val.as_ptr(), val.len() as i32, super::STATE.ident) };
+    }
+
+    // add_header adds a value to a response header without replacing its existing values, such as for Set-Cookie
+    pub fn add_header(key: &str, val: &str) {
+        unsafe { response_add_header(key.as_ptr(), key.len() as i32, val.as_ptr(), val.len() as i32, super::STATE.ident) };
+    }
+}
+
+pub mod state {
+    extern {
+        fn state_set(key_pointer: *const u8, key_size: i32, value_pointer: *const u8, value_size: i32, ident: i32) -> i32;
+        fn state_delete(key_pointer: *const u8, key_size: i32, ident: i32) -> i32;
+    }
+
+    // set sets a key in the request's state, which is available to the handler's later steps, returning false if it could not be set
+    pub fn set(key: &str, val: Vec<u8>) -> bool {
+        let result = unsafe { state_set(key.as_ptr(), key.len() as i32, val.as_ptr(), val.len() as i32, super::STATE.ident) };
 
-        Some(Vec::from(result))
+        result == 0
+    }
+
+    // delete removes a key from the request's state, returning false if there is no request
+    pub fn delete(key: &str) -> bool {
+        let result = unsafe { state_delete(key.as_ptr(), key.len() as i32, super::STATE.ident) };
+
+        result == 0
     }
 }
 
@@ -377,6 +608,63 @@ pub mod log {
 }
 
 pub mod util {
+    // read_into_buffer calls read with a buffer pointer and its capacity, retrying with a larger buffer if the
+    // host reports a larger size, and returns the buffer the host wrote into (or the negative size as an error)
+    pub fn read_into_buffer<F>(capacity: i32, mut read: F) -> Result<Vec<u8>, i32>
+    where
+        F: FnMut(*const u8, i32) -> i32,
+    {
+        let mut capacity = capacity;
+
+        loop {
+            let mut buffer: Vec<u8> = Vec::with_capacity(capacity as usize);
+
+            let size = read(buffer.as_mut_ptr() as *const u8, capacity);
+
+            if size < 0 {
+                return Err(size);
+            } else if size > capacity {
+                capacity = size;
+            } else {
+                // the host has written size bytes into the buffer, which is at least that large
+                unsafe { buffer.set_len(size as usize) };
+
+                return Ok(buffer);
+            }
+        }
+    }
+
+    // decode_list decodes a list of strings encoded by the host as a little-endian u32 count
+    // followed by each string as a u32 length and its bytes
+    pub fn decode_list(encoded: &[u8]) -> Vec<String> {
+        let mut list = Vec::new();
+
+        if encoded.len() < 4 {
+            return list;
+        }
+
+        let count = u32::from_le_bytes([encoded[0], encoded[1], encoded[2], encoded[3]]);
+        let mut pos: usize = 4;
+
+        for _ in 0..count {
+            if encoded.len() < pos + 4 {
+                break;
+            }
+
+            let size = u32::from_le_bytes([encoded[pos], encoded[pos + 1], encoded[pos + 2], encoded[pos + 3]]) as usize;
+            pos += 4;
+
+            if encoded.len() < pos + size {
+                break;
+            }
+
+            list.push(String::from_utf8_lossy(&encoded[pos..pos + size]).into_owned());
+            pos += size;
+        }
+
+        list
+    }
+
     pub fn to_string(input: Vec<u8>) -> String {
         String::from_utf8(input).unwrap()
     }
@@ -2,26 +2,76 @@
 @_silgen_name("return_result_swift")
 func return_result(result_pointer: UnsafeRawPointer, result_size: Int32, ident: Int32)
 
+@_silgen_name("return_error_swift")
+func return_error(code: Int32, message_pointer: UnsafeRawPointer, message_size: Int32, ident: Int32)
+
 @_silgen_name("log_msg_swift")
 func log_msg(pointer: UnsafeRawPointer, size: Int32, level: Int32, ident: Int32)
 
-@_silgen_name("fetch_url_swift")
-func fetch_url(method: Int32, url_pointer: UnsafeRawPointer, url_size: Int32, body_pointer: UnsafeRawPointer, body_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+@_silgen_name("fetch_request_swift")
+func fetch_request(request_pointer: UnsafeRawPointer, request_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+@_silgen_name("fetch_status_swift")
+func fetch_status(ident: Int32) -> Int32
+@_silgen_name("fetch_header_swift")
+func fetch_header(key_pointer: UnsafeRawPointer, key_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
 
 @_silgen_name("cache_set_swift")
 func cache_set(key_pointer: UnsafeRawPointer, key_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ttl: Int32, ident: Int32) -> Int32
 @_silgen_name("cache_get_swift")
 func cache_get(key_pointer: UnsafeRawPointer, key_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+@_silgen_name("cache_delete_swift")
+func cache_delete(key_pointer: UnsafeRawPointer, key_size: Int32, ident: Int32) -> Int32
+@_silgen_name("cache_exists_swift")
+func cache_exists(key_pointer: UnsafeRawPointer, key_size: Int32, ident: Int32) -> Int32
+@_silgen_name("cache_incr_swift")
+func cache_incr(key_pointer: UnsafeRawPointer, key_size: Int32, delta: Int64, ttl: Int32, dest_pointer: UnsafeRawPointer, ident: Int32) -> Int32
+@_silgen_name("cache_cas_swift")
+func cache_cas(key_pointer: UnsafeRawPointer, key_size: Int32, old_pointer: UnsafeRawPointer?, old_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ttl: Int32, ident: Int32) -> Int32
+@_silgen_name("cache_keys_swift")
+func cache_keys(prefix_pointer: UnsafeRawPointer, prefix_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+
+@_silgen_name("kv_get_swift")
+func kv_get(key_pointer: UnsafeRawPointer, key_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+@_silgen_name("kv_put_swift")
+func kv_put(key_pointer: UnsafeRawPointer, key_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ident: Int32) -> Int32
+@_silgen_name("kv_delete_swift")
+func kv_delete(key_pointer: UnsafeRawPointer, key_size: Int32, ident: Int32) -> Int32
+@_silgen_name("kv_scan_swift")
+func kv_scan(prefix_pointer: UnsafeRawPointer, prefix_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+
+@_silgen_name("get_secret_swift")
+func get_secret(name_pointer: UnsafeRawPointer, name_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+
+@_silgen_name("get_config_swift")
+func get_config(key_pointer: UnsafeRawPointer, key_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
+
+@_silgen_name("invoke_fn_swift")
+func invoke_fn(name_pointer: UnsafeRawPointer, name_size: Int32, input_pointer: UnsafeRawPointer, input_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
 
 @_silgen_name("request_get_field_swift")
 func request_get_field(field_type: Int32, key_pointer: UnsafeRawPointer, key_size: Int32, dest_pointer: UnsafeRawPointer, dest_max_size: Int32, ident: Int32) -> Int32
 
+@_silgen_name("response_set_status_swift")
+func response_set_status(status: Int32, ident: Int32) -> Int32
+@_silgen_name("response_set_header_swift")
+func response_set_header(key_pointer: UnsafeRawPointer, key_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ident: Int32) -> Int32
+@_silgen_name("response_add_header_swift")
+func response_add_header(key_pointer: UnsafeRawPointer, key_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ident: Int32) -> Int32
+
+@_silgen_name("state_set_swift")
+func state_set(key_pointer: UnsafeRawPointer, key_size: Int32, value_pointer: UnsafeRawPointer, value_size: Int32, ident: Int32) -> Int32
+@_silgen_name("state_delete_swift")
+func state_delete(key_pointer: UnsafeRawPointer, key_size: Int32, ident: Int32) -> Int32
+
 // keep track of the current ident
 var CURRENT_IDENT: Int32 = 0
 
 // the Runnable instance currently being used
 var RUNNABLE: Runnable = defaultRunnable()
 
+// an error reported by the Runnable during the current run
+var RUN_ERROR: (code: Int32, message: String)? = nil
+
 // the protocol that users conform to to make their package a Runnable
 public protocol Runnable {
     func run(input: String) -> String
@@ -38,58 +88,149 @@ public func Set(runnable: Runnable) {
     RUNNABLE = runnable
 }
 
-let httpMethodGet = Int32(1)
-let httpMethodPost = Int32(2)
-let httpMethodPatch = Int32(3)
-let httpMethodDelete = Int32(4)
+// ReturnError causes the current run to fail with the given code and message once
+// the Runnable's run function returns, and the string it returns will be discarded
+public func ReturnError(code: Int, message: String) {
+    RUN_ERROR = (code: Int32(code), message: message)
+}
+
+let httpMethodGet = "GET"
+let httpMethodPost = "POST"
+let httpMethodPatch = "PATCH"
+let httpMethodDelete = "DELETE"
+let httpMethodPut = "PUT"
+let httpMethodHead = "HEAD"
+let httpMethodOptions = "OPTIONS"
+
+let requestEncodingVersion = UInt8(1)
+
+// headers are key/value pairs, so that a header can be sent more than once
+public func HttpGet(url: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodGet, url: url, body: "", headers: headers)
+}
+
+public func HttpPost(url: String, body: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodPost, url: url, body: body, headers: headers)
+}
 
-public func HttpGet(url: String) -> String {
-    return fetch(method: httpMethodGet, url: url, body: "")
+public func HttpPatch(url: String, body: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodPatch, url: url, body: body, headers: headers)
 }
 
-public func HttpPost(url: String, body: String) -> String {
-    return fetch(method: httpMethodPost, url: url, body: body)
+public func HttpDelete(url: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodDelete, url: url, body: "", headers: headers)
 }
 
-public func HttpPatch(url: String, body: String) -> String {
-    return fetch(method: httpMethodPatch, url: url, body: body)
+public func HttpPut(url: String, body: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodPut, url: url, body: body, headers: headers)
+}
+
+public func HttpHead(url: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodHead, url: url, body: "", headers: headers)
+}
+
+public func HttpOptions(url: String, headers: [(key: String, value: String)] = []) -> String {
+    return fetch(method: httpMethodOptions, url: url, body: "", headers: headers)
+}
+
+// HttpStatus returns the status code of the response to the last successful request, or -1 if there wasn't one
+public func HttpStatus() -> Int {
+    let status = fetch_status(ident: CURRENT_IDENT)
+    if status < 0 {
+        return -1
+    }
+
+    return Int(status)
 }
 
-public func HttpDelete(url: String) -> String {
-    return fetch(method: httpMethodDelete, url: url, body: "")
+// HttpHeader returns the value of a header from the response to the last successful request, or "" if it wasn't set
+public func HttpHeader(key: String) -> String {
+    var maxSize: Int32 = 1024
+    var retVal = ""
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = fetch_header(key_pointer: keyPtr, key_size: keySize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize <= 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = fromFFI(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
 }
 
-func fetch(method: Int32, url: String, body: String) -> String {    
+func fetch(method: String, url: String, body: String, headers: [(key: String, value: String)]) -> String {
+    let request = encodeRequest(method: method, url: url, body: body, headers: headers)
+
     var maxSize: Int32 = 256000
     var retVal = ""
 
     // loop until the returned size is within the defined max size, increasing it as needed
+    // (the host keeps the response, so the request is not sent again)
     var done = false
     while !done {
-        toFFI(val: url, use: { (url_ptr: UnsafePointer<Int8>, url_size: Int32) in
-            toFFI(val: body, use: { (body_ptr: UnsafePointer<Int8>, body_size: Int32) in
-                let dest_ptr = allocate(size: Int32(maxSize))
+        request.withUnsafeBufferPointer({ (requestPtr: UnsafeBufferPointer<UInt8>) in
+            let dest_ptr = allocate(size: Int32(maxSize))
 
-                let resultSize = fetch_url(method: method, url_pointer: url_ptr, url_size: url_size, body_pointer: body_ptr, body_size: body_size, dest_pointer: dest_ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+            let resultSize = fetch_request(request_pointer: requestPtr.baseAddress!, request_size: Int32(request.count), dest_pointer: dest_ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
 
-                if resultSize == 0 {
-                    done = true
-                } else if resultSize < 0 {
-                    retVal = "failed to fetch from url \(url)"
-                    done = true
-                } else if resultSize > maxSize {
-                    maxSize = resultSize
-                } else {
-                    retVal = fromFFI(ptr: dest_ptr, size: resultSize)
-                    done = true
-                }
-            })
+            if resultSize == 0 {
+                done = true
+            } else if resultSize < 0 {
+                retVal = "failed to fetch from url \(url)"
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = fromFFI(ptr: dest_ptr, size: resultSize)
+                done = true
+            }
         })
     }
     
     return retVal
 }
 
+// encodeRequest encodes a request for fetch_request: a version byte followed by the method, URL, headers and body,
+// where each field is a little-endian UInt32 length followed by its bytes, and the headers are a UInt32 count of key/value field pairs
+// (a header can be repeated by passing the same key more than once, and each pair is sent in order)
+func encodeRequest(method: String, url: String, body: String, headers: [(key: String, value: String)]) -> [UInt8] {
+    var encoded: [UInt8] = [requestEncodingVersion]
+
+    encodeField(&encoded, Array(method.utf8))
+    encodeField(&encoded, Array(url.utf8))
+
+    encodeUInt32(&encoded, UInt32(headers.count))
+    for (key, value) in headers {
+        encodeField(&encoded, Array(key.utf8))
+        encodeField(&encoded, Array(value.utf8))
+    }
+
+    encodeField(&encoded, Array(body.utf8))
+
+    return encoded
+}
+
+func encodeField(_ encoded: inout [UInt8], _ field: [UInt8]) {
+    encodeUInt32(&encoded, UInt32(field.count))
+    encoded.append(contentsOf: field)
+}
+
+func encodeUInt32(_ encoded: inout [UInt8], _ val: UInt32) {
+    encoded.append(contentsOf: [UInt8(val & 0xff), UInt8((val >> 8) & 0xff), UInt8((val >> 16) & 0xff), UInt8((val >> 24) & 0xff)])
+}
+
 public func CacheSet(key: String, value: String, ttl: Int) {    
 
     toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
@@ -128,6 +269,257 @@ public func CacheGet(key: String) -> String {
     return retVal
 }
 
+// CacheDelete removes a key from the cache, returning false if it did not exist
+public func CacheDelete(key: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        result = cache_delete(key_pointer: keyPtr, key_size: keySize, ident: CURRENT_IDENT)
+    })
+
+    return result == 0
+}
+
+public func CacheExists(key: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        result = cache_exists(key_pointer: keyPtr, key_size: keySize, ident: CURRENT_IDENT)
+    })
+
+    return result == 1
+}
+
+// CacheIncr atomically adds delta to the integer stored at key (treating a missing key as 0) and returns the result,
+// or nil if the existing value is not an integer. Values are stored as decimal strings
+public func CacheIncr(key: String, delta: Int64, ttl: Int) -> Int64? {
+    var retVal: Int64? = nil
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        let destPtr = allocate(size: 8)
+        defer { deallocate(pointer: destPtr, size: 8) }
+
+        let result = cache_incr(key_pointer: keyPtr, key_size: keySize, delta: delta, ttl: Int32(ttl), dest_pointer: destPtr, ident: CURRENT_IDENT)
+        if result == 0 {
+            retVal = Int64(littleEndian: destPtr.load(as: Int64.self))
+        }
+    })
+
+    return retVal
+}
+
+// CacheCompareAndSet atomically sets key to value if its current value is old (or if it does not exist, when old is nil),
+// returning true if the value was set
+public func CacheCompareAndSet(key: String, old: String?, value: String, ttl: Int) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        toFFI(val: value, use: { (valPtr: UnsafePointer<Int8>, valSize: Int32) in
+            if let old = old {
+                toFFI(val: old, use: { (oldPtr: UnsafePointer<Int8>, oldSize: Int32) in
+                    result = cache_cas(key_pointer: keyPtr, key_size: keySize, old_pointer: oldPtr, old_size: oldSize, value_pointer: valPtr, value_size: valSize, ttl: Int32(ttl), ident: CURRENT_IDENT)
+                })
+            } else {
+                result = cache_cas(key_pointer: keyPtr, key_size: keySize, old_pointer: nil, old_size: -1, value_pointer: valPtr, value_size: valSize, ttl: Int32(ttl), ident: CURRENT_IDENT)
+            }
+        })
+    })
+
+    return result == 1
+}
+
+// CacheKeys returns the keys in the cache beginning with prefix, sorted
+public func CacheKeys(prefix: String) -> [String] {
+    var maxSize: Int32 = 1024
+    var retVal: [String] = []
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: prefix, use: { (prefixPtr: UnsafePointer<Int8>, prefixSize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = cache_keys(prefix_pointer: prefixPtr, prefix_size: prefixSize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize < 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = decodeList(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
+}
+
+// KVGet returns the value stored at key in the persistent key-value store, or nil if it does not exist
+public func KVGet(key: String) -> String? {
+    var maxSize: Int32 = 1024
+    var retVal: String? = nil
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = kv_get(key_pointer: keyPtr, key_size: keySize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize < 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = fromFFI(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
+}
+
+// KVPut stores value at key in the persistent key-value store, returning false if it could not be stored
+public func KVPut(key: String, value: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        toFFI(val: value, use: { (valPtr: UnsafePointer<Int8>, valSize: Int32) in
+            result = kv_put(key_pointer: keyPtr, key_size: keySize, value_pointer: valPtr, value_size: valSize, ident: CURRENT_IDENT)
+        })
+    })
+
+    return result == 0
+}
+
+// KVDelete removes a key from the persistent key-value store, returning false if it did not exist
+public func KVDelete(key: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        result = kv_delete(key_pointer: keyPtr, key_size: keySize, ident: CURRENT_IDENT)
+    })
+
+    return result == 0
+}
+
+// KVScan returns the keys in the persistent key-value store beginning with prefix, sorted
+public func KVScan(prefix: String) -> [String] {
+    var maxSize: Int32 = 1024
+    var retVal: [String] = []
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: prefix, use: { (prefixPtr: UnsafePointer<Int8>, prefixSize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = kv_scan(prefix_pointer: prefixPtr, prefix_size: prefixSize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize < 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = decodeList(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
+}
+
+// GetSecret returns the value of the named secret, or nil if it does not exist or the Runnable has not been granted
+// access to it. The value is redacted from any message a Runnable logs afterwards
+public func GetSecret(name: String) -> String? {
+    var maxSize: Int32 = 1024
+    var retVal: String? = nil
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: name, use: { (namePtr: UnsafePointer<Int8>, nameSize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = get_secret(name_pointer: namePtr, name_size: nameSize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize < 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = fromFFI(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
+}
+
+// GetConfig returns the app's configuration value for key, or nil if it is not set
+public func GetConfig(key: String) -> String? {
+    var maxSize: Int32 = 1024
+    var retVal: String? = nil
+
+    // loop until the returned size is within the defined max size, increasing it as needed
+    var done = false
+    while !done {
+        toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+            let ptr = allocate(size: Int32(maxSize))
+
+            let resultSize = get_config(key_pointer: keyPtr, key_size: keySize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+            if resultSize < 0 {
+                done = true
+            } else if resultSize > maxSize {
+                maxSize = resultSize
+            } else {
+                retVal = fromFFI(ptr: ptr, size: resultSize)
+                done = true
+            }
+        })
+    }
+
+    return retVal
+}
+
+// InvokeFn invokes the function with the given name (or FQFN) with input, waits for it to complete and returns
+// its output, or nil if it failed, timed out or was not permitted (such as the function being the Runnable itself or
+// one that led to it, or the limit on nested invocations being reached)
+public func InvokeFn(name: String, input: String) -> String? {
+    var maxSize: Int32 = 1024
+    var retVal: String? = nil
+
+    // loop until the returned size is within the defined max size, increasing it as needed.
+    // the output is kept by the host, so the function is not invoked again
+    var done = false
+    while !done {
+        toFFI(val: name, use: { (namePtr: UnsafePointer<Int8>, nameSize: Int32) in
+            toFFI(val: input, use: { (inputPtr: UnsafePointer<Int8>, inputSize: Int32) in
+                let ptr = allocate(size: Int32(maxSize))
+
+                let resultSize = invoke_fn(name_pointer: namePtr, name_size: nameSize, input_pointer: inputPtr, input_size: inputSize, dest_pointer: ptr, dest_max_size: maxSize, ident: CURRENT_IDENT)
+
+                if resultSize < 0 {
+                    done = true
+                } else if resultSize > maxSize {
+                    maxSize = resultSize
+                } else {
+                    retVal = fromFFI(ptr: ptr, size: resultSize)
+                    done = true
+                }
+            })
+        })
+    }
+
+    return retVal
+}
+
 public func LogInfo(msg: String) {
     log(msg: msg, level: 3)
 }
@@ -151,6 +543,7 @@ let fieldTypeBody = Int32(1)
 let fieldTypeHeader = Int32(2)
 let fieldTypeParams = Int32(3)
 let fieldTypeState = Int32(4)
+let fieldTypeBodyPath = Int32(5)
 
 public func ReqMethod() -> String {
     return requestGetField(fieldType: fieldTypeMeta, key: "method")
@@ -172,6 +565,12 @@ public func ReqBodyField(key: String) -> String {
     return requestGetField(fieldType: fieldTypeBody, key: key)
 }
 
+// ReqBodyPath returns the value in the JSON body at path, which is either a JSON pointer (/user/emails/0)
+// or a dotted path (user.emails.0). Strings are returned as their contents, and other values as raw JSON
+public func ReqBodyPath(path: String) -> String {
+    return requestGetField(fieldType: fieldTypeBodyPath, key: path)
+}
+
 public func ReqHeader(key: String) -> String {
     return requestGetField(fieldType: fieldTypeHeader, key: key)
 }
@@ -213,6 +612,51 @@ func requestGetField(fieldType: Int32, key: String) -> String {
     return retVal
 }
 
+public func RespSetStatus(code: Int) {
+    let _ = response_set_status(status: Int32(code), ident: CURRENT_IDENT)
+}
+
+public func RespSetHeader(key: String, value: String) {
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        toFFI(val: value, use: { (valPtr: UnsafePointer<Int8>, valSize: Int32) in
+            let _ = response_set_header(key_pointer: keyPtr, key_size: keySize, value_pointer: valPtr, value_size: valSize, ident: CURRENT_IDENT)
+        })
+    })
+}
+
+// RespAddHeader adds a value to a response header without replacing its existing values, such as for Set-Cookie
+public func RespAddHeader(key: String, value: String) {
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        toFFI(val: value, use: { (valPtr: UnsafePointer<Int8>, valSize: Int32) in
+            let _ = response_add_header(key_pointer: keyPtr, key_size: keySize, value_pointer: valPtr, value_size: valSize, ident: CURRENT_IDENT)
+        })
+    })
+}
+
+// StateSet sets a key in the request's state, which is available to the handler's later steps, returning false if it could not be set
+public func StateSet(key: String, value: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        toFFI(val: value, use: { (valPtr: UnsafePointer<Int8>, valSize: Int32) in
+            result = state_set(key_pointer: keyPtr, key_size: keySize, value_pointer: valPtr, value_size: valSize, ident: CURRENT_IDENT)
+        })
+    })
+
+    return result == 0
+}
+
+// StateDelete removes a key from the request's state, returning false if there is no request
+public func StateDelete(key: String) -> Bool {
+    var result: Int32 = -1
+
+    toFFI(val: key, use: { (keyPtr: UnsafePointer<Int8>, keySize: Int32) in
+        result = state_delete(key_pointer: keyPtr, key_size: keySize, ident: CURRENT_IDENT)
+    })
+
+    return result == 0
+}
+
 @_cdecl("run_e")
 func run_e(pointer: UnsafeRawPointer, size: Int32, ident: Int32) {
     CURRENT_IDENT = ident
@@ -222,6 +666,17 @@ func run_e(pointer: UnsafeRawPointer, size: Int32, ident: Int32) {
     // call the user-provided run function
     let retString = RUNNABLE.run(input: inString)
 
+    // if the Runnable reported an error, return that instead of the result
+    if let err = RUN_ERROR {
+        RUN_ERROR = nil
+
+        toFFI(val: err.message, use: { (ptr: UnsafePointer<Int8>, size: Int32) in
+            return_error(code: err.code, message_pointer: ptr, message_size: size, ident: ident)
+        })
+
+        return
+    }
+
     // convert the output to a usable pointer/size combo
     toFFI(val: retString, use: { (ptr: UnsafePointer<Int8>, size: Int32) in
         return_result(result_pointer: ptr, result_size: size, ident: ident)
@@ -250,6 +705,42 @@ func toFFI(val: String, use: (UnsafePointer<Int8>, Int32) -> Void) {
     })
 }
 
+// decodeList decodes a list of strings encoded by the host as a little-endian UInt32 count
+// followed by each string as a UInt32 length and its bytes
+func decodeList(ptr: UnsafeRawPointer, size: Int32) -> [String] {
+    let bytes = UnsafeBufferPointer(start: ptr.bindMemory(to: UInt8.self, capacity: Int(size)), count: Int(size))
+    var list: [String] = []
+
+    func readUInt32(at pos: Int) -> Int {
+        return Int(bytes[pos]) | Int(bytes[pos + 1]) << 8 | Int(bytes[pos + 2]) << 16 | Int(bytes[pos + 3]) << 24
+    }
+
+    if bytes.count < 4 {
+        return list
+    }
+
+    let count = readUInt32(at: 0)
+    var pos = 4
+
+    for _ in 0..<count {
+        if bytes.count < pos + 4 {
+            break
+        }
+
+        let fieldSize = readUInt32(at: pos)
+        pos += 4
+
+        if bytes.count < pos + fieldSize {
+            break
+        }
+
+        list.append(String(decoding: bytes[pos..<pos + fieldSize], as: UTF8.self))
+        pos += fieldSize
+    }
+
+    return list
+}
+
 func fromFFI(ptr: UnsafeRawPointer, size: Int32) -> String {
     let typed: UnsafePointer<UInt8> = ptr.bindMemory(to: UInt8.self, capacity: Int(size))
     let val = String(cString: typed)
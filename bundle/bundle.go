@@ -3,8 +3,10 @@ package bundle
 import (
 	"archive/zip"
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,10 +14,17 @@ import (
 	"github.com/suborbital/hive-wasm/directive"
 )
 
+// StaticDir is the directory within a bundle that contains static files
+const StaticDir = "static"
+
 // Bundle represents a Runnable bundle
 type Bundle struct {
 	Directive *directive.Directive
 	Runnables []WasmModuleRef
+
+	// StaticFiles are the contents of the bundle's static directory, keyed by their path
+	// within the bundle (such as static/assets/logo.png)
+	StaticFiles map[string][]byte
 }
 
 // WasmModuleRef is a reference to a Wasm module (either its filepath or its bytes)
@@ -28,6 +37,12 @@ type WasmModuleRef struct {
 // Write writes a runnable bundle
 // based loosely on https://golang.org/src/archive/zip/example_test.go
 func Write(directive *directive.Directive, files []os.File, targetPath string) error {
+	return WriteWithStaticFiles(directive, files, nil, targetPath)
+}
+
+// WriteWithStaticFiles writes a runnable bundle that also includes static files, keyed
+// by their path within the bundle, each of which must be within the static directory
+func WriteWithStaticFiles(directive *directive.Directive, files []os.File, staticFiles map[string][]byte, targetPath string) error {
 	if directive == nil {
 		return errors.New("directive must be provided")
 	}
@@ -60,6 +75,16 @@ func Write(directive *directive.Directive, files []os.File, targetPath string) e
 		}
 	}
 
+	for name, contents := range staticFiles {
+		if !isStaticFile(name) {
+			return fmt.Errorf("static file %s is not within the %s directory", name, StaticDir)
+		}
+
+		if err := writeFile(w, name, contents); err != nil {
+			return errors.Wrap(err, "failed to writeFile for static file into bundle")
+		}
+	}
+
 	if err := w.Close(); err != nil {
 		return errors.Wrap(err, "failed to close bundle writer")
 	}
@@ -110,7 +135,8 @@ func Read(path string) (*Bundle, error) {
 	defer r.Close()
 
 	bundle := &Bundle{
-		Runnables: []WasmModuleRef{},
+		Runnables:   []WasmModuleRef{},
+		StaticFiles: map[string][]byte{},
 	}
 
 	// Iterate through the files in the archive,
@@ -124,6 +150,18 @@ func Read(path string) (*Bundle, error) {
 
 			bundle.Directive = directive
 			continue
+		} else if isStaticFile(f.Name) {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+
+			contents, err := readFile(f)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to readFile for static file")
+			}
+
+			bundle.StaticFiles[f.Name] = contents
+			continue
 		} else if !strings.HasSuffix(f.Name, ".wasm") {
 			continue
 		}
@@ -171,6 +209,30 @@ func readDirective(f *zip.File) (*directive.Directive, error) {
 	return d, nil
 }
 
+func readFile(f *zip.File) ([]byte, error) {
+	file, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s from bundle", f.Name)
+	}
+
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s from bundle", f.Name)
+	}
+
+	return contents, nil
+}
+
+// isStaticFile returns true if name is a path within the bundle's static directory.
+// paths that would escape the static directory (using ..) are not considered static files
+func isStaticFile(name string) bool {
+	cleaned := path.Clean(name)
+
+	return strings.HasPrefix(cleaned, StaticDir+"/") && !strings.Contains(cleaned, "..")
+}
+
 func refWithData(name string, data []byte) *WasmModuleRef {
 	ref := &WasmModuleRef{
 		Name: name,
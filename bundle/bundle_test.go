@@ -1,11 +1,13 @@
 package bundle
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/directive"
 )
 
 func TestRead(t *testing.T) {
@@ -36,3 +38,42 @@ func TestRead(t *testing.T) {
 		t.Error("hello-echo.wasm runnable not found in bundle")
 	}
 }
+
+func TestWriteReadStaticFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "bundle-test-")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempDir"))
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	dir := &directive.Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+	}
+
+	static := map[string][]byte{
+		"static/index.html":     []byte("<p>hello</p>"),
+		"static/assets/app.css": []byte("p {}"),
+	}
+
+	bundlePath := filepath.Join(tmpDir, "runnables.wasm.zip")
+
+	if err := WriteWithStaticFiles(dir, []os.File{}, static, bundlePath); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to WriteWithStaticFiles"))
+	}
+
+	bundle, err := Read(bundlePath)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Read"))
+	}
+
+	if len(bundle.StaticFiles) != 2 || string(bundle.StaticFiles["static/assets/app.css"]) != "p {}" {
+		t.Errorf("unexpected static files %v", bundle.StaticFiles)
+	}
+
+	if err := WriteWithStaticFiles(dir, []os.File{}, map[string][]byte{"static/../escape": {}}, bundlePath); err == nil {
+		t.Error("expected static file outside of static directory to fail")
+	}
+}
@@ -0,0 +1,140 @@
+package directive
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvLookup returns the value of the named environment variable to be interpolated into config values,
+// or an error if it is not set or the Directive is not permitted to use it
+type EnvLookup func(name string) (string, error)
+
+// AllowEnv returns an EnvLookup that reads the named environment variables from the host's
+// environment, and returns an error for any others so a Directive can only read those chosen by the host
+func AllowEnv(names ...string) EnvLookup {
+	allowed := map[string]bool{}
+	for _, name := range names {
+		allowed[name] = true
+	}
+
+	return func(name string) (string, error) {
+		if !allowed[name] {
+			return "", fmt.Errorf("environment variable %s is not permitted", name)
+		}
+
+		val, exists := os.LookupEnv(name)
+		if !exists {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return val, nil
+	}
+}
+
+// RunnableConfig returns the configuration for the Runnable with the given name ("naked" if in the default namespace,
+// or namespace#name), which is the Directive's config overridden by the Runnable's own. References to environment
+// variables (${NAME}) in the values are interpolated with lookup, and an error is returned if any of them fail
+func (d *Directive) RunnableConfig(name string, lookup EnvLookup) (map[string]string, error) {
+	config := map[string]string{}
+
+	for key, val := range d.Config {
+		config[key] = val
+	}
+
+	if r := d.FindRunnable(name); r != nil {
+		for key, val := range r.Config {
+			config[key] = val
+		}
+	}
+
+	for key, val := range config {
+		interpolated, err := interpolate(val, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("config value %s: %s", key, err.Error())
+		}
+
+		config[key] = interpolated
+	}
+
+	return config, nil
+}
+
+// validateConfig returns the problems with the keys and interpolation syntax of the values in config,
+// describing where the config is with owner
+func validateConfig(owner string, config map[string]string) []error {
+	errs := []error{}
+
+	// the environment is not consulted, since it may differ from the one the Directive is loaded in
+	lookup := func(string) (string, error) { return "", nil }
+
+	for key, val := range config {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("%s has an empty config key", owner))
+		}
+
+		if _, err := interpolate(val, lookup); err != nil {
+			errs = append(errs, fmt.Errorf("%s has invalid config value %s: %s", owner, key, err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// interpolate replaces each ${NAME} in val with the value of the environment variable NAME, as returned by lookup.
+// $$ is replaced with a literal $, and any other $ is left as it is
+func interpolate(val string, lookup EnvLookup) (string, error) {
+	builder := strings.Builder{}
+
+	for i := 0; i < len(val); i++ {
+		if val[i] != '$' || i == len(val)-1 {
+			builder.WriteByte(val[i])
+			continue
+		}
+
+		switch val[i+1] {
+		case '$':
+			builder.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(val[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated ${ at position %d", i)
+			}
+
+			name := val[i+2 : i+end]
+			if !validEnvName(name) {
+				return "", fmt.Errorf("invalid environment variable name %q", name)
+			}
+
+			envVal, err := lookup(name)
+			if err != nil {
+				return "", err
+			}
+
+			builder.WriteString(envVal)
+			i += end
+		default:
+			builder.WriteByte('$')
+		}
+	}
+
+	return builder.String(), nil
+}
+
+// validEnvName returns true if name consists of letters, digits and underscores, and does not start with a digit
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, r := range name {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9' {
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
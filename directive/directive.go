@@ -28,6 +28,9 @@ type Directive struct {
 	Runnables   []Runnable `yaml:"runnables"`
 	Handlers    []Handler  `yaml:"handlers,omitempty"`
 
+	// Config is the app-wide configuration available to every Runnable with get_config
+	Config map[string]string `yaml:"config,omitempty"`
+
 	// "fully qualified function names"
 	fqfns map[string]string `yaml:"-"`
 }
@@ -76,10 +79,17 @@ func (d *Directive) Marshal() ([]byte, error) {
 // Unmarshal unmarshals YAML bytes into a Directive struct
 // it also calculates a map of FQFNs for later use
 func (d *Directive) Unmarshal(in []byte) error {
-	return yaml.Unmarshal(in, d)
+	if err := yaml.Unmarshal(in, d); err != nil {
+		return err
+	}
+
+	d.calculateFQFNs()
+
+	return nil
 }
 
-// FQFN returns the FQFN for a given function in the directive
+// FQFN returns the FQFN for a given function in the directive. The FQFNs are calculated on first use if the Directive
+// was not created with Unmarshal, so callers sharing a Directive between goroutines should call it before doing so
 func (d *Directive) FQFN(fn string) (string, error) {
 	if d.fqfns == nil {
 		d.calculateFQFNs()
@@ -93,6 +103,20 @@ func (d *Directive) FQFN(fn string) (string, error) {
 	return fqfn, nil
 }
 
+// FindRunnable returns the Runnable with the given name ("naked" if in the default namespace, or namespace#name)
+// or nil if it does not exist
+func (d *Directive) FindRunnable(name string) *Runnable {
+	for i, r := range d.Runnables {
+		namespaced := fmt.Sprintf("%s#%s", r.Namespace, r.Name)
+
+		if name == namespaced || (r.Namespace == NamespaceDefault && name == r.Name) {
+			return &d.Runnables[i]
+		}
+	}
+
+	return nil
+}
+
 // Validate validates a directive
 func (d *Directive) Validate() error {
 	problems := &problems{}
@@ -109,6 +133,10 @@ func (d *Directive) Validate() error {
 		problems.add(errors.New("atmo version is not a valid semantic version"))
 	}
 
+	for _, err := range validateConfig("directive", d.Config) {
+		problems.add(err)
+	}
+
 	if len(d.Runnables) < 1 {
 		problems.add(errors.New("no functions listed"))
 	}
@@ -136,6 +164,55 @@ func (d *Directive) Validate() error {
 			problems.add(fmt.Errorf("function at position %d missing namespace", i))
 		}
 
+		if f.TimeoutMS < 0 {
+			problems.add(fmt.Errorf("function at position %d has negative timeoutMs", i))
+		}
+
+		if f.WASI != nil {
+			for j, dir := range f.WASI.Dirs {
+				if dir.GuestPath == "" {
+					problems.add(fmt.Errorf("function at position %d has wasi dir at position %d missing guestPath", i, j))
+				}
+
+				if (dir.Path == "") == (dir.BundlePath == "") {
+					problems.add(fmt.Errorf("function at position %d has wasi dir at position %d that must have exactly one of path or bundlePath", i, j))
+				}
+			}
+		}
+
+		if f.Egress != nil {
+			for _, host := range append(append([]string{}, f.Egress.AllowHosts...), f.Egress.DenyHosts...) {
+				if !validHostPattern(host) {
+					problems.add(fmt.Errorf("function at position %d has invalid egress host %q", i, host))
+				}
+			}
+
+			if f.Egress.MaxRedirects < -1 {
+				problems.add(fmt.Errorf("function at position %d has egress maxRedirects less than -1", i))
+			}
+		}
+
+		for _, err := range validateConfig(fmt.Sprintf("function at position %d", i), f.Config) {
+			problems.add(err)
+		}
+
+		for _, key := range f.StateKeys {
+			if key == "" {
+				problems.add(fmt.Errorf("function at position %d has an empty state key", i))
+			}
+		}
+
+		secrets := map[string]bool{}
+		for _, name := range f.Secrets {
+			if name == "" {
+				problems.add(fmt.Errorf("function at position %d has an empty secret name", i))
+			} else if secrets[name] {
+				problems.add(fmt.Errorf("function at position %d lists secret %s more than once", i, name))
+			}
+
+			secrets[name] = true
+		}
+
 		// if the fn is in the default namespace, let it exist "naked" and namespaced
 		if f.Namespace == NamespaceDefault {
 			fns[f.Name] = true
@@ -194,6 +271,11 @@ func (d *Directive) Validate() error {
 				}
 
 				fnsToAdd = append(fnsToAdd, key)
+
+				// the keys the fn declares that it sets are also available to the steps that follow it
+				if r := d.FindRunnable(fn.Fn); r != nil {
+					fnsToAdd = append(fnsToAdd, r.StateKeys...)
+				}
 			}
 
 			if s.IsFn() {
@@ -272,6 +354,17 @@ func (c *CallableFn) ParseWith() ([]Alias, error) {
 	return c.DesiredState, nil
 }
 
+// validHostPattern returns true if host is a hostname, *, or a hostname with a leading wildcard (*.example.com)
+func validHostPattern(host string) bool {
+	if host == "*" {
+		return true
+	}
+
+	host = strings.TrimPrefix(host, "*.")
+
+	return host != "" && !strings.ContainsAny(host, "*/ ")
+}
+
 type problems []error
 
 func (p *problems) add(err error) {
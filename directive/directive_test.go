@@ -2,6 +2,9 @@ package directive
 
 import (
 	"fmt"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -287,3 +290,210 @@ func TestDirectiveValidatorWithMissingState(t *testing.T) {
 		fmt.Println("directive validation properly failed:", err)
 	}
 }
+
+func TestDirectiveValidatorWASIDirs(t *testing.T) {
+	dir := Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Runnables: []Runnable{
+			{
+				Name:      "getUser",
+				Namespace: "db",
+				WASI: &WASI{
+					Dirs: []WASIDir{
+						{
+							Path:       "/var/data",
+							BundlePath: "static/data",
+							GuestPath:  "/data",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := dir.Validate(); err == nil {
+		t.Error("directive validation should have failed")
+	} else {
+		fmt.Println("directive validation properly failed:", err)
+	}
+}
+
+func TestDirectiveValidatorEgress(t *testing.T) {
+	dir := Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Runnables: []Runnable{
+			{
+				Name:      "getUser",
+				Namespace: "db",
+				Egress: &Egress{
+					AllowHosts: []string{"*.example.com", "api.*.com"},
+					DenyHosts:  []string{""},
+				},
+			},
+		},
+	}
+
+	err := dir.Validate()
+	if err == nil {
+		t.Fatal("directive validation should have failed")
+	}
+
+	if !strings.Contains(err.Error(), "found 2 problems") {
+		t.Errorf("expected 2 problems, got: %s", err)
+	}
+}
+
+func TestDirectiveValidatorSecrets(t *testing.T) {
+	dir := Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Runnables: []Runnable{
+			{
+				Name:      "getUser",
+				Namespace: "db",
+				Secrets:   []string{"db.password", "", "db.password"},
+			},
+		},
+	}
+
+	err := dir.Validate()
+	if err == nil {
+		t.Fatal("directive validation should have failed")
+	}
+
+	if !strings.Contains(err.Error(), "found 2 problems") {
+		t.Errorf("expected 2 problems, got: %s", err)
+	}
+}
+
+func TestDirectiveRunnableConfig(t *testing.T) {
+	os.Setenv("HIVE_WASM_TEST_HOST", "db.internal")
+	defer os.Unsetenv("HIVE_WASM_TEST_HOST")
+
+	os.Setenv("HIVE_WASM_TEST_PRIVATE", "hunter2")
+	defer os.Unsetenv("HIVE_WASM_TEST_PRIVATE")
+
+	lookup := AllowEnv("HIVE_WASM_TEST_HOST", "HIVE_WASM_TEST_UNSET")
+
+	dir := Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Config: map[string]string{
+			"dbURL": "postgres://${HIVE_WASM_TEST_HOST}:5432",
+			"price": "$$5 or $5",
+			"mode":  "app",
+		},
+		Runnables: []Runnable{
+			{
+				Name:      "getUser",
+				Namespace: "db",
+				Config: map[string]string{
+					"mode": "runnable",
+				},
+			},
+		},
+	}
+
+	if err := dir.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := dir.RunnableConfig("db#getUser", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"dbURL": "postgres://db.internal:5432", "price": "$5 or $5", "mode": "runnable"}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected config %v, got %v", expected, config)
+	}
+
+	dir.Config["token"] = "${HIVE_WASM_TEST_UNSET}"
+
+	if _, err := dir.RunnableConfig("db#getUser", lookup); err == nil {
+		t.Error("expected error for unset environment variable")
+	}
+
+	// an environment variable that the host has not permitted cannot be read, even when it is set
+	dir.Config["token"] = "${HIVE_WASM_TEST_PRIVATE}"
+
+	if _, err := dir.RunnableConfig("db#getUser", lookup); err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected error for environment variable that is not permitted, got %v", err)
+	}
+
+	dir.Config[""] = "empty"
+	dir.Runnables[0].Config["broken"] = "${UNTERMINATED"
+	dir.Runnables[0].Config["invalid"] = "${1NVALID}"
+
+	err = dir.Validate()
+	if err == nil {
+		t.Fatal("directive validation should have failed")
+	}
+
+	if !strings.Contains(err.Error(), "found 3 problems") {
+		t.Errorf("expected 3 problems, got: %s", err)
+	}
+}
+
+func TestDirectiveValidatorStateKeys(t *testing.T) {
+	dir := Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Runnables: []Runnable{
+			{
+				Name:      "authenticate",
+				Namespace: "default",
+				StateKeys: []string{"token"},
+			},
+			{
+				Name:      "getUser",
+				Namespace: "db",
+			},
+		},
+		Handlers: []Handler{
+			{
+				Input: Input{
+					Type:     "request",
+					Method:   "GET",
+					Resource: "/api/v1/user",
+				},
+				Steps: []Executable{
+					{
+						CallableFn: CallableFn{
+							Fn: "authenticate",
+						},
+					},
+					{
+						CallableFn: CallableFn{
+							Fn:   "db#getUser",
+							With: []string{"t: token"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := dir.Validate(); err != nil {
+		t.Errorf("expected declared state key to be available, got: %s", err)
+	}
+
+	// without the declaration, the reference is to a key that is not available
+	dir.Runnables[0].StateKeys = []string{""}
+
+	err := dir.Validate()
+	if err == nil {
+		t.Fatal("directive validation should have failed")
+	}
+
+	if !strings.Contains(err.Error(), "found 2 problems") {
+		t.Errorf("expected 2 problems, got: %s", err)
+	}
+}
@@ -2,8 +2,58 @@ package directive
 
 // Runnable is the structure of a .runnable.yaml file
 type Runnable struct {
-	Name       string `yaml:"name"`
-	Namespace  string `yaml:"namespace"`
-	Lang       string `yaml:"lang"`
-	APIVersion string `yaml:"apiVersion,omitempty"`
+	Name           string  `yaml:"name"`
+	Namespace      string  `yaml:"namespace"`
+	Lang           string  `yaml:"lang"`
+	APIVersion     string  `yaml:"apiVersion,omitempty"`
+	TimeoutMS      int     `yaml:"timeoutMs,omitempty"`
+	MaxMemoryPages uint32  `yaml:"maxMemoryPages,omitempty"`
+	WASI           *WASI   `yaml:"wasi,omitempty"`
+	Egress         *Egress `yaml:"egress,omitempty"`
+	Cache          *Cache  `yaml:"cache,omitempty"`
+
+	// Secrets are the names of the secrets that the Runnable is permitted to access
+	Secrets []string `yaml:"secrets,omitempty"`
+
+	// Config overrides values in the Directive's config for the Runnable
+	Config map[string]string `yaml:"config,omitempty"`
+
+	// StateKeys are the handler state keys that the Runnable sets with state_set (in addition to its output),
+	// so that the steps that follow it can reference them with 'with'
+	StateKeys []string `yaml:"stateKeys,omitempty"`
+}
+
+// WASI is the WASI environment provided to a Runnable
+type WASI struct {
+	Env  map[string]string `yaml:"env,omitempty"`
+	Args []string          `yaml:"args,omitempty"`
+	Dirs []WASIDir         `yaml:"dirs,omitempty"`
+}
+
+// WASIDir is a directory made available to a Runnable at GuestPath (as a copy, so anything the Runnable writes to it
+// is discarded after each execution), sourced either from within the
+// bundle (BundlePath) or from a directory on the host (Path), which is relative to the root directory that the
+// host permits bundles to use and is rejected if the host does not permit one
+type WASIDir struct {
+	Path       string `yaml:"path,omitempty"`
+	BundlePath string `yaml:"bundlePath,omitempty"`
+	GuestPath  string `yaml:"guestPath"`
+}
+
+// Egress is the policy for a Runnable's outbound HTTP requests, which applies in addition to any
+// policy set for the whole runtime. Empty Schemes means http and https, empty AllowHosts means any
+// host, and hosts can use a leading wildcard (*.example.com). Private IP addresses are blocked unless
+// AllowPrivateIPs is set, and MaxRedirects of 0 means the default (10) while -1 disables redirects
+type Egress struct {
+	Schemes         []string `yaml:"schemes,omitempty"`
+	AllowHosts      []string `yaml:"allowHosts,omitempty"`
+	DenyHosts       []string `yaml:"denyHosts,omitempty"`
+	AllowPrivateIPs bool     `yaml:"allowPrivateIPs,omitempty"`
+	MaxRedirects    int      `yaml:"maxRedirects,omitempty"`
+}
+
+// Cache configures a Runnable's use of the cache. A Runnable's cache keys are isolated to its app and namespace,
+// unless Shared is set, in which case they are in a namespace shared by all Runnables (of any app) that set it
+type Cache struct {
+	Shared bool `yaml:"shared,omitempty"`
 }
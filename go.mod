@@ -8,7 +8,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/suborbital/hive v0.2.1
 	github.com/suborbital/vektor v0.2.3
-	github.com/wasmerio/wasmer-go v1.0.1
+	github.com/wasmerio/wasmer-go v1.0.4
 	golang.org/x/mod v0.3.0
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.3.0
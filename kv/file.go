@@ -0,0 +1,321 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	opPut    = byte(1)
+	opDelete = byte(2)
+)
+
+// ErrStoreClosed is returned by a FileStore that has been closed
+var ErrStoreClosed = errors.New("store is closed")
+
+// FileStore is a Store for local use that persists its values to a single file. Every change is appended to the
+// file as a checksummed record and synced before it returns, and the file is replayed into memory when the store
+// is opened. A record left incomplete by a crash is discarded (along with anything after it) when the file is next
+// opened. Since overwritten and deleted values remain in the file until it is compacted, Compact should be called
+// periodically by long-running processes
+type FileStore struct {
+	path string
+	file *os.File
+	vals map[string][]byte
+
+	// garbage is the number of records in the file that have since been overwritten or deleted
+	garbage int
+
+	lock sync.RWMutex
+}
+
+// NewFileStore opens the FileStore at path, creating the file if it does not exist
+func NewFileStore(path string) (*FileStore, error) {
+	f := &FileStore{
+		path: path,
+		vals: map[string][]byte{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to ReadFile")
+	}
+
+	valid := f.replay(data)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to OpenFile")
+	}
+
+	// discard any incomplete or corrupt record so that new records are appended after the last valid one
+	if valid < len(data) {
+		if err := file.Truncate(int64(valid)); err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to Truncate")
+		}
+	}
+
+	if _, err := file.Seek(int64(valid), io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to Seek")
+	}
+
+	f.file = file
+
+	return f, nil
+}
+
+// Get returns the value stored at key
+func (f *FileStore) Get(key string) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	val, exists := f.vals[key]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte{}, val...), nil
+}
+
+// Put stores val at key
+func (f *FileStore) Put(key string, val []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.append(encodeRecord(opPut, key, val)); err != nil {
+		return errors.Wrap(err, "failed to append")
+	}
+
+	if _, exists := f.vals[key]; exists {
+		f.garbage++
+	}
+
+	f.vals[key] = append([]byte{}, val...)
+
+	return nil
+}
+
+// Delete removes key
+func (f *FileStore) Delete(key string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, exists := f.vals[key]; !exists {
+		return ErrKeyNotFound
+	}
+
+	if err := f.append(encodeRecord(opDelete, key, nil)); err != nil {
+		return errors.Wrap(err, "failed to append")
+	}
+
+	// both the deleted value's record and the delete record itself are no longer needed
+	f.garbage += 2
+
+	delete(f.vals, key)
+
+	return nil
+}
+
+// Scan returns the keys beginning with prefix, sorted
+func (f *FileStore) Scan(prefix string) ([]string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return scanKeys(f.vals, prefix), nil
+}
+
+// Garbage returns the number of records in the file that Compact would remove
+func (f *FileStore) Garbage() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.garbage
+}
+
+// Compact rewrites the file with only the current values, replacing it atomically
+func (f *FileStore) Compact() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return ErrStoreClosed
+	}
+
+	buf := &bytes.Buffer{}
+	for _, key := range scanKeys(f.vals, "") {
+		buf.Write(encodeRecord(opPut, key, f.vals[key]))
+	}
+
+	tmpPath := f.path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to OpenFile")
+	}
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to Write")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to Sync")
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to Rename")
+	}
+
+	// the temporary file is now the store's file, positioned at its end
+	f.file.Close()
+	f.file = tmp
+	f.garbage = 0
+
+	return nil
+}
+
+// Close closes the file. The store cannot be used after it is closed
+func (f *FileStore) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// append writes a record to the end of the file and syncs it, and must be called with the lock held
+func (f *FileStore) append(record []byte) error {
+	if f.file == nil {
+		return ErrStoreClosed
+	}
+
+	if _, err := f.file.Write(record); err != nil {
+		return errors.Wrap(err, "failed to Write")
+	}
+
+	if err := f.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to Sync")
+	}
+
+	return nil
+}
+
+// replay applies the records in data to the store's values, and returns the
+// length of data up to the end of the last complete and valid record
+func (f *FileStore) replay(data []byte) int {
+	offset := 0
+
+	for offset < len(data) {
+		op, key, val, size, ok := decodeRecord(data[offset:])
+		if !ok {
+			break
+		}
+
+		_, exists := f.vals[key]
+
+		switch op {
+		case opPut:
+			if exists {
+				f.garbage++
+			}
+
+			f.vals[key] = val
+		case opDelete:
+			f.garbage += 2
+			delete(f.vals, key)
+		}
+
+		offset += size
+	}
+
+	return offset
+}
+
+// encodeRecord encodes a change as a little-endian uint32 CRC-32 checksum of the rest of the record, followed by the
+// op, the key's uint32 length and bytes, and (for puts) the value's uint32 length and bytes
+func encodeRecord(op byte, key string, val []byte) []byte {
+	body := []byte{op}
+	body = appendField(body, []byte(key))
+
+	if op == opPut {
+		body = appendField(body, val)
+	}
+
+	record := make([]byte, 4, 4+len(body))
+	binary.LittleEndian.PutUint32(record, crc32.ChecksumIEEE(body))
+
+	return append(record, body...)
+}
+
+func appendField(buf, field []byte) []byte {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(field)))
+
+	return append(append(buf, size...), field...)
+}
+
+// decodeRecord decodes the record at the start of data, returning its size,
+// or false if data does not begin with a complete and valid record
+func decodeRecord(data []byte) (op byte, key string, val []byte, size int, ok bool) {
+	if len(data) < 5 {
+		return 0, "", nil, 0, false
+	}
+
+	checksum := binary.LittleEndian.Uint32(data)
+	op = data[4]
+	offset := 5
+
+	keyBytes, offset, ok := readField(data, offset)
+	if !ok {
+		return 0, "", nil, 0, false
+	}
+
+	switch op {
+	case opPut:
+		val, offset, ok = readField(data, offset)
+		if !ok {
+			return 0, "", nil, 0, false
+		}
+	case opDelete:
+	default:
+		return 0, "", nil, 0, false
+	}
+
+	if crc32.ChecksumIEEE(data[4:offset]) != checksum {
+		return 0, "", nil, 0, false
+	}
+
+	return op, string(keyBytes), append([]byte{}, val...), offset, true
+}
+
+func readField(data []byte, offset int) ([]byte, int, bool) {
+	if len(data)-offset < 4 {
+		return nil, offset, false
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[offset:]))
+	offset += 4
+
+	if size < 0 || len(data)-offset < size {
+		return nil, offset, false
+	}
+
+	return data[offset : offset+size], offset + size, true
+}
@@ -0,0 +1,141 @@
+package kv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrKeyNotFound is returned by a Store when a key does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// Store is a durable key-value store that Runnables can use to persist data. Unlike the cache, its values do
+// not expire. Implementations must be safe for concurrent use
+type Store interface {
+	// Get returns the value stored at key, or ErrKeyNotFound if it does not exist
+	Get(key string) ([]byte, error)
+	// Put stores val at key, replacing any existing value
+	Put(key string, val []byte) error
+	// Delete removes key, returning ErrKeyNotFound if it does not exist
+	Delete(key string) error
+	// Scan returns the keys beginning with prefix, sorted
+	Scan(prefix string) ([]string, error)
+}
+
+// Scoped returns a Store that prefixes every key with scope before passing it to store,
+// so that users of the returned Store cannot access keys outside of the scope
+func Scoped(store Store, scope string) Store {
+	if scope == "" {
+		return store
+	}
+
+	return &scopedStore{store: store, scope: scope}
+}
+
+type scopedStore struct {
+	store Store
+	scope string
+}
+
+func (s *scopedStore) Get(key string) ([]byte, error) {
+	return s.store.Get(s.scope + key)
+}
+
+func (s *scopedStore) Put(key string, val []byte) error {
+	return s.store.Put(s.scope+key, val)
+}
+
+func (s *scopedStore) Delete(key string) error {
+	return s.store.Delete(s.scope + key)
+}
+
+func (s *scopedStore) Scan(prefix string) ([]string, error) {
+	keys, err := s.store.Scan(s.scope + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.scope)
+	}
+
+	return keys, nil
+}
+
+// MemoryStore is a Store that keeps its values in memory, for tests and
+// Runnables that do not need their data to outlive the process
+type MemoryStore struct {
+	vals map[string][]byte
+	lock sync.RWMutex
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{
+		vals: map[string][]byte{},
+	}
+
+	return m
+}
+
+// Get returns the value stored at key
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	val, exists := m.vals[key]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte{}, val...), nil
+}
+
+// Put stores val at key
+func (m *MemoryStore) Put(key string, val []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.vals[key] = append([]byte{}, val...)
+
+	return nil
+}
+
+// Delete removes key
+func (m *MemoryStore) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.vals[key]; !exists {
+		return ErrKeyNotFound
+	}
+
+	delete(m.vals, key)
+
+	return nil
+}
+
+// Scan returns the keys beginning with prefix, sorted
+func (m *MemoryStore) Scan(prefix string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return scanKeys(m.vals, prefix), nil
+}
+
+// scanKeys returns the keys of vals beginning with prefix, sorted
+func scanKeys(vals map[string][]byte, prefix string) []string {
+	keys := []string{}
+
+	for key := range vals {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
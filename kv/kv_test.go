@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempDir"))
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.db")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to NewFileStore"))
+	}
+
+	store.Put("user/1", []byte("alice"))
+	store.Put("user/2", []byte("bob"))
+	store.Put("user/2", []byte("carol"))
+	store.Put("order/1", []byte("book"))
+
+	if err := store.Delete("order/1"); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Delete"))
+	}
+
+	if err := store.Delete("order/1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound deleting missing key, got %v", err)
+	}
+
+	if store.Garbage() != 3 {
+		t.Errorf("expected 3 garbage records, got %d", store.Garbage())
+	}
+
+	store.Close()
+
+	// a partially written record is discarded when the store is reopened
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	file.Write(encodeRecord(opPut, "user/3", []byte("dave"))[:10])
+	file.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to NewFileStore again"))
+	}
+
+	defer store.Close()
+
+	if val, _ := store.Get("user/2"); string(val) != "carol" {
+		t.Errorf("expected user/2 to be carol, got %s", string(val))
+	}
+
+	if _, err := store.Get("order/1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected order/1 to have been deleted, got %v", err)
+	}
+
+	if _, err := store.Get("user/3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected partial user/3 to have been discarded, got %v", err)
+	}
+
+	if err := store.Put("user/4", []byte("erin")); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Put after reopening"))
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Compact"))
+	}
+
+	if err := store.Put("user/5", []byte("frank")); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Put after compacting"))
+	}
+
+	keys, _ := store.Scan("user/")
+	if expected := []string{"user/1", "user/2", "user/4", "user/5"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to NewFileStore after compacting"))
+	}
+
+	defer reopened.Close()
+
+	if keys, _ := reopened.Scan(""); !reflect.DeepEqual(keys, []string{"user/1", "user/2", "user/4", "user/5"}) {
+		t.Errorf("unexpected keys after compacting %v", keys)
+	}
+
+	if reopened.Garbage() != 0 {
+		t.Errorf("expected no garbage after compacting, got %d", reopened.Garbage())
+	}
+}
+
+func TestScoped(t *testing.T) {
+	store := NewMemoryStore()
+
+	foo := Scoped(store, "app/foo/")
+	bar := Scoped(store, "app/bar/")
+
+	foo.Put("key", []byte("foo"))
+	bar.Put("key", []byte("bar"))
+
+	if val, _ := foo.Get("key"); string(val) != "foo" {
+		t.Errorf("expected foo, got %s", string(val))
+	}
+
+	if err := foo.Delete("key"); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Delete"))
+	}
+
+	if val, _ := bar.Get("key"); string(val) != "bar" {
+		t.Errorf("expected bar to be unaffected, got %s", string(val))
+	}
+
+	if keys, _ := bar.Scan(""); !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("expected keys [key], got %v", keys)
+	}
+
+	if keys, _ := store.Scan(""); !reflect.DeepEqual(keys, []string{"app/bar/key"}) {
+		t.Errorf("expected keys [app/bar/key], got %v", keys)
+	}
+}
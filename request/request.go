@@ -1,15 +1,24 @@
 package request
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/suborbital/vektor/vk"
 )
 
+// ErrBodyPathNotFound is returned by BodyPath when the request body does not contain a value at the path
+var ErrBodyPathNotFound = errors.New("body does not contain a value at path")
+
+// pointerUnescaper decodes the ~1 (/) and ~0 (~) escapes used in JSON pointer segments
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
 // CoordinatedRequest represents a request whose fulfillment can be coordinated across multiple hosts
 // and is serializable to facilitate interoperation with Wasm Runnables and transmissible over the wire
 type CoordinatedRequest struct {
@@ -21,7 +30,153 @@ type CoordinatedRequest struct {
 	Params  map[string]string `json:"params"`
 	State   map[string][]byte `json:"state"`
 
-	bodyValues map[string]interface{} `json:"-"`
+	// Response holds the response status and headers set by the Runnables handling the request
+	Response *Response `json:"response,omitempty"`
+
+	bodyValues interface{} `json:"-"`
+
+	// stateChanges records the changes made to State with SetState and DeleteState
+	stateChanges StateChanges `json:"-"`
+
+	// responseChanged records whether Response has been changed with SetStatus, SetHeader or AddHeader
+	responseChanged bool `json:"-"`
+}
+
+// Response is the status code and headers to be used when responding to a CoordinatedRequest
+type Response struct {
+	Status  int                 `json:"status,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// StateChanges are the changes made to a CoordinatedRequest's state by a Runnable handling it
+type StateChanges struct {
+	Set     map[string][]byte `json:"set,omitempty"`
+	Deleted []string          `json:"deleted,omitempty"`
+}
+
+// CoordinatedResponse is the result of a Runnable handling a CoordinatedRequest, including
+// its output, the response status and headers that have been set, and its changes to the state
+type CoordinatedResponse struct {
+	Output []byte `json:"output"`
+	Response
+	StateChanges StateChanges `json:"stateChanges,omitempty"`
+}
+
+// SetStatus sets the status code of the request's Response
+func (c *CoordinatedRequest) SetStatus(status int) {
+	c.ensureResponse()
+
+	c.Response.Status = status
+	c.responseChanged = true
+}
+
+// SetHeader sets a header on the request's Response, replacing any values it already has
+func (c *CoordinatedRequest) SetHeader(key, val string) {
+	c.ensureResponse()
+
+	c.Response.Headers[key] = []string{val}
+	c.responseChanged = true
+}
+
+// AddHeader adds a value to a header on the request's Response, keeping any values it already has
+// (needed for headers such as Set-Cookie that are sent once for each value)
+func (c *CoordinatedRequest) AddHeader(key, val string) {
+	c.ensureResponse()
+
+	c.Response.Headers[key] = append(c.Response.Headers[key], val)
+	c.responseChanged = true
+}
+
+// ResponseChanged returns true if the request's Response has been changed with SetStatus, SetHeader or AddHeader
+func (c *CoordinatedRequest) ResponseChanged() bool {
+	return c.responseChanged
+}
+
+// MergeResponse applies the status (if set) and headers of resp to the request's Response.
+// Each header in resp replaces all of the values of that header in the request's Response
+func (c *CoordinatedRequest) MergeResponse(resp Response) {
+	if resp.Status != 0 {
+		c.SetStatus(resp.Status)
+	}
+
+	if len(resp.Headers) == 0 {
+		return
+	}
+
+	c.ensureResponse()
+
+	for k, vals := range resp.Headers {
+		c.Response.Headers[k] = append([]string{}, vals...)
+	}
+
+	c.responseChanged = true
+}
+
+// SetState sets a key in the request's state, and records the change
+func (c *CoordinatedRequest) SetState(key string, val []byte) {
+	if c.State == nil {
+		c.State = map[string][]byte{}
+	}
+
+	c.State[key] = val
+
+	if c.stateChanges.Set == nil {
+		c.stateChanges.Set = map[string][]byte{}
+	}
+
+	c.stateChanges.Set[key] = val
+	c.stateChanges.Deleted = removeString(c.stateChanges.Deleted, key)
+}
+
+// DeleteState deletes a key from the request's state, and records the change
+func (c *CoordinatedRequest) DeleteState(key string) {
+	delete(c.State, key)
+	delete(c.stateChanges.Set, key)
+
+	c.stateChanges.Deleted = append(removeString(c.stateChanges.Deleted, key), key)
+}
+
+// StateChanges returns the changes made to the request's state with SetState and DeleteState
+func (c *CoordinatedRequest) StateChanges() StateChanges {
+	return c.stateChanges
+}
+
+// Empty returns true if there are no changes
+func (s StateChanges) Empty() bool {
+	return len(s.Set) == 0 && len(s.Deleted) == 0
+}
+
+// ApplyStateChanges applies changes made by a Runnable to the request's state
+func (c *CoordinatedRequest) ApplyStateChanges(changes StateChanges) {
+	for _, key := range changes.Deleted {
+		c.DeleteState(key)
+	}
+
+	for key, val := range changes.Set {
+		c.SetState(key, val)
+	}
+}
+
+func removeString(vals []string, val string) []string {
+	filtered := []string{}
+
+	for _, v := range vals {
+		if v != val {
+			filtered = append(filtered, v)
+		}
+	}
+
+	return filtered
+}
+
+func (c *CoordinatedRequest) ensureResponse() {
+	if c.Response == nil {
+		c.Response = &Response{}
+	}
+
+	if c.Response.Headers == nil {
+		c.Response.Headers = map[string][]string{}
+	}
 }
 
 // FromVKRequest creates a CoordinatedRequest from an http.Request
@@ -58,22 +213,21 @@ func FromVKRequest(r *http.Request, ctx *vk.Ctx) (*CoordinatedRequest, error) {
 
 // BodyField returns a field from the request body as a string
 func (c *CoordinatedRequest) BodyField(key string) (string, error) {
-	if c.bodyValues == nil {
-		if len(c.Body) == 0 {
-			return "", nil
-		}
-
-		vals := map[string]interface{}{}
+	if len(c.Body) == 0 {
+		return "", nil
+	}
 
-		if err := json.Unmarshal(c.Body, &vals); err != nil {
-			return "", errors.Wrap(err, "failed to Unmarshal request body")
-		}
+	body, err := c.bodyValue()
+	if err != nil {
+		return "", err
+	}
 
-		// cache the parsed body
-		c.bodyValues = vals
+	vals, ok := body.(map[string]interface{})
+	if !ok {
+		return "", errors.New("request body is not a JSON object")
 	}
 
-	interfaceVal, ok := c.bodyValues[key]
+	interfaceVal, ok := vals[key]
 	if !ok {
 		return "", fmt.Errorf("body does not contain field %s", key)
 	}
@@ -86,6 +240,95 @@ func (c *CoordinatedRequest) BodyField(key string) (string, error) {
 	return stringVal, nil
 }
 
+// BodyPath returns the value at path within the JSON request body. The path is either a JSON pointer (RFC 6901)
+// such as /user/emails/0, or a dotted path such as user.emails.0, with array elements selected by their index.
+// Strings are returned as their contents, and any other value (including objects and arrays) as raw JSON.
+// An empty body does not contain a value at any path
+func (c *CoordinatedRequest) BodyPath(path string) ([]byte, error) {
+	if len(bytes.TrimSpace(c.Body)) == 0 {
+		return nil, errors.Wrap(ErrBodyPathNotFound, path)
+	}
+
+	body, err := c.bodyValue()
+	if err != nil {
+		return nil, err
+	}
+
+	val := body
+
+	for _, s := range pathSegments(path) {
+		switch v := val.(type) {
+		case map[string]interface{}:
+			next, ok := v[s]
+			if !ok {
+				return nil, errors.Wrap(ErrBodyPathNotFound, path)
+			}
+
+			val = next
+		case []interface{}:
+			index, err := strconv.Atoi(s)
+			if err != nil || index < 0 || index >= len(v) || strconv.Itoa(index) != s {
+				return nil, errors.Wrap(ErrBodyPathNotFound, path)
+			}
+
+			val = v[index]
+		default:
+			return nil, errors.Wrap(ErrBodyPathNotFound, path)
+		}
+	}
+
+	if stringVal, ok := val.(string); ok {
+		return []byte(stringVal), nil
+	}
+
+	valJSON, err := json.Marshal(val)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to Marshal body value")
+	}
+
+	return valJSON, nil
+}
+
+// bodyValue parses and caches the JSON request body. Numbers are kept as
+// json.Number so that they are returned by BodyPath exactly as they were sent
+func (c *CoordinatedRequest) bodyValue() (interface{}, error) {
+	if c.bodyValues != nil {
+		return c.bodyValues, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(c.Body))
+	decoder.UseNumber()
+
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, errors.Wrap(err, "failed to Decode request body")
+	}
+
+	// cache the parsed body
+	c.bodyValues = body
+
+	return body, nil
+}
+
+// pathSegments splits a JSON pointer or dotted path into its segments. An empty path refers to the whole body
+func pathSegments(path string) []string {
+	if path == "" {
+		return []string{}
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return strings.Split(path, ".")
+	}
+
+	segments := strings.Split(path[1:], "/")
+
+	for i, s := range segments {
+		segments[i] = pointerUnescaper.Replace(s)
+	}
+
+	return segments
+}
+
 // FromJSON unmarshalls a CoordinatedRequest from JSON
 func FromJSON(jsonBytes []byte) (*CoordinatedRequest, error) {
 	req := CoordinatedRequest{}
@@ -0,0 +1,118 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// fileVersion is the version of the encrypted file format, which is the version byte
+// followed by the nonce and the AES-GCM sealed JSON object of secret names to values
+const fileVersion = byte(1)
+
+// FileProvider is a Provider that reads secrets from a local file encrypted with AES-GCM,
+// such as one written by WriteFile. The file is decrypted once, when the provider is created
+type FileProvider struct {
+	secrets map[string][]byte
+}
+
+// NewFileProvider creates a FileProvider from the file at path, decrypting it with key
+// (which must be 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256)
+func NewFileProvider(path string, key []byte) (*FileProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ReadFile")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to newAEAD")
+	}
+
+	if len(data) < 1+aead.NonceSize() {
+		return nil, errors.New("secrets file is too short")
+	}
+
+	if data[0] != fileVersion {
+		return nil, fmt.Errorf("secrets file has unknown version %d", data[0])
+	}
+
+	nonce := data[1 : 1+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, data[1+aead.NonceSize():], []byte{fileVersion})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to Open, the key may be incorrect")
+	}
+
+	secrets := map[string]string{}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, errors.Wrap(err, "failed to Unmarshal")
+	}
+
+	f := &FileProvider{
+		secrets: map[string][]byte{},
+	}
+
+	for name, val := range secrets {
+		f.secrets[name] = []byte(val)
+	}
+
+	return f, nil
+}
+
+// Secret returns the value of the named secret
+func (f *FileProvider) Secret(name string) ([]byte, error) {
+	val, exists := f.secrets[name]
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+
+	return append([]byte{}, val...), nil
+}
+
+// WriteFile encrypts secrets with key and writes them to path, to be read by NewFileProvider
+func WriteFile(path string, key []byte, secrets map[string]string) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return errors.Wrap(err, "failed to newAEAD")
+	}
+
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "failed to read nonce")
+	}
+
+	data := append([]byte{fileVersion}, nonce...)
+	data = aead.Seal(data, nonce, plaintext, []byte{fileVersion})
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to WriteFile")
+	}
+
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to NewCipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to NewGCM")
+	}
+
+	return aead, nil
+}
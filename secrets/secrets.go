@@ -0,0 +1,84 @@
+package secrets
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSecretNotFound is returned by a Provider when a secret does not exist
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Provider provides the values of secrets that Runnables can access with get_secret.
+// Implementations must be safe for concurrent use
+type Provider interface {
+	// Secret returns the value of the named secret, or ErrSecretNotFound if it does not exist
+	Secret(name string) ([]byte, error)
+}
+
+// EnvProvider is a Provider that reads secrets from environment variables
+type EnvProvider struct {
+	prefix string
+}
+
+// NewEnvProvider creates an EnvProvider that reads the secret with a given name from the environment variable
+// named prefix followed by the name in upper case, with any characters other than letters, digits and
+// underscores replaced by underscores (so with the prefix HIVE_SECRET_, db.password is HIVE_SECRET_DB_PASSWORD)
+func NewEnvProvider(prefix string) *EnvProvider {
+	e := &EnvProvider{
+		prefix: prefix,
+	}
+
+	return e
+}
+
+// Secret returns the value of the named secret
+func (e *EnvProvider) Secret(name string) ([]byte, error) {
+	val, exists := os.LookupEnv(e.prefix + envName(name))
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+
+	return []byte(val), nil
+}
+
+func envName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+
+	return strings.ToUpper(mapped)
+}
+
+// MemoryProvider is a Provider that holds secrets in memory, for tests
+type MemoryProvider struct {
+	secrets map[string][]byte
+}
+
+// NewMemoryProvider creates a MemoryProvider holding the given secrets
+func NewMemoryProvider(secrets map[string]string) *MemoryProvider {
+	m := &MemoryProvider{
+		secrets: map[string][]byte{},
+	}
+
+	for name, val := range secrets {
+		m.secrets[name] = []byte(val)
+	}
+
+	return m
+}
+
+// Secret returns the value of the named secret
+func (m *MemoryProvider) Secret(name string) ([]byte, error) {
+	val, exists := m.secrets[name]
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+
+	return append([]byte{}, val...), nil
+}
@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempDir"))
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets.enc")
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	if err := WriteFile(path, key, map[string]string{"db.password": "hunter2"}); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to WriteFile"))
+	}
+
+	if data, _ := ioutil.ReadFile(path); strings.Contains(string(data), "hunter2") {
+		t.Fatal("expected secret to be encrypted")
+	}
+
+	provider, err := NewFileProvider(path, key)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to NewFileProvider"))
+	}
+
+	if val, _ := provider.Secret("db.password"); string(val) != "hunter2" {
+		t.Errorf("expected hunter2, got %s", string(val))
+	}
+
+	if _, err := provider.Secret("missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected ErrSecretNotFound, got %v", err)
+	}
+
+	if _, err := NewFileProvider(path, []byte("fedcba9876543210fedcba9876543210")); err == nil {
+		t.Error("expected error decrypting with the wrong key")
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	os.Setenv("HIVE_SECRET_DB_PASSWORD", "hunter2")
+	defer os.Unsetenv("HIVE_SECRET_DB_PASSWORD")
+
+	provider := NewEnvProvider("HIVE_SECRET_")
+
+	if val, _ := provider.Secret("db.password"); string(val) != "hunter2" {
+		t.Errorf("expected hunter2, got %s", string(val))
+	}
+
+	if _, err := provider.Secret("db.user"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected ErrSecretNotFound, got %v", err)
+	}
+}
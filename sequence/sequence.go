@@ -0,0 +1,295 @@
+package sequence
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/directive"
+	"github.com/suborbital/hive-wasm/request"
+	"github.com/suborbital/hive/hive"
+)
+
+// Sequence represents the steps of a Directive handler, ready to be executed against CoordinatedRequests.
+// Single steps are run serially, and the fns within a group step are run concurrently.
+type Sequence struct {
+	directive *directive.Directive
+	handler   directive.Handler
+	do        hive.DoFunc
+
+	// the FQFN of each fn in the handler's steps, calculated once so
+	// that concurrent executions only read from the map
+	fqfns map[string]string
+}
+
+// attachedResult is implemented by results that wrap a Runnable's output along with other information, such as the
+// *wasm.RunResult returned by Runners that attach their output, so that the output and response can be unwrapped
+type attachedResult interface {
+	RunnableResult() ([]byte, *request.CoordinatedResponse)
+}
+
+// fnResult is the result of a single fn within a step
+type fnResult struct {
+	key          string
+	output       []byte
+	response     *request.Response
+	stateChanges request.StateChanges
+}
+
+// New creates a new Sequence for a handler within a Directive. The do func is
+// used to schedule each fn as a job, and is typically the Do method of the hive
+// instance that the Directive's bundle was loaded into
+func New(dir *directive.Directive, handler directive.Handler, do hive.DoFunc) *Sequence {
+	s := &Sequence{
+		directive: dir,
+		handler:   handler,
+		do:        do,
+		fqfns:     map[string]string{},
+	}
+
+	for _, step := range handler.Steps {
+		fns := append([]directive.CallableFn{step.CallableFn}, step.Group...)
+
+		for _, fn := range fns {
+			if fn.Fn == "" {
+				continue
+			}
+
+			// fns that do not exist are reported when they are scheduled
+			if fqfn, err := dir.FQFN(fn.Fn); err == nil {
+				s.fqfns[fn.Fn] = fqfn
+			}
+		}
+	}
+
+	return s
+}
+
+// Execute runs each step of the sequence, storing each fn's output in the request's
+// state (under its `as` name if one is set), and returns the handler's response.
+// Any response status and headers set by the fns are merged into req.Response,
+// and any state keys they set or delete are applied after their outputs are stored
+func (s *Sequence) Execute(req *request.CoordinatedRequest) ([]byte, error) {
+	if len(s.handler.Steps) == 0 {
+		return nil, errors.New("handler has no steps")
+	}
+
+	if req.State == nil {
+		req.State = map[string][]byte{}
+	}
+
+	var lastOutput []byte
+
+	for i, step := range s.handler.Steps {
+		var results []fnResult
+
+		if step.IsFn() {
+			result, err := s.runFn(step.CallableFn, req)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to run step %d", i)
+			}
+
+			results = []fnResult{*result}
+		} else if step.IsGroup() {
+			groupResults, err := s.runGroup(step.Group, req)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to run group at step %d", i)
+			}
+
+			results = groupResults
+		} else {
+			return nil, fmt.Errorf("step %d has neither Fn or Group", i)
+		}
+
+		// only merge the outputs once the whole step has completed
+		// so that fns within a group cannot see eachother's output
+		for _, r := range results {
+			req.State[r.key] = r.output
+			lastOutput = r.output
+
+			if r.response != nil {
+				req.MergeResponse(*r.response)
+			}
+
+			req.ApplyStateChanges(r.stateChanges)
+		}
+	}
+
+	if s.handler.Response == "" {
+		return lastOutput, nil
+	}
+
+	response, exists := req.State[s.handler.Response]
+	if !exists {
+		return nil, fmt.Errorf("response key %s does not exist in handler state", s.handler.Response)
+	}
+
+	return response, nil
+}
+
+// runFn schedules a single fn and waits for its result
+func (s *Sequence) runFn(fn directive.CallableFn, req *request.CoordinatedRequest) (*fnResult, error) {
+	res, err := s.scheduleFn(fn, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.awaitFn(fn, res)
+}
+
+// runGroup schedules every fn in a group at once, and then waits for all of their results
+func (s *Sequence) runGroup(fns []directive.CallableFn, req *request.CoordinatedRequest) ([]fnResult, error) {
+	pending := make([]*hive.Result, len(fns))
+
+	for i, fn := range fns {
+		res, err := s.scheduleFn(fn, req)
+		if err != nil {
+			return nil, err
+		}
+
+		pending[i] = res
+	}
+
+	results := make([]fnResult, len(fns))
+	var firstErr error
+
+	// wait for every result even if one fails, to ensure none are left dangling
+	for i, fn := range fns {
+		result, err := s.awaitFn(fn, pending[i])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		results[i] = *result
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return results, nil
+}
+
+func (s *Sequence) scheduleFn(fn directive.CallableFn, req *request.CoordinatedRequest) (*hive.Result, error) {
+	fqfn, exists := s.fqfns[fn.Fn]
+	if !exists {
+		return nil, fmt.Errorf("failed to FQFN for %s: fn does not exist", fn.Fn)
+	}
+
+	state, err := desiredState(fn, req.State)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to determine desired state for %s", fn.Fn)
+	}
+
+	// each fn gets its own copy of the request containing only its desired state
+	fnReq := *req
+	fnReq.State = state
+
+	reqJSON, err := fnReq.ToJSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ToJSON")
+	}
+
+	return s.do(hive.NewJob(fqfn, reqJSON)), nil
+}
+
+func (s *Sequence) awaitFn(fn directive.CallableFn, res *hive.Result) (*fnResult, error) {
+	output, err := res.Then()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fn %s returned an error", fn.Fn)
+	}
+
+	var response *request.Response
+	var stateChanges request.StateChanges
+
+	// the output attached to a result is not stored in the state, only the Runnable's own output
+	if attached, ok := output.(attachedResult); ok {
+		result, resp := attached.RunnableResult()
+
+		output = result
+		if resp != nil {
+			output = resp
+		}
+	}
+
+	// Wasm Runnables handling a request return their output along with
+	// the response status and headers and the state changes they set
+	if resp, ok := output.(*request.CoordinatedResponse); ok {
+		output = resp.Output
+		response = &resp.Response
+		stateChanges = resp.StateChanges
+	}
+
+	outputBytes, err := resultToBytes(output)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert output of fn %s", fn.Fn)
+	}
+
+	key := fn.Fn
+	if fn.As != "" {
+		key = fn.As
+	}
+
+	result := &fnResult{
+		key:          key,
+		output:       outputBytes,
+		response:     response,
+		stateChanges: stateChanges,
+	}
+
+	return result, nil
+}
+
+// desiredState returns the state that should be provided to a fn, based on its 'with' clause.
+// if the fn has no 'with' clause, it receives the full state
+func desiredState(fn directive.CallableFn, state map[string][]byte) (map[string][]byte, error) {
+	aliases, err := fn.ParseWith()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ParseWith")
+	}
+
+	desired := map[string][]byte{}
+
+	if len(aliases) == 0 {
+		for k, v := range state {
+			desired[k] = v
+		}
+
+		return desired, nil
+	}
+
+	for _, a := range aliases {
+		val, exists := state[a.Key]
+		if !exists {
+			return nil, fmt.Errorf("state key %s does not exist", a.Key)
+		}
+
+		desired[a.Alias] = val
+	}
+
+	return desired, nil
+}
+
+func resultToBytes(result interface{}) ([]byte, error) {
+	switch r := result.(type) {
+	case nil:
+		return []byte{}, nil
+	case []byte:
+		return r, nil
+	case string:
+		return []byte(r), nil
+	}
+
+	// otherwise, assume it's a struct of some kind,
+	// so JSON marshal it and return it
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to Marshal result")
+	}
+
+	return resultJSON, nil
+}
@@ -0,0 +1,450 @@
+package sequence
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/directive"
+	"github.com/suborbital/hive-wasm/request"
+	"github.com/suborbital/hive-wasm/wasm"
+	"github.com/suborbital/hive/hive"
+)
+
+// stateEcho returns its name along with the state it was given
+type stateEcho struct {
+	name string
+}
+
+func (s *stateEcho) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
+	req, err := request.FromJSON(job.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to FromJSON")
+	}
+
+	pairs := []string{}
+	for k, v := range req.State {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, string(v)))
+	}
+
+	sort.Strings(pairs)
+
+	return []byte(fmt.Sprintf("%s(%s)", s.name, strings.Join(pairs, ","))), nil
+}
+
+func (s *stateEcho) OnChange(_ hive.ChangeEvent) error { return nil }
+
+type failer struct{}
+
+func (f *failer) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
+	return nil, errors.New("failed on purpose")
+}
+
+func (f *failer) OnChange(_ hive.ChangeEvent) error { return nil }
+
+// redirecter sets a response status and header the way a Wasm Runnable would
+type redirecter struct{}
+
+func (r *redirecter) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
+	resp := &request.CoordinatedResponse{
+		Output: []byte("redirecting"),
+		Response: request.Response{
+			Status:  302,
+			Headers: map[string][]string{"Location": {"/login"}},
+		},
+	}
+
+	return resp, nil
+}
+
+func (r *redirecter) OnChange(_ hive.ChangeEvent) error { return nil }
+
+// authenticator sets and deletes state keys the way a Wasm Runnable would
+type authenticator struct{}
+
+func (a *authenticator) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
+	req, err := request.FromJSON(job.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to FromJSON")
+	}
+
+	req.SetState("token", []byte("abc123"))
+	req.DeleteState("stale")
+
+	resp := &request.CoordinatedResponse{
+		Output:       []byte("authenticated"),
+		StateChanges: req.StateChanges(),
+	}
+
+	return resp, nil
+}
+
+func (a *authenticator) OnChange(_ hive.ChangeEvent) error { return nil }
+
+func testDirective() *directive.Directive {
+	dir := &directive.Directive{
+		Identifier:  "dev.suborbital.appname",
+		AppVersion:  "v0.1.1",
+		AtmoVersion: "v0.0.6",
+		Runnables: []directive.Runnable{
+			{
+				Name:      "getUser",
+				Namespace: "db",
+			},
+			{
+				Name:      "getUserDetails",
+				Namespace: "db",
+			},
+			{
+				Name:      "returnUser",
+				Namespace: "default",
+			},
+			{
+				Name:      "fail",
+				Namespace: "default",
+			},
+			{
+				Name:      "redirect",
+				Namespace: "default",
+			},
+			{
+				Name:      "authenticate",
+				Namespace: "default",
+				StateKeys: []string{"token"},
+			},
+		},
+	}
+
+	return dir
+}
+
+func testHive(t *testing.T, dir *directive.Directive) *hive.Hive {
+	h := hive.New()
+
+	for _, r := range dir.Runnables {
+		name := r.Name
+		if r.Namespace != directive.NamespaceDefault {
+			name = fmt.Sprintf("%s#%s", r.Namespace, r.Name)
+		}
+
+		fqfn, err := dir.FQFN(name)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to FQFN"))
+		}
+
+		if r.Name == "fail" {
+			h.Handle(fqfn, &failer{})
+		} else if r.Name == "redirect" {
+			h.Handle(fqfn, &redirecter{})
+		} else if r.Name == "authenticate" {
+			h.Handle(fqfn, &authenticator{})
+		} else {
+			h.Handle(fqfn, &stateEcho{name: r.Name})
+		}
+	}
+
+	return h
+}
+
+func TestSequenceGroupAndAliases(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	handler := directive.Handler{
+		Input: directive.Input{
+			Type:     directive.InputTypeRequest,
+			Method:   "GET",
+			Resource: "/api/v1/user",
+		},
+		Steps: []directive.Executable{
+			{
+				Group: []directive.CallableFn{
+					{
+						Fn: "db#getUser",
+						As: "user",
+					},
+					{
+						Fn: "db#getUserDetails",
+						As: "details",
+					},
+				},
+			},
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "returnUser",
+					With: []string{
+						"u: user",
+						"d: details",
+					},
+				},
+			},
+		},
+	}
+
+	req := &request.CoordinatedRequest{
+		Method: "GET",
+		URL:    "/api/v1/user",
+		ID:     "abc123",
+		State: map[string][]byte{
+			"hello": []byte("world"),
+		},
+	}
+
+	seq := New(dir, handler, h.Do)
+
+	output, err := seq.Execute(req)
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Execute"))
+		return
+	}
+
+	expected := "returnUser(d=getUserDetails(hello=world),u=getUser(hello=world))"
+	if string(output) != expected {
+		t.Errorf("expected %q, got %q", expected, string(output))
+	}
+
+	if string(req.State["user"]) != "getUser(hello=world)" {
+		t.Errorf("expected state key 'user' to be set, got %q", string(req.State["user"]))
+	}
+
+	if _, exists := req.State["returnUser"]; !exists {
+		t.Error("expected state key 'returnUser' to be set")
+	}
+}
+
+func TestSequenceResponseKey(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	handler := directive.Handler{
+		Steps: []directive.Executable{
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "db#getUser",
+					As: "user",
+				},
+			},
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "returnUser",
+				},
+			},
+		},
+		Response: "user",
+	}
+
+	output, err := New(dir, handler, h.Do).Execute(&request.CoordinatedRequest{})
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Execute"))
+		return
+	}
+
+	if string(output) != "getUser()" {
+		t.Errorf("expected 'getUser()', got %q", string(output))
+	}
+}
+
+func TestSequenceResponseStatusAndHeaders(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	handler := directive.Handler{
+		Steps: []directive.Executable{
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "redirect",
+				},
+			},
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "returnUser",
+				},
+			},
+		},
+	}
+
+	req := &request.CoordinatedRequest{}
+
+	output, err := New(dir, handler, h.Do).Execute(req)
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Execute"))
+		return
+	}
+
+	if string(output) != "returnUser(redirect=redirecting)" {
+		t.Errorf("expected 'returnUser(redirect=redirecting)', got %q", string(output))
+	}
+
+	if req.Response == nil || req.Response.Status != 302 || strings.Join(req.Response.Headers["Location"], ",") != "/login" {
+		t.Errorf("expected response status and headers to be set, got %+v", req.Response)
+	}
+}
+
+func TestSequenceAttachedOutput(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	fqfn, err := dir.FQFN("redirect")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to FQFN"))
+	}
+
+	// a Wasm Runner attaching its output returns a *wasm.RunResult, which is unwrapped
+	h.Handle(fqfn, wasm.NewRunner("../wasm/testdata/response/response.wat", wasm.Output(wasm.OutputLogAndAttach)))
+
+	handler := directive.Handler{
+		Steps: []directive.Executable{
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "redirect",
+				},
+			},
+		},
+	}
+
+	req := &request.CoordinatedRequest{
+		Method: "GET",
+		URL:    "/account",
+		ID:     "abc123",
+	}
+
+	output, err := New(dir, handler, h.Do).Execute(req)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Execute"))
+	}
+
+	if string(output) != "redirecting" {
+		t.Errorf("expected 'redirecting', got %q", string(output))
+	}
+
+	if req.Response == nil || req.Response.Status != 302 || strings.Join(req.Response.Headers["Location"], ",") != "/login" {
+		t.Errorf("expected response status and headers to be set, got %+v", req.Response)
+	}
+
+	// values added to the same header by a Runnable must all be kept
+	if cookies := req.Response.Headers["Set-Cookie"]; strings.Join(cookies, ";") != "session=1;theme=dark" {
+		t.Errorf("expected both cookies to be set, got %v", cookies)
+	}
+}
+
+func TestSequenceStateChanges(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	handler := directive.Handler{
+		Input: directive.Input{
+			Type:     directive.InputTypeRequest,
+			Method:   "GET",
+			Resource: "/api/v1/user",
+		},
+		Steps: []directive.Executable{
+			{
+				CallableFn: directive.CallableFn{
+					Fn: "authenticate",
+				},
+			},
+			{
+				CallableFn: directive.CallableFn{
+					Fn:   "returnUser",
+					With: []string{"t: token"},
+				},
+			},
+		},
+	}
+
+	// the key declared by authenticate can be referenced by the steps that follow it
+	dir.Handlers = []directive.Handler{handler}
+
+	if err := dir.Validate(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Validate"))
+	}
+
+	req := &request.CoordinatedRequest{
+		State: map[string][]byte{"stale": []byte("old")},
+	}
+
+	output, err := New(dir, handler, h.Do).Execute(req)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Execute"))
+	}
+
+	if string(output) != "returnUser(t=abc123)" {
+		t.Errorf("expected 'returnUser(t=abc123)', got %q", string(output))
+	}
+
+	if _, exists := req.State["stale"]; exists {
+		t.Error("expected stale state key to have been deleted")
+	}
+
+	if string(req.State["authenticate"]) != "authenticated" {
+		t.Errorf("expected authenticate's output to be stored, got %q", string(req.State["authenticate"]))
+	}
+}
+
+func TestSequenceGroupError(t *testing.T) {
+	dir := testDirective()
+	h := testHive(t, dir)
+
+	handler := directive.Handler{
+		Steps: []directive.Executable{
+			{
+				Group: []directive.CallableFn{
+					{
+						Fn: "db#getUser",
+					},
+					{
+						Fn: "fail",
+					},
+				},
+			},
+		},
+		Response: "db#getUser",
+	}
+
+	if _, err := New(dir, handler, h.Do).Execute(&request.CoordinatedRequest{}); err == nil {
+		t.Error("sequence should have failed")
+	} else {
+		fmt.Println("sequence properly failed:", err)
+	}
+}
+
+func TestSequenceConcurrentExecute(t *testing.T) {
+	// the hive is set up with a separate copy of the Directive, so that its FQFNs have not been calculated
+	dir := testDirective()
+	h := testHive(t, testDirective())
+
+	handler := directive.Handler{
+		Steps: []directive.Executable{
+			{
+				Group: []directive.CallableFn{
+					{
+						Fn: "db#getUser",
+					},
+					{
+						Fn: "db#getUserDetails",
+					},
+				},
+			},
+		},
+		Response: "db#getUser",
+	}
+
+	seq := New(dir, handler, h.Do)
+
+	errs := make(chan error, 8)
+
+	for i := 0; i < 8; i++ {
+		go func() {
+			_, err := seq.Execute(&request.CoordinatedRequest{})
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(errors.Wrap(err, "failed to Execute"))
+		}
+	}
+}
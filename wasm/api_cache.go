@@ -1,11 +1,14 @@
 package wasm
 
 import (
+	"encoding/binary"
+
 	"github.com/pkg/errors"
+	"github.com/suborbital/hive/hive"
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
-func cacheSet() *HostFn {
+func cacheSet(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		keyPointer := args[0].I32()
 		keySize := args[1].I32()
@@ -14,7 +17,7 @@ func cacheSet() *HostFn {
 		ttl := args[4].I32()
 		ident := args[5].I32()
 
-		ret := cache_set(keyPointer, keySize, valPointer, valSize, ttl, ident)
+		ret := rt.cache_set(keyPointer, keySize, valPointer, valSize, ttl, ident)
 
 		return ret, nil
 	}
@@ -22,27 +25,42 @@ func cacheSet() *HostFn {
 	return newHostFn("cache_set", 6, true, fn)
 }
 
-func cache_set(keyPointer int32, keySize int32, valPointer int32, valSize int32, ttl int32, identifier int32) int32 {
-	inst, err := instanceForIdentifier(identifier)
+func (rt *Runtime) cache_set(keyPointer int32, keySize int32, valPointer int32, valSize int32, ttl int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return -1
 	}
 
-	key := inst.readMemory(keyPointer, keySize)
-	val := inst.readMemory(valPointer, valSize)
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
 
-	logger.Debug("[hive-wasm] setting cache key", string(key))
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
 
-	if err := inst.hiveCtx.Cache.Set(string(key), val, int(ttl)); err != nil {
-		logger.ErrorString("[hive-wasm] failed to set cache key", string(key), err.Error())
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache value"))
+		return errCodeMemoryAccess
+	}
+
+	rt.logger.Debug("[hive-wasm] setting cache key", string(key))
+
+	if err := ops.set(string(key), val, int(ttl)); err != nil {
+		rt.logger.ErrorString("[hive-wasm] failed to set cache key", string(key), err.Error())
 		return -2
 	}
 
 	return 0
 }
 
-func cacheGet() *HostFn {
+func cacheGet(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		keyPointer := args[0].I32()
 		keySize := args[1].I32()
@@ -50,7 +68,7 @@ func cacheGet() *HostFn {
 		destMaxSize := args[3].I32()
 		ident := args[4].I32()
 
-		ret := cache_get(keyPointer, keySize, destPointer, destMaxSize, ident)
+		ret := rt.cache_get(keyPointer, keySize, destPointer, destMaxSize, ident)
 
 		return ret, nil
 	}
@@ -58,28 +76,323 @@ func cacheGet() *HostFn {
 	return newHostFn("cache_get", 5, true, fn)
 }
 
-func cache_get(keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
-	inst, err := instanceForIdentifier(identifier)
+func (rt *Runtime) cache_get(keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return -1
 	}
 
-	key := inst.readMemory(keyPointer, keySize)
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
 
-	logger.Debug("[hive-wasm] getting cache key", string(key))
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
+
+	rt.logger.Debug("[hive-wasm] getting cache key", string(key))
 
-	val, err := inst.hiveCtx.Cache.Get(string(key))
+	val, err := ops.get(string(key))
 	if err != nil {
-		logger.ErrorString("[hive-wasm] failed to get cache key", string(key), err.Error())
+		if errors.Is(err, hive.ErrCacheKeyNotFound) {
+			return errCodeNotFound
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to get cache key", string(key), err.Error())
 		return -2
 	}
 
 	valBytes := []byte(val)
 
 	if len(valBytes) <= int(destMaxSize) {
-		inst.writeMemoryAtLocation(destPointer, valBytes)
+		if err := inst.writeMemoryAtLocation(destPointer, valBytes); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for cache value"))
+			return errCodeMemoryAccess
+		}
 	}
 
 	return int32(len(valBytes))
 }
+
+func cacheDelete(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		ident := args[2].I32()
+
+		ret := rt.cache_delete(keyPointer, keySize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("cache_delete", 3, true, fn)
+}
+
+func (rt *Runtime) cache_delete(keyPointer int32, keySize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
+
+	rt.logger.Debug("[hive-wasm] deleting cache key", string(key))
+
+	if err := ops.delete(string(key)); err != nil {
+		if errors.Is(err, hive.ErrCacheKeyNotFound) {
+			return errCodeNotFound
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to delete cache key", string(key), err.Error())
+		return -2
+	}
+
+	return 0
+}
+
+func cacheExists(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		ident := args[2].I32()
+
+		ret := rt.cache_exists(keyPointer, keySize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("cache_exists", 3, true, fn)
+}
+
+func (rt *Runtime) cache_exists(keyPointer int32, keySize int32, identifier int32) int32 {
+	// cache_exists returns 1 if the key exists and 0 if it does not
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
+
+	if _, err := ops.get(string(key)); err != nil {
+		if errors.Is(err, hive.ErrCacheKeyNotFound) {
+			return 0
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to get cache key", string(key), err.Error())
+		return -2
+	}
+
+	return 1
+}
+
+func cacheIncr(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		delta := args[2].I64()
+		ttl := args[3].I32()
+		destPointer := args[4].I32()
+		ident := args[5].I32()
+
+		ret := rt.cache_incr(keyPointer, keySize, delta, ttl, destPointer, ident)
+
+		return ret, nil
+	}
+
+	args := []wasmer.ValueKind{wasmer.I32, wasmer.I32, wasmer.I64, wasmer.I32, wasmer.I32, wasmer.I32}
+
+	return newHostFnWithTypes("cache_incr", args, []wasmer.ValueKind{wasmer.I32}, fn)
+}
+
+func (rt *Runtime) cache_incr(keyPointer int32, keySize int32, delta int64, ttl int32, destPointer int32, identifier int32) int32 {
+	// cache_incr atomically adds delta to the integer stored at key (treating a missing key as 0), and
+	// writes the result into memory at destPointer as 8 little-endian bytes. Values are stored as decimal strings
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
+
+	val, err := ops.incr(string(key), delta, int(ttl))
+	if err != nil {
+		if errors.Is(err, errCacheValueNotInteger) {
+			return -3
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to increment cache key", string(key), err.Error())
+		return -2
+	}
+
+	valBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(valBytes, uint64(val))
+
+	if err := inst.writeMemoryAtLocation(destPointer, valBytes); err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for cache value"))
+		return errCodeMemoryAccess
+	}
+
+	return 0
+}
+
+func cacheCAS(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		oldPointer := args[2].I32()
+		oldSize := args[3].I32()
+		valPointer := args[4].I32()
+		valSize := args[5].I32()
+		ttl := args[6].I32()
+		ident := args[7].I32()
+
+		ret := rt.cache_cas(keyPointer, keySize, oldPointer, oldSize, valPointer, valSize, ttl, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("cache_cas", 8, true, fn)
+}
+
+func (rt *Runtime) cache_cas(keyPointer int32, keySize int32, oldPointer int32, oldSize int32, valPointer int32, valSize int32, ttl int32, identifier int32) int32 {
+	// cache_cas atomically sets key to the new value if its current value is equal to the old value, or if
+	// it does not exist when oldSize is -1. It returns 1 if the value was set, and 0 if it was not
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key"))
+		return errCodeMemoryAccess
+	}
+
+	var old []byte
+	if oldSize != -1 {
+		old, err = inst.readMemory(oldPointer, oldSize)
+		if err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for old cache value"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache value"))
+		return errCodeMemoryAccess
+	}
+
+	set, err := ops.compareAndSet(string(key), old, val, int(ttl))
+	if err != nil {
+		rt.logger.ErrorString("[hive-wasm] failed to compare and set cache key", string(key), err.Error())
+		return -2
+	}
+
+	if set {
+		return 1
+	}
+
+	return 0
+}
+
+func cacheKeys(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		prefixPointer := args[0].I32()
+		prefixSize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.cache_keys(prefixPointer, prefixSize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("cache_keys", 5, true, fn)
+}
+
+func (rt *Runtime) cache_keys(prefixPointer int32, prefixSize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// cache_keys writes the sorted list of keys beginning with the prefix into memory at destPointer and returns its size.
+	// The list is encoded as a little-endian uint32 count followed by each key as a uint32 length and its bytes
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	ops, err := rt.cacheFor(inst)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to cacheFor"))
+		return errCodeUnavailable
+	}
+
+	prefix, err := inst.readMemory(prefixPointer, prefixSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for cache key prefix"))
+		return errCodeMemoryAccess
+	}
+
+	keys, err := ops.keys(string(prefix))
+	if err != nil {
+		rt.logger.ErrorString("[hive-wasm] failed to list cache keys", string(prefix), err.Error())
+		return -2
+	}
+
+	encoded := encodeList(keys)
+
+	// if the size is greater than what's been allocated, then the module will increase the size and try again
+	if len(encoded) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, encoded); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for cache keys"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(encoded))
+}
@@ -0,0 +1,53 @@
+package wasm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func getConfig(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.get_config(keyPointer, keySize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("get_config", 5, true, fn)
+}
+
+func (rt *Runtime) get_config(keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for config key"))
+		return errCodeMemoryAccess
+	}
+
+	val, exists := inst.env.opts.config[string(key)]
+	if !exists {
+		return errCodeNotFound
+	}
+
+	valBytes := []byte(val)
+
+	// if the size is greater than what's been allocated, then the module will increase the size and try again
+	if len(valBytes) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, valBytes); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for config value"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(valBytes))
+}
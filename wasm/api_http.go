@@ -1,8 +1,7 @@
 package wasm
 
 import (
-	"bytes"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -12,10 +11,13 @@ import (
 )
 
 const (
-	methodGet    = int32(1)
-	methodPost   = int32(2)
-	methodPatch  = int32(3)
-	methodDelete = int32(4)
+	methodGet     = int32(1)
+	methodPost    = int32(2)
+	methodPatch   = int32(3)
+	methodDelete  = int32(4)
+	methodPut     = int32(5)
+	methodHead    = int32(6)
+	methodOptions = int32(7)
 )
 
 const (
@@ -25,13 +27,27 @@ const (
 )
 
 var methodValToMethod = map[int32]string{
-	methodGet:    http.MethodGet,
-	methodPost:   http.MethodPost,
-	methodPatch:  http.MethodPatch,
-	methodDelete: http.MethodDelete,
+	methodGet:     http.MethodGet,
+	methodPost:    http.MethodPost,
+	methodPatch:   http.MethodPatch,
+	methodDelete:  http.MethodDelete,
+	methodPut:     http.MethodPut,
+	methodHead:    http.MethodHead,
+	methodOptions: http.MethodOptions,
 }
 
-func fetchURL() *HostFn {
+// isSupportedMethod returns true if method is one of the HTTP methods that Runnables can use
+func isSupportedMethod(method string) bool {
+	for _, m := range methodValToMethod {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fetchURL(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		method := args[0].I32()
 		urlPointer := args[1].I32()
@@ -42,7 +58,7 @@ func fetchURL() *HostFn {
 		destMaxSize := args[6].I32()
 		ident := args[7].I32()
 
-		ret := fetch_url(method, urlPointer, urlSize, bodyPointer, bodySize, destPointer, destMaxSize, ident)
+		ret := rt.fetch_url(method, urlPointer, urlSize, bodyPointer, bodySize, destPointer, destMaxSize, ident)
 
 		return ret, nil
 	}
@@ -50,73 +66,253 @@ func fetchURL() *HostFn {
 	return newHostFn("fetch_url", 8, true, fn)
 }
 
-func fetch_url(method int32, urlPointer int32, urlSize int32, bodyPointer int32, bodySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+func (rt *Runtime) fetch_url(method int32, urlPointer int32, urlSize int32, bodyPointer int32, bodySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
 	// fetch makes a network request on bahalf of the wasm runner.
 	// fetch writes the http response body into memory starting at returnBodyPointer, and the return value is a pointer to that memory
-	inst, err := instanceForIdentifier(identifier)
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return -1
 	}
 
-	httpMethod, exists := methodValToMethod[method]
-	if !exists {
-		logger.ErrorString("invalid method provided")
-		return -2
+	urlBytes, err := inst.readMemory(urlPointer, urlSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for URL"))
+		return errCodeMemoryAccess
+	}
+
+	body, err := inst.readMemory(bodyPointer, bodySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for request body"))
+		return errCodeMemoryAccess
 	}
 
-	urlBytes := inst.readMemory(urlPointer, urlSize)
+	// the key is length-prefixed so that different URL and body pairs cannot produce the same key
+	key := fmt.Sprintf("fetch_url:%d:%d:%s%s", method, len(urlBytes), urlBytes, body)
+
+	return rt.fetch(inst, key, destPointer, destMaxSize, func() (*outboundRequest, error) {
+		httpMethod, exists := methodValToMethod[method]
+		if !exists {
+			return nil, errors.New("invalid method provided")
+		}
+
+		// the URL is encoded with headers added on the end, each seperated by ::
+		// eg. https://google.com/somepage::authorization:bearer qdouwrnvgoquwnrg::anotherheader:nicetomeetyou
+		urlParts := strings.Split(string(urlBytes), "::")
+
+		headers, err := parseHTTPHeaders(urlParts)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse URL headers")
+		}
+
+		req := &outboundRequest{
+			method:  httpMethod,
+			url:     urlParts[0],
+			headers: *headers,
+			body:    body,
+		}
+
+		return req, nil
+	})
+}
+
+func fetchRequest(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		reqPointer := args[0].I32()
+		reqSize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.fetch_request(reqPointer, reqSize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
 
-	// the URL is encoded with headers added on the end, each seperated by ::
-	// eg. https://google.com/somepage::authorization:bearer qdouwrnvgoquwnrg::anotherheader:nicetomeetyou
-	urlParts := strings.Split(string(urlBytes), "::")
-	urlString := urlParts[0]
+	return newHostFn("fetch_request", 5, true, fn)
+}
 
-	headers, err := parseHTTPHeaders(urlParts)
+func (rt *Runtime) fetch_request(reqPointer int32, reqSize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// fetch_request makes a network request described by a request encoded by the Runnable (see decodeOutboundRequest),
+	// writes the response body into memory at destPointer, and returns its size, in the same way as fetch_url
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "could not parse URL headers"))
-		return -2
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
 	}
 
-	urlObj, err := url.Parse(urlString)
+	encoded, err := inst.readMemory(reqPointer, reqSize)
 	if err != nil {
-		logger.ErrorString("couldn't parse URL")
-		return -2
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for request"))
+		return errCodeMemoryAccess
 	}
 
-	body := inst.readMemory(bodyPointer, bodySize)
+	key := fmt.Sprintf("fetch_request:%s", encoded)
+
+	return rt.fetch(inst, key, destPointer, destMaxSize, func() (*outboundRequest, error) {
+		return decodeOutboundRequest(encoded)
+	})
+}
+
+// fetch makes the request built by buildReq on behalf of inst (or uses the buffered response if the Runnable is
+// repeating the request identified by key with a larger buffer), and writes the response body into memory at destPointer
+func (rt *Runtime) fetch(inst *wasmInstance, key string, destPointer int32, destMaxSize int32, buildReq func() (*outboundRequest, error)) int32 {
+	resp := inst.lastFetch
 
-	if len(body) > 0 {
-		if headers.Get("Content-Type") == "" {
-			headers.Add("Content-Type", contentTypeOctetStream)
+	// if the Runnable is repeating a request whose response did not fit in its buffer,
+	// the buffered response is used rather than sending the request again
+	if resp == nil || !resp.pending || resp.key != key {
+		// a failed fetch must not leave the previous response behind
+		inst.lastFetch = nil
+
+		req, err := buildReq()
+		if err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to build request"))
+			return -2
+		}
+
+		urlObj, err := url.Parse(req.url)
+		if err != nil {
+			rt.logger.ErrorString("couldn't parse URL")
+			return -2
 		}
+
+		if len(req.body) > 0 {
+			if req.headers.Get("Content-Type") == "" {
+				req.headers.Add("Content-Type", contentTypeOctetStream)
+			}
+		}
+
+		resp, err = inst.env.doFetch(req.method, urlObj.String(), req.headers, req.body)
+		if err != nil {
+			var deniedErr *EgressDeniedError
+			if errors.As(err, &deniedErr) {
+				rt.auditEgressDenied(inst, req.method, urlObj.String(), deniedErr)
+				return errCodeEgressDenied
+			} else if errors.Is(err, errResponseTooLarge) {
+				rt.logger.ErrorString("[hive-wasm] response exceeded maximum size for", urlObj.String())
+				return errCodeResponseTooLarge
+			}
+
+			rt.logger.Error(errors.Wrap(err, "failed to doFetch"))
+			return -3
+		}
+
+		resp.key = key
+		inst.lastFetch = resp
 	}
 
-	req, err := http.NewRequest(httpMethod, urlObj.String(), bytes.NewBuffer(body))
+	// if the size is greater than what's been allocated, then the module will increase the size and try again
+	resp.pending = len(resp.body) > int(destMaxSize)
+	size := int32(len(resp.body))
+
+	if !resp.pending {
+		if err := inst.writeMemoryAtLocation(destPointer, resp.body); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for response body"))
+			return errCodeMemoryAccess
+		}
+
+		// only the status and headers are needed once the body has been delivered
+		resp.body = nil
+	}
+
+	return size
+}
+
+func fetchStatus(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		ident := args[0].I32()
+
+		ret := rt.fetch_status(ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("fetch_status", 1, true, fn)
+}
+
+func (rt *Runtime) fetch_status(identifier int32) int32 {
+	// fetch_status returns the status code of the response to the Runnable's last successful call to fetch_url
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.ErrorString("failed to build request")
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	if inst.lastFetch == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to get fetch status without a successful fetch")
 		return -2
 	}
 
-	req.Header = *headers
+	return int32(inst.lastFetch.status)
+}
+
+func fetchHeader(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
 
-	resp, err := http.DefaultClient.Do(req)
+		ret := rt.fetch_header(keyPointer, keySize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("fetch_header", 5, true, fn)
+}
+
+func (rt *Runtime) fetch_header(keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// fetch_header writes the value of a header from the response to the Runnable's last successful call to fetch_url
+	// into memory at destPointer, and returns its size. Multiple values for the same header are joined with commas
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "failed to Do request"))
-		return -3
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
 	}
 
-	defer resp.Body.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	if inst.lastFetch == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to get fetch header without a successful fetch")
+		return -2
+	}
+
+	keyBytes, err := inst.readMemory(keyPointer, keySize)
 	if err != nil {
-		logger.ErrorString("failed to Read response body")
-		return -4
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for fetch header key"))
+		return errCodeMemoryAccess
 	}
 
+	vals, exists := inst.lastFetch.headers[http.CanonicalHeaderKey(string(keyBytes))]
+	if !exists {
+		return -3
+	}
+
+	valBytes := []byte(strings.Join(vals, ","))
+
 	// if the size is greater than what's been allocated, then the module will increase the size and try again
-	if len(respBytes) <= int(destMaxSize) {
-		inst.writeMemoryAtLocation(destPointer, respBytes)
+	if len(valBytes) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, valBytes); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for fetch header"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(valBytes))
+}
+
+// auditEgressDenied logs a request that was denied by the egress policy of the instance's environment
+func (rt *Runtime) auditEgressDenied(inst *wasmInstance, method, urlString string, deniedErr *EgressDeniedError) {
+	audit := egressAudit{
+		Runnable: inst.env.runnableName(),
+		Method:   method,
+		URL:      urlString,
+		Reason:   deniedErr.Reason,
+	}
+
+	if req := inst.jobRequest(); req != nil {
+		audit.RequestID = req.ID
 	}
 
-	return int32(len(respBytes))
+	rt.logger.CreateScoped(audit).Warn("[hive-wasm] egress denied for Wasm Runnable")
 }
@@ -0,0 +1,137 @@
+package wasm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive/hive"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func invokeFn(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		namePointer := args[0].I32()
+		nameSize := args[1].I32()
+		inputPointer := args[2].I32()
+		inputSize := args[3].I32()
+		destPointer := args[4].I32()
+		destMaxSize := args[5].I32()
+		ident := args[6].I32()
+
+		ret := rt.invoke_fn(namePointer, nameSize, inputPointer, inputSize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("invoke_fn", 7, true, fn)
+}
+
+func (rt *Runtime) invoke_fn(namePointer int32, nameSize int32, inputPointer int32, inputSize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// invoke_fn schedules a job on the hive for the function with the given name (its job name or FQFN), waits for it to
+	// complete (for at most the Runner's invoke timeout), and writes its output into memory at destPointer. If the output is larger than destMaxSize, its size is
+	// returned and it is kept so that the Runnable can repeat the call with a larger buffer without invoking the function again
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	hiveCtx := inst.jobCtx()
+	if hiveCtx == nil {
+		return errCodeUnavailable
+	}
+
+	name, err := inst.readMemory(namePointer, nameSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for invoked function name"))
+		return errCodeMemoryAccess
+	}
+
+	input, err := inst.readMemory(inputPointer, inputSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for invoked function input"))
+		return errCodeMemoryAccess
+	}
+
+	key := fmt.Sprintf("%d:%s%s", len(name), name, input)
+
+	var output []byte
+
+	if inst.pendingInvoke != nil && inst.pendingInvoke.key == key {
+		output = inst.pendingInvoke.output
+	} else {
+		inst.pendingInvoke = nil
+
+		if inst.invokeDepth >= inst.env.maxInvokeDepth() {
+			rt.logger.Warn(fmt.Sprintf("[hive-wasm] %s exceeded the maximum invoke_fn depth invoking %s", inst.env.runnableName(), name))
+			return errCodeDepthExceeded
+		}
+
+		if !inst.env.canInvoke(string(name)) {
+			rt.logger.Warn(fmt.Sprintf("[hive-wasm] %s is not permitted to invoke %s", inst.env.runnableName(), name))
+			return errCodeAccessDenied
+		}
+
+		// a function that led to this one may be waiting on the only worker that could run it
+		if inst.invokesCycle(string(name)) {
+			rt.logger.Warn(fmt.Sprintf("[hive-wasm] %s attempted to invoke %s, which led to it being invoked", inst.env.runnableName(), name))
+			return errCodeInvokeCycle
+		}
+
+		invocation := &Invocation{
+			Input: input,
+			Depth: inst.invokeDepth + 1,
+			Chain: inst.invokeChain(string(name)),
+		}
+
+		result := hiveCtx.Do(hive.NewJob(string(name), invocation))
+
+		resultChan := make(chan invokeJobResult, 1)
+
+		// the wait is bounded since the invoked function may never be run, for example if every worker
+		// that could run it is occupied by a Runnable waiting on it, and this instance's lock is held meanwhile
+		go func() {
+			res, err := result.Then()
+			resultChan <- invokeJobResult{res: res, err: err}
+		}()
+
+		timer := time.NewTimer(inst.env.invokeTimeout())
+		defer timer.Stop()
+
+		var res interface{}
+
+		select {
+		case jobResult := <-resultChan:
+			if jobResult.err != nil {
+				rt.logger.ErrorString("[hive-wasm] invoked function", string(name), "failed:", jobResult.err.Error())
+				return -3
+			}
+
+			res = jobResult.res
+		case <-timer.C:
+			rt.logger.ErrorString("[hive-wasm] invoked function", string(name), "timed out")
+			return -3
+		}
+
+		output, err = invokeOutput(res)
+		if err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to invokeOutput"))
+			return -2
+		}
+	}
+
+	if len(output) > int(destMaxSize) {
+		inst.pendingInvoke = &invokeResult{key: key, output: output}
+		return int32(len(output))
+	}
+
+	inst.pendingInvoke = nil
+
+	if err := inst.writeMemoryAtLocation(destPointer, output); err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for invoked function output"))
+		return errCodeMemoryAccess
+	}
+
+	return int32(len(output))
+}
@@ -0,0 +1,229 @@
+package wasm
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/kv"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func kvGet(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.kv_get(keyPointer, keySize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("kv_get", 5, true, fn)
+}
+
+func (rt *Runtime) kv_get(keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	store := kvFor(inst)
+	if store == nil {
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for kv key"))
+		return errCodeMemoryAccess
+	}
+
+	val, err := store.Get(string(key))
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return errCodeNotFound
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to get kv key", string(key), err.Error())
+		return -2
+	}
+
+	// if the size is greater than what's been allocated, then the module will increase the size and try again
+	if len(val) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, val); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for kv value"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(val))
+}
+
+func kvPut(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		valPointer := args[2].I32()
+		valSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.kv_put(keyPointer, keySize, valPointer, valSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("kv_put", 5, true, fn)
+}
+
+func (rt *Runtime) kv_put(keyPointer int32, keySize int32, valPointer int32, valSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	store := kvFor(inst)
+	if store == nil {
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for kv key"))
+		return errCodeMemoryAccess
+	}
+
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for kv value"))
+		return errCodeMemoryAccess
+	}
+
+	rt.logger.Debug("[hive-wasm] putting kv key", string(key))
+
+	if err := store.Put(string(key), val); err != nil {
+		rt.logger.ErrorString("[hive-wasm] failed to put kv key", string(key), err.Error())
+		return -2
+	}
+
+	return 0
+}
+
+func kvDelete(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		ident := args[2].I32()
+
+		ret := rt.kv_delete(keyPointer, keySize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("kv_delete", 3, true, fn)
+}
+
+func (rt *Runtime) kv_delete(keyPointer int32, keySize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	store := kvFor(inst)
+	if store == nil {
+		return errCodeUnavailable
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for kv key"))
+		return errCodeMemoryAccess
+	}
+
+	rt.logger.Debug("[hive-wasm] deleting kv key", string(key))
+
+	if err := store.Delete(string(key)); err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return errCodeNotFound
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to delete kv key", string(key), err.Error())
+		return -2
+	}
+
+	return 0
+}
+
+func kvScan(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		prefixPointer := args[0].I32()
+		prefixSize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.kv_scan(prefixPointer, prefixSize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("kv_scan", 5, true, fn)
+}
+
+func (rt *Runtime) kv_scan(prefixPointer int32, prefixSize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// kv_scan writes the sorted list of keys beginning with the prefix into memory at destPointer and returns
+	// its size, encoded in the same way as the list written by cache_keys
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	store := kvFor(inst)
+	if store == nil {
+		return errCodeUnavailable
+	}
+
+	prefix, err := inst.readMemory(prefixPointer, prefixSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for kv key prefix"))
+		return errCodeMemoryAccess
+	}
+
+	keys, err := store.Scan(string(prefix))
+	if err != nil {
+		rt.logger.ErrorString("[hive-wasm] failed to scan kv keys", string(prefix), err.Error())
+		return -2
+	}
+
+	encoded := encodeList(keys)
+
+	if len(encoded) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, encoded); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for kv keys"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(encoded))
+}
+
+// kvFor returns the KV store for an instance, scoped as configured, or nil if it has none
+func kvFor(inst *wasmInstance) kv.Store {
+	if inst.env.opts.kvStore == nil {
+		return nil
+	}
+
+	return kv.Scoped(inst.env.opts.kvStore, inst.env.opts.kvScope)
+}
+
+// appKVScope returns the KV scope for the Runnables of the app with the given identifier
+func appKVScope(identifier string) string {
+	return fmt.Sprintf("app/%s/", url.PathEscape(identifier))
+}
@@ -9,14 +9,14 @@ type logScope struct {
 	Identifier int32 `json:"ident"`
 }
 
-func logMsg() *HostFn {
+func logMsg(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		pointer := args[0].I32()
 		size := args[1].I32()
 		level := args[2].I32()
 		ident := args[3].I32()
 
-		log_msg(pointer, size, level, ident)
+		rt.log_msg(pointer, size, level, ident)
 
 		return nil, nil
 	}
@@ -24,23 +24,30 @@ func logMsg() *HostFn {
 	return newHostFn("log_msg", 4, false, fn)
 }
 
-func log_msg(pointer int32, size int32, level int32, identifier int32) {
-	inst, err := instanceForIdentifier(identifier)
+func (rt *Runtime) log_msg(pointer int32, size int32, level int32, identifier int32) {
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return
 	}
 
-	msgBytes := inst.readMemory(pointer, size)
+	msgBytes, err := inst.readMemory(pointer, size)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for log message"))
+		return
+	}
+
+	// secrets any Runnable has accessed are never logged
+	msg := rt.redactor.redact(string(msgBytes))
 
-	l := logger.CreateScoped(logScope{Identifier: identifier})
+	l := rt.logger.CreateScoped(logScope{Identifier: identifier})
 
 	switch level {
 	case 1:
-		l.ErrorString(string(msgBytes))
+		l.ErrorString(msg)
 	case 2:
-		l.Warn(string(msgBytes))
+		l.Warn(msg)
 	default:
-		l.Info(string(msgBytes))
+		l.Info(msg)
 	}
 }
@@ -2,18 +2,20 @@ package wasm
 
 import (
 	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/request"
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
 const (
-	fieldTypeMeta   = int32(0)
-	fieldTypeBody   = int32(1)
-	fieldTypeHeader = int32(2)
-	fieldTypeParams = int32(3)
-	fieldTypeState  = int32(4)
+	fieldTypeMeta     = int32(0)
+	fieldTypeBody     = int32(1)
+	fieldTypeHeader   = int32(2)
+	fieldTypeParams   = int32(3)
+	fieldTypeState    = int32(4)
+	fieldTypeBodyPath = int32(5)
 )
 
-func requestGetField() *HostFn {
+func requestGetField(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		fieldType := args[0].I32()
 		keyPointer := args[1].I32()
@@ -22,7 +24,7 @@ func requestGetField() *HostFn {
 		destMaxSize := args[4].I32()
 		ident := args[5].I32()
 
-		ret := request_get_field(fieldType, keyPointer, keySize, destPointer, destMaxSize, ident)
+		ret := rt.request_get_field(fieldType, keyPointer, keySize, destPointer, destMaxSize, ident)
 
 		return ret, nil
 	}
@@ -30,21 +32,24 @@ func requestGetField() *HostFn {
 	return newHostFn("request_get_field", 6, true, fn)
 }
 
-func request_get_field(fieldType int32, keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
-	inst, err := instanceForIdentifier(identifier)
+func (rt *Runtime) request_get_field(fieldType int32, keyPointer int32, keySize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return -1
 	}
 
-	if inst.request == nil {
-		logger.ErrorString("[hive-wasm] Runnable attempted to access request when none is set")
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to access request when none is set")
 		return -2
 	}
 
-	req := inst.request
-
-	keyBytes := inst.readMemory(keyPointer, keySize)
+	keyBytes, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for request field key"))
+		return errCodeMemoryAccess
+	}
 	key := string(keyBytes)
 
 	val := ""
@@ -68,7 +73,7 @@ func request_get_field(fieldType int32, keyPointer int32, keySize int32, destPoi
 		if err == nil {
 			val = bodyVal
 		} else {
-			logger.Error(errors.Wrap(err, "failed to get BodyField"))
+			rt.logger.Error(errors.Wrap(err, "failed to get BodyField"))
 			return -4
 		}
 	case fieldTypeHeader:
@@ -92,14 +97,29 @@ func request_get_field(fieldType int32, keyPointer int32, keySize int32, destPoi
 		} else {
 			return -3
 		}
+	case fieldTypeBodyPath:
+		pathVal, err := req.BodyPath(key)
+		if err != nil {
+			if errors.Is(err, request.ErrBodyPathNotFound) {
+				return -3
+			}
+
+			rt.logger.Error(errors.Wrap(err, "failed to get BodyPath"))
+			return -4
+		}
+
+		val = string(pathVal)
 	}
 
 	valBytes := []byte(val)
 
 	if len(valBytes) <= int(destMaxSize) {
-		inst.writeMemoryAtLocation(destPointer, valBytes)
+		if err := inst.writeMemoryAtLocation(destPointer, valBytes); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for request field"))
+			return errCodeMemoryAccess
+		}
 	}
 
-	// logger.Debug(fmt.Sprintf("returning value length %d", len(valBytes)))
+	// rt.logger.Debug(fmt.Sprintf("returning value length %d", len(valBytes)))
 	return int32(len(valBytes))
 }
@@ -0,0 +1,134 @@
+package wasm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func responseSetStatus(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		status := args[0].I32()
+		ident := args[1].I32()
+
+		ret := rt.response_set_status(status, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("response_set_status", 2, true, fn)
+}
+
+func (rt *Runtime) response_set_status(status int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to set response status when no request is set")
+		return -2
+	}
+
+	if status < 100 || status > 599 {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to set invalid response status", status)
+		return -3
+	}
+
+	req.SetStatus(int(status))
+
+	return 0
+}
+
+func responseSetHeader(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		valPointer := args[2].I32()
+		valSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.response_set_header(keyPointer, keySize, valPointer, valSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("response_set_header", 5, true, fn)
+}
+
+func (rt *Runtime) response_set_header(keyPointer int32, keySize int32, valPointer int32, valSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to set response header when no request is set")
+		return -2
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for response header key"))
+		return errCodeMemoryAccess
+	}
+
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for response header value"))
+		return errCodeMemoryAccess
+	}
+
+	req.SetHeader(string(key), string(val))
+
+	return 0
+}
+
+func responseAddHeader(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		valPointer := args[2].I32()
+		valSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.response_add_header(keyPointer, keySize, valPointer, valSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("response_add_header", 5, true, fn)
+}
+
+func (rt *Runtime) response_add_header(keyPointer int32, keySize int32, valPointer int32, valSize int32, identifier int32) int32 {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to add response header when no request is set")
+		return -2
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for response header key"))
+		return errCodeMemoryAccess
+	}
+
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for response header value"))
+		return errCodeMemoryAccess
+	}
+
+	req.AddHeader(string(key), string(val))
+
+	return 0
+}
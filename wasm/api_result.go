@@ -5,13 +5,13 @@ import (
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
-func returnResult() *HostFn {
+func returnResult(rt *Runtime) *HostFn {
 	fn := func(args ...wasmer.Value) (interface{}, error) {
 		pointer := args[0].I32()
 		size := args[1].I32()
 		ident := args[2].I32()
 
-		return_result(pointer, size, ident)
+		rt.return_result(pointer, size, ident)
 
 		return nil, nil
 	}
@@ -19,17 +19,62 @@ func returnResult() *HostFn {
 	return newHostFn("return_result", 3, false, fn)
 }
 
-func return_result(pointer int32, size int32, identifier int32) {
-	envLock.RLock()
-	defer envLock.RUnlock()
+func (rt *Runtime) return_result(pointer int32, size int32, identifier int32) {
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return
+	}
+
+	result, err := inst.readMemory(pointer, size)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for result"))
+		return
+	}
+
+	select {
+	case inst.resultChan <- result:
+	default:
+		rt.logger.ErrorString("[hive-wasm] Runnable returned a result more than once, ignoring")
+	}
+}
+
+func returnError(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		code := args[0].I32()
+		pointer := args[1].I32()
+		size := args[2].I32()
+		ident := args[3].I32()
 
-	inst, err := instanceForIdentifier(identifier)
+		rt.return_error(code, pointer, size, ident)
+
+		return nil, nil
+	}
+
+	return newHostFn("return_error", 4, false, fn)
+}
+
+func (rt *Runtime) return_error(code int32, pointer int32, size int32, identifier int32) {
+	inst, err := rt.instanceForIdentifier(identifier)
 	if err != nil {
-		logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
 		return
 	}
 
-	result := inst.readMemory(pointer, size)
+	msg, err := inst.readMemory(pointer, size)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for error message"))
+		return
+	}
 
-	inst.resultChan <- result
+	runErr := &RunnableError{
+		Code:    int(code),
+		Message: string(msg),
+	}
+
+	select {
+	case inst.errChan <- runErr:
+	default:
+		rt.logger.ErrorString("[hive-wasm] Runnable returned an error more than once, ignoring")
+	}
 }
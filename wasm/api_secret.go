@@ -0,0 +1,87 @@
+package wasm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/secrets"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func getSecret(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		namePointer := args[0].I32()
+		nameSize := args[1].I32()
+		destPointer := args[2].I32()
+		destMaxSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.get_secret(namePointer, nameSize, destPointer, destMaxSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("get_secret", 5, true, fn)
+}
+
+func (rt *Runtime) get_secret(namePointer int32, nameSize int32, destPointer int32, destMaxSize int32, identifier int32) int32 {
+	// get_secret writes the value of the named secret into memory at destPointer and returns its size, if the Runnable
+	// has been granted access to it. The value is redacted from any message a Runnable logs, replacing its previous value
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	provider := inst.env.opts.secretProvider
+	if provider == nil {
+		return errCodeUnavailable
+	}
+
+	nameBytes, err := inst.readMemory(namePointer, nameSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for secret name"))
+		return errCodeMemoryAccess
+	}
+
+	name := string(nameBytes)
+
+	if !inst.env.opts.secretAccess[name] {
+		rt.auditSecretDenied(inst, name)
+		return errCodeAccessDenied
+	}
+
+	val, err := provider.Secret(name)
+	if err != nil {
+		if errors.Is(err, secrets.ErrSecretNotFound) {
+			return errCodeNotFound
+		}
+
+		rt.logger.ErrorString("[hive-wasm] failed to get secret", name, err.Error())
+		return -2
+	}
+
+	rt.redactor.set(provider, name, string(val))
+
+	// if the size is greater than what's been allocated, then the module will increase the size and try again
+	if len(val) <= int(destMaxSize) {
+		if err := inst.writeMemoryAtLocation(destPointer, val); err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to writeMemoryAtLocation for secret value"))
+			return errCodeMemoryAccess
+		}
+	}
+
+	return int32(len(val))
+}
+
+// auditSecretDenied logs an attempt to access a secret that the instance's environment has not been granted access to
+func (rt *Runtime) auditSecretDenied(inst *wasmInstance, name string) {
+	audit := secretAudit{
+		Runnable: inst.env.runnableName(),
+		Secret:   name,
+	}
+
+	if req := inst.jobRequest(); req != nil {
+		audit.RequestID = req.ID
+	}
+
+	rt.logger.CreateScoped(audit).Warn("[hive-wasm] secret access denied for Wasm Runnable")
+}
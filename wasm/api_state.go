@@ -0,0 +1,99 @@
+package wasm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func stateSet(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		valPointer := args[2].I32()
+		valSize := args[3].I32()
+		ident := args[4].I32()
+
+		ret := rt.state_set(keyPointer, keySize, valPointer, valSize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("state_set", 5, true, fn)
+}
+
+func (rt *Runtime) state_set(keyPointer int32, keySize int32, valPointer int32, valSize int32, identifier int32) int32 {
+	// state_set sets a key in the state of the request being handled, which is visible to the Runnable immediately
+	// and is applied to the handler's state once the Runnable's step has completed (after its output is stored)
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to set state when no request is set")
+		return -2
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for state key"))
+		return errCodeMemoryAccess
+	}
+
+	if len(key) == 0 {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to set empty state key")
+		return -3
+	}
+
+	val, err := inst.readMemory(valPointer, valSize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for state value"))
+		return errCodeMemoryAccess
+	}
+
+	req.SetState(string(key), val)
+
+	return 0
+}
+
+func stateDelete(rt *Runtime) *HostFn {
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		keyPointer := args[0].I32()
+		keySize := args[1].I32()
+		ident := args[2].I32()
+
+		ret := rt.state_delete(keyPointer, keySize, ident)
+
+		return ret, nil
+	}
+
+	return newHostFn("state_delete", 3, true, fn)
+}
+
+func (rt *Runtime) state_delete(keyPointer int32, keySize int32, identifier int32) int32 {
+	// state_delete deletes a key from the state of the request being handled. Since the Runnable may
+	// only be given part of the handler's state, the key is deleted whether or not the Runnable can see it
+	inst, err := rt.instanceForIdentifier(identifier)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+		return -1
+	}
+
+	req := inst.jobRequest()
+	if req == nil {
+		rt.logger.ErrorString("[hive-wasm] Runnable attempted to delete state when no request is set")
+		return -2
+	}
+
+	key, err := inst.readMemory(keyPointer, keySize)
+	if err != nil {
+		rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to readMemory for state key"))
+		return errCodeMemoryAccess
+	}
+
+	req.DeleteState(string(key))
+
+	return 0
+}
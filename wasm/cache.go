@@ -0,0 +1,364 @@
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/directive"
+	"github.com/suborbital/hive/hive"
+)
+
+// errCacheValueNotInteger is returned when a Runnable increments a cache value that is not an integer
+var errCacheValueNotInteger = errors.New("cache value is not an integer")
+
+// AtomicCache is a hive.Cache that can increment and compare-and-set values atomically itself (for example,
+// one backed by a shared store). If a hive's cache does not implement it, the Runtime provides atomicity
+// by serializing the cache operations made by its Runnables on each key (but not those made by other code)
+type AtomicCache interface {
+	hive.Cache
+	// Incr adds delta to the integer stored at key (treating a missing key as 0) and returns the result
+	Incr(key string, delta int64, ttl int) (int64, error)
+	// CompareAndSet sets key to val if its current value is old (or if it does not exist, when old is nil)
+	CompareAndSet(key string, old, val []byte, ttl int) (bool, error)
+}
+
+// ListableCache is a hive.Cache that can list its keys. If a hive's cache does not implement it,
+// only the keys set by Runnables belonging to the Runtime are listed
+type ListableCache interface {
+	hive.Cache
+	// Keys returns the keys beginning with prefix
+	Keys(prefix string) ([]string, error)
+}
+
+// sharedCacheScope is the scope of the cache keys of Runnables that have opted in to the shared cache
+const sharedCacheScope = "shared/"
+
+// cacheOps performs the operations of the cache host functions on a cache,
+// with every key prefixed by scope so that Runnables in other scopes cannot access them
+type cacheOps struct {
+	cache hive.Cache
+	scope string
+	state *cacheState
+}
+
+// cacheLockStripes is the number of locks that the keys of a cache are spread across
+const cacheLockStripes = 64
+
+// cacheSweepInterval is how often expired keys are removed from a cache's index
+const cacheSweepInterval = time.Minute
+
+// cacheState is the state kept by the Runtime for a cache that does not implement AtomicCache or ListableCache
+type cacheState struct {
+	// locks serialize the operations on each key so that read-modify-write operations are atomic. Keys
+	// are spread across them by their hash, so that operations on different keys rarely contend
+	locks [cacheLockStripes]sync.Mutex
+
+	// keys is the index of keys that have been set along with when they expire (the zero time if they don't),
+	// which is pruned as they are deleted and expire so that it does not grow beyond the keys in the cache
+	keys      map[string]time.Time
+	nextSweep time.Time
+	indexLock sync.Mutex
+}
+
+// CacheScope prefixes every key that the Runnable uses with the cache host functions with scope, isolating them from
+// Runnables in other scopes. Runnables loaded from a bundle are scoped to their app and namespace automatically.
+// Without a scope, a Runner is given one of its own, and the empty scope is only used with UnscopedCache
+func CacheScope(scope string) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.cacheScope = scope
+		opts.cacheUnscoped = false
+	}
+}
+
+// UnscopedCache gives the Runnable access to every key in the cache, including those of every other Runnable
+func UnscopedCache() RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.cacheScope = ""
+		opts.cacheUnscoped = true
+	}
+}
+
+// runnerScope returns the cache and KV scope of a Runner that has not been given one, which is its own
+func runnerScope(envUUID string) string {
+	return fmt.Sprintf("runner/%s/", envUUID)
+}
+
+// runnableCacheScope returns the cache scope for a Runnable belonging to the app with the given identifier. Each
+// part is escaped so that a crafted identifier or namespace cannot produce the same scope as another app's
+func runnableCacheScope(identifier string, r *directive.Runnable) string {
+	namespace := directive.NamespaceDefault
+
+	if r != nil {
+		if r.Cache != nil && r.Cache.Shared {
+			return sharedCacheScope
+		}
+
+		namespace = r.Namespace
+	}
+
+	return fmt.Sprintf("app/%s/%s/", url.PathEscape(identifier), url.PathEscape(namespace))
+}
+
+// cacheFor returns the cacheOps for the cache and scope of the job an instance is running
+func (rt *Runtime) cacheFor(inst *wasmInstance) (*cacheOps, error) {
+	hiveCtx := inst.jobCtx()
+	if hiveCtx == nil {
+		return nil, errors.New("instance is not running a job")
+	}
+
+	return rt.cacheOps(hiveCtx.Cache, inst.env.opts.cacheScope), nil
+}
+
+// cacheOps returns the cacheOps for a cache and scope, creating the cache's state if needed
+func (rt *Runtime) cacheOps(cache hive.Cache, scope string) *cacheOps {
+	rt.cacheLock.Lock()
+	defer rt.cacheLock.Unlock()
+
+	// caches that can't be used as map keys (which is unusual, since they are typically pointers)
+	// share a state, so their operations are serialized together and share an index of keys
+	var stateKey interface{} = cache
+	if !reflect.TypeOf(cache).Comparable() {
+		stateKey = nil
+	}
+
+	state, exists := rt.caches[stateKey]
+	if !exists {
+		state = &cacheState{keys: map[string]time.Time{}}
+		rt.caches[stateKey] = state
+	}
+
+	return &cacheOps{cache: cache, scope: scope, state: state}
+}
+
+func (c *cacheOps) get(key string) ([]byte, error) {
+	return c.cache.Get(c.scope + key)
+}
+
+func (c *cacheOps) set(key string, val []byte, ttl int) error {
+	key = c.scope + key
+
+	lock := c.state.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return c.setLocked(key, val, ttl)
+}
+
+// delete removes key from the cache, returning hive.ErrCacheKeyNotFound if it does not exist
+func (c *cacheOps) delete(key string) error {
+	key = c.scope + key
+
+	lock := c.state.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := c.cache.Get(key); err != nil {
+		return err
+	}
+
+	c.state.unindex(key)
+
+	return c.cache.Delete(key)
+}
+
+func (c *cacheOps) incr(key string, delta int64, ttl int) (int64, error) {
+	key = c.scope + key
+
+	if atomic, ok := c.cache.(AtomicCache); ok {
+		val, err := atomic.Incr(key, delta, ttl)
+		if err == nil {
+			c.state.index(key, ttl)
+		}
+
+		return val, err
+	}
+
+	lock := c.state.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current := int64(0)
+
+	val, err := c.cache.Get(key)
+	if err == nil {
+		current, err = strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return 0, errCacheValueNotInteger
+		}
+	} else if !errors.Is(err, hive.ErrCacheKeyNotFound) {
+		return 0, errors.Wrap(err, "failed to Get")
+	}
+
+	current += delta
+
+	if err := c.setLocked(key, []byte(strconv.FormatInt(current, 10)), ttl); err != nil {
+		return 0, errors.Wrap(err, "failed to setLocked")
+	}
+
+	return current, nil
+}
+
+func (c *cacheOps) compareAndSet(key string, old, val []byte, ttl int) (bool, error) {
+	key = c.scope + key
+
+	if atomic, ok := c.cache.(AtomicCache); ok {
+		set, err := atomic.CompareAndSet(key, old, val, ttl)
+		if set {
+			c.state.index(key, ttl)
+		}
+
+		return set, err
+	}
+
+	lock := c.state.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, err := c.cache.Get(key)
+	if err != nil && !errors.Is(err, hive.ErrCacheKeyNotFound) {
+		return false, errors.Wrap(err, "failed to Get")
+	}
+
+	exists := err == nil
+
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+
+	if err := c.setLocked(key, val, ttl); err != nil {
+		return false, errors.Wrap(err, "failed to setLocked")
+	}
+
+	return true, nil
+}
+
+// keys returns the keys in the cache's scope beginning with prefix (without the scope), sorted
+func (c *cacheOps) keys(prefix string) ([]string, error) {
+	prefix = c.scope + prefix
+
+	if listable, ok := c.cache.(ListableCache); ok {
+		keys, err := listable.Keys(prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to Keys")
+		}
+
+		return c.unscoped(keys), nil
+	}
+
+	keys := []string{}
+
+	// the index may contain keys that were deleted or evicted by something other than the host functions
+	for _, key := range c.state.indexed(prefix) {
+		if _, err := c.cache.Get(key); err != nil {
+			if errors.Is(err, hive.ErrCacheKeyNotFound) {
+				c.state.unindex(key)
+				continue
+			}
+
+			return nil, errors.Wrap(err, "failed to Get")
+		}
+
+		keys = append(keys, key)
+	}
+
+	return c.unscoped(keys), nil
+}
+
+// unscoped removes the scope from keys and sorts them
+func (c *cacheOps) unscoped(keys []string) []string {
+	unscoped := make([]string, len(keys))
+	for i, key := range keys {
+		unscoped[i] = strings.TrimPrefix(key, c.scope)
+	}
+
+	sort.Strings(unscoped)
+
+	return unscoped
+}
+
+// setLocked sets a value and adds its key to the index, and must be called with the key's lock held
+func (c *cacheOps) setLocked(key string, val []byte, ttl int) error {
+	if err := c.cache.Set(key, val, ttl); err != nil {
+		return err
+	}
+
+	c.state.index(key, ttl)
+
+	return nil
+}
+
+// lockFor returns the lock that serializes the operations on key
+func (s *cacheState) lockFor(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return &s.locks[hash.Sum32()%cacheLockStripes]
+}
+
+// index adds a key to the index, expiring after ttl seconds (or never if ttl is 0 or less), and
+// periodically removes the keys that have expired so that keys set with a TTL don't accumulate
+func (s *cacheState) index(key string, ttl int) {
+	now := time.Now()
+
+	expires := time.Time{}
+	if ttl > 0 {
+		expires = now.Add(time.Duration(ttl) * time.Second)
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	s.keys[key] = expires
+
+	if now.Before(s.nextSweep) {
+		return
+	}
+
+	for k, exp := range s.keys {
+		if !exp.IsZero() && !now.Before(exp) {
+			delete(s.keys, k)
+		}
+	}
+
+	s.nextSweep = now.Add(cacheSweepInterval)
+}
+
+// unindex removes a key from the index
+func (s *cacheState) unindex(key string) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	delete(s.keys, key)
+}
+
+// indexed returns the indexed keys beginning with prefix, removing any that have expired
+func (s *cacheState) indexed(prefix string) []string {
+	now := time.Now()
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	keys := []string{}
+
+	for key, exp := range s.keys {
+		if !exp.IsZero() && !now.Before(exp) {
+			delete(s.keys, key)
+			continue
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
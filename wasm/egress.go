@@ -0,0 +1,373 @@
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxRedirects matches the number of redirects followed by http.DefaultClient
+const defaultMaxRedirects = 10
+
+// EgressPolicy controls which outbound HTTP requests a Runnable is permitted to make with fetch_url.
+// The zero value permits http and https requests to any public host, following up to 10 redirects
+type EgressPolicy struct {
+	// Schemes are the URL schemes that may be used. Empty means http and https
+	Schemes []string
+	// AllowHosts are the hosts that may be requested, empty means any host. A leading
+	// wildcard (*.example.com) matches any subdomain, and * alone matches every host
+	AllowHosts []string
+	// DenyHosts are hosts that may not be requested, even if they are allowed by AllowHosts
+	DenyHosts []string
+	// AllowPrivateIPs permits connections to loopback, private, link-local and other non-public
+	// addresses. These are blocked by default, and are checked after DNS resolution so that
+	// a public hostname resolving to a private address is blocked as well
+	AllowPrivateIPs bool
+	// MaxRedirects is the number of redirects that may be followed (each of which must also be permitted
+	// by the policy). 0 means the default of 10, and a negative value means redirects are not followed
+	MaxRedirects int
+}
+
+// EgressDeniedError is the error returned when a request is not permitted by a Runnable's EgressPolicy
+type EgressDeniedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *EgressDeniedError) Error() string {
+	return fmt.Sprintf("egress to %s denied: %s", e.URL, e.Reason)
+}
+
+// egressAudit is the scope of the log line written when a request is denied
+type egressAudit struct {
+	Runnable  string `json:"runnable"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	Reason    string `json:"reason"`
+}
+
+// Egress sets the EgressPolicy for a Runnable's outbound HTTP requests. It can be set more than once (for example
+// with DefaultRunnerOptions for the whole Runtime, and again for a Runnable), in which case every request must be
+// permitted by every policy. If no policy is set, the zero value EgressPolicy is used
+func Egress(policy EgressPolicy) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.egress = append(opts.egress, policy)
+	}
+}
+
+// egressPolicies is the set of policies that must all permit a request
+type egressPolicies []EgressPolicy
+
+// checkURL returns an *EgressDeniedError if u's scheme or host is not permitted
+func (e egressPolicies) checkURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	host := normalizeHost(u.Hostname())
+
+	for _, p := range e {
+		schemes := p.Schemes
+		if len(schemes) == 0 {
+			schemes = []string{"http", "https"}
+		}
+
+		if !containsFold(schemes, scheme) {
+			return &EgressDeniedError{URL: u.String(), Reason: fmt.Sprintf("scheme %s is not allowed", scheme)}
+		}
+
+		if matchesHost(p.DenyHosts, host) {
+			return &EgressDeniedError{URL: u.String(), Reason: fmt.Sprintf("host %s is denied", host)}
+		}
+
+		if len(p.AllowHosts) > 0 && !matchesHost(p.AllowHosts, host) {
+			return &EgressDeniedError{URL: u.String(), Reason: fmt.Sprintf("host %s is not allowed", host)}
+		}
+	}
+
+	return nil
+}
+
+// checkIP returns an *EgressDeniedError if a connection to ip is not permitted
+func (e egressPolicies) checkIP(ip net.IP) error {
+	if !isPrivateIP(ip) {
+		return nil
+	}
+
+	for _, p := range e {
+		if !p.AllowPrivateIPs {
+			return &EgressDeniedError{URL: ip.String(), Reason: fmt.Sprintf("address %s is not public", ip)}
+		}
+	}
+
+	return nil
+}
+
+// allowPrivateIPs returns true if every policy permits connections to private IP addresses
+func (e egressPolicies) allowPrivateIPs() bool {
+	for _, p := range e {
+		if !p.AllowPrivateIPs {
+			return false
+		}
+	}
+
+	return true
+}
+
+// maxRedirects returns the lowest number of redirects permitted by any of the policies
+func (e egressPolicies) maxRedirects() int {
+	max := defaultMaxRedirects
+
+	for _, p := range e {
+		if p.MaxRedirects < 0 {
+			return 0
+		} else if p.MaxRedirects > 0 && p.MaxRedirects < max {
+			max = p.MaxRedirects
+		}
+	}
+
+	return max
+}
+
+// egressTransport checks each request (including those made to follow redirects) against the policies before sending it
+type egressTransport struct {
+	policies egressPolicies
+	next     http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policies.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// newEgressClient creates an http.Client that enforces the policies, based on base if it is set. Addresses are checked
+// as each connection is made (after DNS resolution) and proxies are not used since they would hide the real address.
+// A base client's transport is cloned with its dialer wrapped to check addresses, and if it is not an *http.Transport
+// (so its connections cannot be checked), an error is returned unless the policies permit private IP addresses
+func newEgressClient(policies egressPolicies, base *http.Client) (*http.Client, error) {
+	if len(policies) == 0 {
+		policies = egressPolicies{EgressPolicy{}}
+	}
+
+	client := &http.Client{}
+	var next http.RoundTripper
+
+	if base != nil {
+		*client = *base
+
+		guarded, err := guardedTransport(policies, base.Transport)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to guardedTransport")
+		}
+
+		next = guarded
+	} else {
+		next = newEgressTransport(policies)
+	}
+
+	client.Transport = &egressTransport{policies: policies, next: next}
+
+	maxRedirects := policies.maxRedirects()
+	baseCheckRedirect := client.CheckRedirect
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return &EgressDeniedError{URL: req.URL.String(), Reason: fmt.Sprintf("more than %d redirects", maxRedirects)}
+		}
+
+		if baseCheckRedirect != nil {
+			return baseCheckRedirect(req, via)
+		}
+
+		return nil
+	}
+
+	return client, nil
+}
+
+// guardedTransport returns a transport based on base that checks the address of each connection against the policies
+func guardedTransport(policies egressPolicies, base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if policies.allowPrivateIPs() {
+		return base, nil
+	}
+
+	transport, ok := base.(*http.Transport)
+	if !ok || transport.DialTLSContext != nil || transport.DialTLS != nil {
+		return nil, errors.New("connections made by the HTTP client's transport cannot be checked for private IP addresses, which must be allowed by the egress policy to use it")
+	}
+
+	dial := transport.DialContext
+	if dial == nil && transport.Dial != nil {
+		baseDial := transport.Dial
+		dial = func(_ context.Context, network, address string) (net.Conn, error) {
+			return baseDial(network, address)
+		}
+	} else if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	guarded := transport.Clone()
+	guarded.Proxy = nil
+	guarded.Dial = nil
+	guarded.DialContext = checkedDialContext(policies, dial)
+
+	return guarded, nil
+}
+
+// checkedDialContext wraps dial so that it resolves the host itself and only dials the addresses permitted by the policies
+func checkedDialContext(policies egressPolicies, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to SplitHostPort")
+		}
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to LookupIPAddr")
+		}
+
+		lastErr := fmt.Errorf("no addresses found for %s", host)
+
+		// the checked address is dialed (rather than the host) so that it cannot be resolved differently a second time
+		for _, addr := range addrs {
+			if err := policies.checkIP(addr.IP); err != nil {
+				lastErr = err
+				continue
+			}
+
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			return conn, nil
+		}
+
+		return nil, lastErr
+	}
+}
+
+// newEgressTransport creates a transport that checks the address of each connection against the policies
+func newEgressTransport(policies egressPolicies) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Wrap(err, "failed to SplitHostPort")
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("dialed address %s is not an IP", host)
+			}
+
+			return policies.checkIP(ip)
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return transport
+}
+
+// matchesHost returns true if host matches any of the patterns
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = normalizeHost(pattern)
+
+		if pattern == "*" || pattern == host {
+			return true
+		}
+
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeHost lowercases host and removes the trailing dot of a fully qualified
+// name, so that "Example.com." cannot be used to get around a pattern for "example.com"
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func containsFold(vals []string, val string) bool {
+	for _, v := range vals {
+		if strings.EqualFold(v, val) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// privateNets are the address ranges that are not publicly routable
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata endpoints
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // NAT64, which can embed any IPv4 address
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func isPrivateIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets[i] = n
+	}
+
+	return nets
+}
@@ -0,0 +1,120 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errResponseTooLarge is returned by doFetch when a response body is larger than the Runnable's maximum response size
+var errResponseTooLarge = errors.New("response body exceeds maximum size")
+
+// fetchResponse holds the last response received by an instance's call to fetch_url or fetch_request, so that
+// the Runnable can inspect it with fetch_status and fetch_header afterwards. If the body did not fit in the
+// Runnable's buffer it is kept (pending) so that the Runnable can make the same call (identified by key)
+// again with a larger buffer without the request being sent again
+type fetchResponse struct {
+	key     string
+	status  int
+	headers http.Header
+	body    []byte
+	pending bool
+}
+
+// doFetch makes a request with the environment's client, retrying it as configured
+// if it is idempotent, and reads the response body up to the maximum response size
+func (w *wasmEnvironment) doFetch(method, url string, headers http.Header, body []byte) (*fetchResponse, error) {
+	retries := 0
+	if isIdempotent(method) {
+		retries = w.opts.fetchRetries
+	}
+
+	backoff := w.opts.fetchBackoff
+
+	for attempt := 0; ; attempt++ {
+		resp, err := w.fetchOnce(method, url, headers, body)
+		if attempt >= retries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchOnce makes a single attempt at a request
+func (w *wasmEnvironment) fetchOnce(method, url string, headers http.Header, body []byte) (*fetchResponse, error) {
+	ctx := context.Background()
+
+	if w.opts.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.opts.fetchTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to NewRequestWithContext")
+	}
+
+	req.Header = headers.Clone()
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to Do request")
+	}
+
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	if w.opts.maxResponseSize > 0 {
+		// reading one byte beyond the limit shows whether the body exceeds it
+		reader = io.LimitReader(resp.Body, w.opts.maxResponseSize+1)
+	}
+
+	respBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ReadAll response body")
+	}
+
+	if w.opts.maxResponseSize > 0 && int64(len(respBytes)) > w.opts.maxResponseSize {
+		return nil, errResponseTooLarge
+	}
+
+	fetchResp := &fetchResponse{
+		status:  resp.StatusCode,
+		headers: resp.Header,
+		body:    respBytes,
+	}
+
+	return fetchResp, nil
+}
+
+// shouldRetry returns true if a request failed in a way that may succeed if it is sent again
+func shouldRetry(resp *fetchResponse, err error) bool {
+	if err != nil {
+		var deniedErr *EgressDeniedError
+		return !errors.As(err, &deniedErr) && !errors.Is(err, errResponseTooLarge)
+	}
+
+	switch resp.status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
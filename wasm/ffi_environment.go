@@ -1,18 +1,18 @@
 package wasm
 
 import (
-	"crypto/rand"
 	"fmt"
 	"math"
-	"math/big"
+	"net/http"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/suborbital/hive-wasm/bundle"
 	"github.com/suborbital/hive-wasm/request"
 	"github.com/suborbital/hive/hive"
-	"github.com/suborbital/vektor/vlog"
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
@@ -21,72 +21,130 @@ import (
  an FFI API. Functions exported from a WASM module can be easily called by Go code via the Wasmer instance exports, but returning data
  to the host Go code is not quite as straightforward.
 
- In order to accomplish this, hivew internally keeps a set of "environments" in a singleton package var (`environments` below).
+ In order to accomplish this, each Runtime internally keeps a set of "environments" (see runtime.go).
  Each environment is a container that includes the WASM module bytes, and a set of WASM instances (runtimes) to execute said module.
- The envionment object has an index referencing its place in the singleton array, and each instance has an index referencing its position within
- the environment's instance array.
+ The envionment object has a UUID referencing its place in the Runtime's environments map, and each job execution is given an identifier
+ that references the environment and the instance it is running on.
 
  When a WASM function calls one of the FFI API functions, it includes the `ident`` value that was provided at the beginning
  of job execution, which allows hivew to look up the [env][instance] and send the result on the appropriate result channel. This is needed due to
  the way Go makes functions available on the FFI using CGO.
 */
 
-// the globally shared set of Wasm environments, accessed by UUID
-var environments = map[string]*wasmEnvironment{}
-
-// a lock to ensure the environments array is concurrency safe (didn't use sync.Map to prevent type coersion)
-var envLock = sync.RWMutex{}
-
-// the instance mapper maps a random int32 to a wasm instance to prevent malicious access to other instances via the FFI
-var instanceMapper = sync.Map{}
-
-// the logger used by Wasm Runnables
-var logger = vlog.Default()
-
 // wasmEnvironment is an environmenr in which Wasm instances run
 type wasmEnvironment struct {
 	UUID      string
+	rt        *Runtime
 	ref       *bundle.WasmModuleRef
+	opts      runnerOpts
 	module    *wasmer.Module
 	store     *wasmer.Store
-	imports   *wasmer.ImportObject
 	instances []*wasmInstance
 
+	// the Runtime's compiled module that the environment holds a reference to, which is released
+	// once every instance created from it (counted by openInstances) has been closed
+	compiled      *compiledModule
+	openInstances sync.WaitGroup
+
+	// the number of instances waiting for an abandoned execution to return before they are closed
+	draining int32
+
+	// the client used for fetch_url, which enforces the environment's egress policies
+	httpClient *http.Client
+
+	// configErr is set if the environment's options are invalid, in which case its jobs fail
+	configErr error
+
+	// temporary directories holding snapshots of the WASI preopened directories, which each instance is given a copy of
+	wasiSnapshots []string
+
+	// the number of instances the pool should contain
+	targetSize int
+
 	// the index of the last used wasm instance
 	instIndex int
+	closed    bool
 	lock      sync.Mutex
 }
 
 type wasmInstance struct {
+	env        *wasmEnvironment
 	wasmerInst *wasmer.Instance
-	hiveCtx    *hive.Ctx
-	request    *request.CoordinatedRequest
+	wasiEnv    *wasmer.WasiEnvironment
 	resultChan chan []byte
+	errChan    chan *RunnableError
+	lastFetch  *fetchResponse
 	lock       sync.Mutex
-}
 
-// instanceReference is a "pointer" to the global environments array and the
-// wasm instances within each environment
-type instanceReference struct {
-	EnvUUID   string
-	InstIndex int
+	// invokeDepth is the number of invoke_fn calls that led to the job the instance is running, invokeCallers
+	// is the chain of function names that led to it, and pendingInvoke is the output of its last invoke_fn
+	// call if it did not fit in the Runnable's buffer
+	invokeDepth   int
+	invokeCallers []string
+	pendingInvoke *invokeResult
+
+	// unhealthy is set when the instance has been discarded from the pool
+	unhealthy bool
+
+	// executing is held while the Runnable is running, and abandoned is set if its execution timed out,
+	// in which case the instance is only closed once the execution returns (see close)
+	executing sync.WaitGroup
+	abandoned bool
+	closed    bool
+
+	// the instance's copies of the environment's WASI snapshots, which are restored after each execution
+	wasiDirs []string
+
+	// hiveCtx and request belong to the job the instance is running. They are guarded by jobLock rather than lock
+	// since a timed out execution is abandoned while it is still running, and its host function calls must not
+	// race with them being cleared (see jobCtx and jobRequest)
+	hiveCtx *hive.Ctx
+	request *request.CoordinatedRequest
+	jobLock sync.RWMutex
 }
 
-// newEnvironment creates a new environment and adds it to the shared environments array
-// such that Wasm instances can return data to the correct place
-func newEnvironment(ref *bundle.WasmModuleRef) *wasmEnvironment {
-	envLock.Lock()
-	defer envLock.Unlock()
-
+// newEnvironment creates a new environment belonging to a Runtime
+func newEnvironment(rt *Runtime, ref *bundle.WasmModuleRef, opts runnerOpts) *wasmEnvironment {
 	e := &wasmEnvironment{
 		UUID:      uuid.New().String(),
+		rt:        rt,
 		ref:       ref,
+		opts:      opts,
 		instances: []*wasmInstance{},
 		instIndex: 0,
 		lock:      sync.Mutex{},
 	}
 
-	environments[e.UUID] = e
+	// a Runner that has not been given a scope must not be able to access the keys of every other Runnable
+	if e.opts.cacheScope == "" && !e.opts.cacheUnscoped {
+		e.opts.cacheScope = runnerScope(e.UUID)
+	}
+
+	if e.opts.kvScope == "" && !e.opts.kvUnscoped {
+		e.opts.kvScope = runnerScope(e.UUID)
+	}
+
+	client, err := newEgressClient(opts.egress, opts.httpClient)
+	if err != nil {
+		e.configErr = errors.Wrap(err, "failed to newEgressClient")
+		rt.logger.Error(errors.Wrapf(e.configErr, "[hive-wasm] invalid options for Runnable %s", e.runnableName()))
+	}
+
+	e.httpClient = client
+
+	// the secrets the Runnable can access are redacted from the start, rather than only once it has accessed them
+	if opts.secretProvider != nil {
+		rt.redactor.seed(opts.secretProvider, opts.secretAccess)
+	}
+
+	// the reference to the compiled module is taken as soon as the environment is created, so that a module being
+	// replaced by an identical one is not closed and compiled again. If the module cannot be read or compiled yet,
+	// it is retried (and the error returned) when the first instance is created
+	if moduleBytes, err := ref.ModuleBytes(); err == nil {
+		if compiled, err := rt.compiledModule(moduleBytes); err == nil {
+			e.compiled = compiled
+		}
+	}
 
 	return e
 }
@@ -96,177 +154,367 @@ func (w *wasmEnvironment) addInstance() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	module, _, imports, err := w.internals()
+	if w.closed {
+		return errors.New("environment is closed")
+	}
+
+	instance, err := w.newInstance()
+	if err != nil {
+		return errors.Wrap(err, "failed to newInstance")
+	}
+
+	w.instances = append(w.instances, instance)
+	w.targetSize++
+
+	return nil
+}
+
+// newInstance creates a new Wasm instance, and must be called with the environment's lock held
+func (w *wasmEnvironment) newInstance() (*wasmInstance, error) {
+	module, store, err := w.internals()
 	if err != nil {
-		return errors.Wrap(err, "failed to ModuleBytes")
+		return nil, errors.Wrap(err, "failed to ModuleBytes")
 	}
 
+	// each instance has its own copy of the WASI directories, so that
+	// one cannot modify the files that another is reading
+	wasiDirs, err := copySnapshots(w.wasiSnapshots)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copySnapshots")
+	}
+
+	// each instance has its own WASI environment so that the output
+	// of each execution can be captured separately
+	wasiEnv, err := wasiEnvironment(w.runnableName(), w.opts, wasiDirs)
+	if err != nil {
+		removeSnapshots(wasiDirs)
+		return nil, errors.Wrap(err, "failed to wasiEnvironment")
+	}
+
+	imports, err := wasiEnv.GenerateImportObject(store, module)
+	if err != nil {
+		removeSnapshots(wasiDirs)
+		return nil, errors.Wrap(err, "failed to GenerateImportObject")
+	}
+
+	// mount the Runnable API host functions to the module's imports
+	addHostFns(imports, store, w.rt.hostFns...)
+
 	inst, err := wasmer.NewInstance(module, imports)
 	if err != nil {
-		return errors.Wrap(err, "failed to NewInstance")
+		removeSnapshots(wasiDirs)
+		return nil, errors.Wrap(err, "failed to NewInstance")
+	}
+
+	instance := &wasmInstance{
+		env:        w,
+		wasmerInst: inst,
+		wasiEnv:    wasiEnv,
+		resultChan: make(chan []byte, 1),
+		errChan:    make(chan *RunnableError, 1),
+		lock:       sync.Mutex{},
+		wasiDirs:   wasiDirs,
+	}
+
+	w.openInstances.Add(1)
+
+	if err := instance.checkMemoryLimit(w.opts.maxMemoryPages); err != nil {
+		instance.close()
+		return nil, errors.Wrap(err, "failed to checkMemoryLimit for new instance")
 	}
 
 	// if the module has exported an init, call it
 	init, err := inst.Exports.GetFunction("init")
 	if err == nil && init != nil {
-		if _, err := init(); err != nil {
-			return errors.Wrap(err, "failed to init instance")
+		_, err := init()
+
+		w.logOutput(instance, nil)
+
+		if err != nil {
+			instance.close()
+			return nil, errors.Wrap(err, "failed to init instance")
+		}
+
+		if err := instance.checkMemoryLimit(w.opts.maxMemoryPages); err != nil {
+			instance.close()
+			return nil, errors.Wrap(err, "failed to checkMemoryLimit after init")
 		}
 	}
 
-	instance := &wasmInstance{
-		wasmerInst: inst,
-		resultChan: make(chan []byte, 1),
-		lock:       sync.Mutex{},
+	return instance, nil
+}
+
+// discardInstance marks an instance unhealthy, removes it from the pool and closes it (for example, when it has
+// trapped or timed out and its state can no longer be trusted) and asynchronously creates a fresh
+// instance to replace it. It must be called while holding the instance's lock
+func (w *wasmEnvironment) discardInstance(inst *wasmInstance) {
+	inst.unhealthy = true
+	inst.close()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i, existing := range w.instances {
+		if existing == inst {
+			w.instances = append(w.instances[:i], w.instances[i+1:]...)
+			break
+		}
 	}
 
-	w.instances = append(w.instances, instance)
+	go func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
 
-	return nil
+		// the pool may have already been refilled by useInstance
+		if w.closed || len(w.instances) >= w.targetSize {
+			return
+		}
+
+		instance, err := w.newInstance()
+		if err != nil {
+			w.rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to replace discarded instance"))
+			return
+		}
+
+		w.instances = append(w.instances, instance)
+	}()
 }
 
-// useInstance provides an instance from the environment's pool to be used
-func (w *wasmEnvironment) useInstance(req *request.CoordinatedRequest, ctx *hive.Ctx, instFunc func(*wasmInstance, int32)) error {
+// nextInstance returns the next instance in the pool in round-robin order
+func (w *wasmEnvironment) nextInstance() (*wasmInstance, error) {
 	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	if w.instIndex == len(w.instances)-1 {
+	if w.closed {
+		return nil, errors.New("environment is closed")
+	} else if w.configErr != nil {
+		return nil, w.configErr
+	}
+
+	// the pool can be temporarily empty if its instances were discarded
+	// and not yet replaced, so create one rather than failing the job
+	if len(w.instances) == 0 {
+		instance, err := w.newInstance()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to newInstance")
+		}
+
+		w.instances = append(w.instances, instance)
+	}
+
+	if w.instIndex >= len(w.instances)-1 {
 		w.instIndex = 0
 	} else {
 		w.instIndex++
 	}
 
-	instIndex := w.instIndex
-	inst := w.instances[instIndex]
+	return w.instances[w.instIndex], nil
+}
+
+// useInstance provides an instance from the environment's pool to be used
+func (w *wasmEnvironment) useInstance(req *request.CoordinatedRequest, ctx *hive.Ctx, instFunc func(*wasmInstance, int32)) error {
+	var inst *wasmInstance
+
+	for inst == nil {
+		next, err := w.nextInstance()
+		if err != nil {
+			return errors.Wrap(err, "failed to nextInstance")
+		}
+
+		next.lock.Lock()
+
+		// the instance may have been discarded while we were waiting for
+		// its lock, in which case it must not be used and we try again
+		if next.unhealthy {
+			next.lock.Unlock()
+			continue
+		}
 
-	w.lock.Unlock() // now that we've acquired our instance, let the next one go
+		inst = next
+	}
 
-	inst.lock.Lock()
 	defer inst.lock.Unlock()
 
-	inst.hiveCtx = ctx
-	inst.request = req
+	inst.setJob(req, ctx)
 
 	// generate a random identifier as a reference to the instance in use to
 	// easily allow the Wasm module to reference itself when calling back over the FFI
-	ident, err := setupNewIdentifier(w.UUID, instIndex)
+	ident, err := w.rt.setupNewIdentifier(w.UUID, inst)
 	if err != nil {
 		return errors.Wrap(err, "failed to setupNewIdentifier")
 	}
 
 	instFunc(inst, ident)
 
-	removeIdentifier(ident)
-	inst.hiveCtx = nil
-	inst.request = nil
+	// removing the identifier and clearing the job ensures that the host function calls of an execution that
+	// timed out (which wasmer cannot interrupt) fail rather than acting on behalf of a job that has completed
+	w.rt.removeIdentifier(ident)
+	inst.setJob(nil, nil)
+
+	// a discarded instance is never used again, and may still be running
+	if inst.unhealthy {
+		return nil
+	}
+
+	// anything the execution wrote to the WASI directories is discarded, so every execution sees the original files
+	if err := restoreSnapshots(w.wasiSnapshots, inst.wasiDirs); err != nil {
+		w.rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to restoreSnapshots, discarding instance"))
+		w.discardInstance(inst)
+		return nil
+	}
+
+	inst.lastFetch = nil
+	inst.invokeDepth = 0
+	inst.invokeCallers = nil
+	inst.pendingInvoke = nil
 
 	return nil
 }
 
-func (w *wasmEnvironment) internals() (*wasmer.Module, *wasmer.Store, *wasmer.ImportObject, error) {
-	if w.module == nil {
-		moduleBytes, err := w.ref.ModuleBytes()
-		if err != nil {
-			return nil, nil, nil, errors.Wrap(err, "failed to get ref ModuleBytes")
-		}
+// setJob sets the request and hive Ctx of the job the instance is running
+func (w *wasmInstance) setJob(req *request.CoordinatedRequest, ctx *hive.Ctx) {
+	w.jobLock.Lock()
+	defer w.jobLock.Unlock()
 
-		engine := wasmer.NewEngine()
-		store := wasmer.NewStore(engine)
+	w.request = req
+	w.hiveCtx = ctx
+}
 
-		// Compiles the module
-		mod, err := wasmer.NewModule(store, moduleBytes)
-		if err != nil {
-			return nil, nil, nil, errors.Wrap(err, "failed to NewModule")
-		}
+// jobRequest returns the CoordinatedRequest the instance is handling, or nil if the job is not a request
+func (w *wasmInstance) jobRequest() *request.CoordinatedRequest {
+	w.jobLock.RLock()
+	defer w.jobLock.RUnlock()
 
-		env, err := wasmer.NewWasiStateBuilder(w.ref.Name).Finalize()
-		if err != nil {
-			return nil, nil, nil, errors.Wrap(err, "failed to NewWasiStateBuilder.Finalize")
-		}
+	return w.request
+}
 
-		imports, err := env.GenerateImportObject(store, mod)
-		if err != nil {
-			return nil, nil, nil, errors.Wrap(err, "failed to GenerateImportObject")
-		}
+// jobCtx returns the hive Ctx of the job the instance is running, or nil if it is not running one
+func (w *wasmInstance) jobCtx() *hive.Ctx {
+	w.jobLock.RLock()
+	defer w.jobLock.RUnlock()
 
-		// mount the Runnable API host functions to the module's imports
-		addHostFns(imports, store,
-			returnResult(),
-			fetchURL(),
-			cacheSet(),
-			cacheGet(),
-			logMsg(),
-			requestGetField(),
-		)
+	return w.hiveCtx
+}
 
-		w.module = mod
-		w.store = store
-		w.imports = imports
+// close prevents new jobs from using the environment, waits for in-flight jobs to finish, and then closes its
+// instances and releases its reference to the compiled module. Instances still running an execution that timed out
+// are closed once it returns, and the module is released after them
+func (w *wasmEnvironment) close() {
+	w.lock.Lock()
+	w.closed = true
+	instances := w.instances
+	w.instances = []*wasmInstance{}
+	w.targetSize = 0
+	w.lock.Unlock()
+
+	// acquiring each instance's lock ensures in-flight jobs have completed
+	for _, inst := range instances {
+		inst.lock.Lock()
+		inst.unhealthy = true
+		inst.close()
+		inst.lock.Unlock()
 	}
 
-	return w.module, w.store, w.imports, nil
-}
+	release := func() {
+		w.openInstances.Wait()
 
-func setupNewIdentifier(envUUID string, instIndex int) (int32, error) {
-	for {
-		ident, err := randomIdentifier()
-		if err != nil {
-			return -1, errors.Wrap(err, "failed to randomIdentifier")
-		}
+		w.lock.Lock()
+		defer w.lock.Unlock()
 
-		// ensure we don't accidentally overwrite something else
-		// (however unlikely that may be)
-		if _, exists := instanceMapper.Load(ident); exists {
-			continue
+		if w.compiled != nil {
+			w.rt.releaseModule(w.compiled)
 		}
 
-		ref := instanceReference{
-			EnvUUID:   envUUID,
-			InstIndex: instIndex,
+		w.compiled = nil
+		w.module = nil
+		w.store = nil
+
+		if err := removeSnapshots(w.wasiSnapshots); err != nil {
+			w.rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to removeSnapshots"))
 		}
 
-		instanceMapper.Store(ident, ref)
+		w.wasiSnapshots = nil
+	}
 
-		return ident, nil
+	// an abandoned execution may never return, so Close does not wait for it
+	if atomic.LoadInt32(&w.draining) > 0 {
+		go release()
+	} else {
+		release()
 	}
 }
 
-func removeIdentifier(ident int32) {
-	instanceMapper.Delete(ident)
-}
+// close closes the instance's wasmer objects, once any execution running on it (which may have timed out and been
+// abandoned) has returned. It must be called while holding the instance's lock, and only once the instance is unused
+func (w *wasmInstance) close() {
+	if w.closed {
+		return
+	}
 
-func instanceForIdentifier(ident int32) (*wasmInstance, error) {
-	rawRef, exists := instanceMapper.Load(ident)
-	if !exists {
-		return nil, errors.New("instance does not exist")
+	w.closed = true
+
+	closeWasmer := func() {
+		w.wasmerInst.Close()
+
+		if err := removeSnapshots(w.wasiDirs); err != nil {
+			w.env.rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to removeSnapshots for instance"))
+		}
+
+		w.env.openInstances.Done()
 	}
 
-	ref := rawRef.(instanceReference)
+	if w.abandoned {
+		atomic.AddInt32(&w.env.draining, 1)
 
-	envLock.RLock()
-	defer envLock.RUnlock()
+		go func() {
+			w.executing.Wait()
+			closeWasmer()
+			atomic.AddInt32(&w.env.draining, -1)
+		}()
 
-	env, exists := environments[ref.EnvUUID]
-	if !exists {
-		return nil, errors.New("environment does not exist")
+		return
 	}
 
-	if len(env.instances) <= ref.InstIndex-1 {
-		return nil, errors.New("invalid instance index")
+	closeWasmer()
+}
+
+func (w *wasmEnvironment) internals() (*wasmer.Module, *wasmer.Store, error) {
+	if w.compiled == nil {
+		moduleBytes, err := w.ref.ModuleBytes()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to get ref ModuleBytes")
+		}
+
+		// compiles the module, or re-uses it if the Runtime has already compiled it
+		compiled, err := w.rt.compiledModule(moduleBytes)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to compiledModule")
+		}
+
+		w.compiled = compiled
 	}
 
-	inst := env.instances[ref.InstIndex]
+	if w.module == nil {
+		snapshots, err := snapshotDirs(w.opts.wasiDirs)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to snapshotDirs")
+		}
 
-	return inst, nil
+		w.module = w.compiled.module
+		w.store = w.compiled.store
+		w.wasiSnapshots = snapshots
+	}
+
+	return w.module, w.store, nil
 }
 
-func randomIdentifier() (int32, error) {
-	// generate a random number between 0 and the largest possible int32
-	num, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
-	if err != nil {
-		return -1, errors.Wrap(err, "failed to rand.Int")
+// runnableName returns the name of the Runnable running in the environment
+func (w *wasmEnvironment) runnableName() string {
+	if w.ref.Name != "" {
+		return w.ref.Name
 	}
 
-	return int32(num.Int64()), nil
+	return filepath.Base(w.ref.Filepath)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -276,22 +524,44 @@ func randomIdentifier() (int32, error) {
 // - deallocate                                                            //
 /////////////////////////////////////////////////////////////////////////////
 
-func (w *wasmInstance) readMemory(pointer int32, size int32) []byte {
+// checkMemoryLimit returns ErrMemoryLimitExceeded if the instance's memory is larger than maxPages.
+// wasmer does not allow limiting the growth of a module's own memory, so this is checked
+// when the instance is created and after its memory may have grown
+func (w *wasmInstance) checkMemoryLimit(maxPages uint32) error {
+	if maxPages == 0 {
+		return nil
+	}
+
 	memory, err := w.wasmerInst.Exports.GetMemory("memory")
 	if err != nil || memory == nil {
-		fmt.Println("MEMORY BAD")
-		// we failed
-		return []byte{}
+		return errors.New("missing required export: memory")
 	}
 
-	data := memory.Data()[pointer:]
-	result := make([]byte, size)
+	if pages := uint32(memory.Size()); pages > maxPages {
+		return errors.Wrapf(ErrMemoryLimitExceeded, "memory is %d pages, limit is %d", pages, maxPages)
+	}
 
-	for index := 0; int32(index) < size; index++ {
-		result[index] = data[index]
+	return nil
+}
+
+// readMemory reads size bytes from the instance's memory starting at pointer,
+// returning an error if that range is not within the bounds of the memory
+func (w *wasmInstance) readMemory(pointer int32, size int32) ([]byte, error) {
+	memory, err := w.wasmerInst.Exports.GetMemory("memory")
+	if err != nil || memory == nil {
+		return nil, errors.New("missing required export: memory")
 	}
 
-	return result
+	data := memory.Data()
+
+	if err := checkBounds(len(data), pointer, size); err != nil {
+		return nil, errors.Wrap(err, "failed to checkBounds")
+	}
+
+	result := make([]byte, size)
+	copy(result, data[pointer:pointer+size])
+
+	return result, nil
 }
 
 func (w *wasmInstance) writeMemory(data []byte) (int32, error) {
@@ -310,31 +580,58 @@ func (w *wasmInstance) writeMemory(data []byte) (int32, error) {
 
 	pointer := allocateResult.(int32)
 
-	w.writeMemoryAtLocation(pointer, data)
+	if err := w.writeMemoryAtLocation(pointer, data); err != nil {
+		return -1, errors.Wrap(err, "failed to writeMemoryAtLocation")
+	}
 
 	return pointer, nil
 }
 
-func (w *wasmInstance) writeMemoryAtLocation(pointer int32, data []byte) {
+// writeMemoryAtLocation writes data into the instance's memory starting at pointer,
+// returning an error if it would not fit within the bounds of the memory
+func (w *wasmInstance) writeMemoryAtLocation(pointer int32, data []byte) error {
 	memory, err := w.wasmerInst.Exports.GetMemory("memory")
 	if err != nil || memory == nil {
-		fmt.Println("MEMORY BAD")
-		// we failed
-		return
+		return errors.New("missing required export: memory")
 	}
 
-	scopedMemory := memory.Data()[pointer:]
+	memData := memory.Data()
 
-	copy(scopedMemory, data)
+	if len(data) > math.MaxInt32 {
+		return errors.New("data is too large to write into Wasm memory")
+	}
+
+	if err := checkBounds(len(memData), pointer, int32(len(data))); err != nil {
+		return errors.Wrap(err, "failed to checkBounds")
+	}
+
+	copy(memData[pointer:], data)
+
+	return nil
 }
 
-func (w *wasmInstance) deallocate(pointer int32, length int) {
+func (w *wasmInstance) deallocate(pointer int32, length int) error {
 	dealloc, err := w.wasmerInst.Exports.GetFunction("deallocate")
 	if err != nil || dealloc == nil {
-		fmt.Println("DEALLOC BAD")
-		// we failed
-		return
+		return errors.New("missing required FFI function: deallocate")
+	}
+
+	if _, err := dealloc(pointer, length); err != nil {
+		return errors.Wrap(err, "failed to call deallocate")
 	}
 
-	dealloc(pointer, length)
+	return nil
+}
+
+// checkBounds ensures that the range described by pointer and size falls within a memory of length memLen
+func checkBounds(memLen int, pointer int32, size int32) error {
+	if pointer < 0 || size < 0 {
+		return fmt.Errorf("invalid negative pointer (%d) or size (%d)", pointer, size)
+	}
+
+	if int64(pointer)+int64(size) > int64(memLen) {
+		return fmt.Errorf("pointer (%d) and size (%d) exceed memory length (%d)", pointer, size, memLen)
+	}
+
+	return nil
 }
@@ -7,11 +7,22 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/suborbital/hive-wasm/bundle"
+	"github.com/suborbital/hive-wasm/directive"
 	"github.com/suborbital/hive/hive"
 )
 
-// HandleBundleAtPath loads a .wasm.zip file into the hive instance
+// HandleBundleAtPath loads a .wasm.zip file into the hive instance using the package's default Runtime
 func HandleBundleAtPath(h *hive.Hive, path string) error {
+	return defaultRuntime.HandleBundleAtPath(h, path)
+}
+
+// HandleBundle loads a .wasm.zip file into the hive instance using the package's default Runtime
+func HandleBundle(h *hive.Hive, bundle *bundle.Bundle) error {
+	return defaultRuntime.HandleBundle(h, bundle)
+}
+
+// HandleBundleAtPath loads a .wasm.zip file into the hive instance, running its Runnables within the Runtime
+func (rt *Runtime) HandleBundleAtPath(h *hive.Hive, path string) error {
 	if !strings.HasSuffix(path, ".wasm.zip") {
 		return fmt.Errorf("cannot load bundle %s, does not have .wasm.zip extension", filepath.Base(path))
 	}
@@ -21,32 +32,90 @@ func HandleBundleAtPath(h *hive.Hive, path string) error {
 		return errors.Wrap(err, "failed to ReadBundle")
 	}
 
-	return HandleBundle(h, bundle)
+	return rt.HandleBundle(h, bundle)
 }
 
-// HandleBundle loads a .wasm.zip file into the hive instance
-func HandleBundle(h *hive.Hive, bundle *bundle.Bundle) error {
+// bundleMount is a Runnable from a bundle along with the job types it is mounted as and the options for its Runner
+type bundleMount struct {
+	ref     *bundle.WasmModuleRef
+	jobName string
+	fqfn    string
+	opts    []RunnerOption
+}
+
+// HandleBundle loads a .wasm.zip file into the hive instance, running its Runnables within the Runtime.
+// Loading a bundle again replaces its Runnables, and the Runners they were using are closed. Each Runnable's
+// cache keys are scoped to the Directive's Identifier and the Runnable's namespace, unless it opts in to the shared cache,
+// and its KV store keys are scoped to the Identifier. Runnables can only invoke the Runnables in the same Directive.
+// The Directive's config is resolved as the bundle is loaded, before any of its Runnables are mounted, so a bundle
+// that fails to load leaves the hive instance unchanged. WASI dirs with a host path are only permitted within the
+// Runtime's BundleWASIRoot
+func (rt *Runtime) HandleBundle(h *hive.Hive, bundle *bundle.Bundle) error {
 	if err := bundle.Directive.Validate(); err != nil {
 		return errors.Wrap(err, "failed to Validate bundle directive")
 	}
 
-	for i, r := range bundle.Runnables {
-		runner := newRunnerWithRef(&bundle.Runnables[i])
+	// every Runnable's options (including its config) are resolved before any of them are mounted,
+	// so that a bundle which fails to load does not leave some of its Runnables mounted
+	mounts := make([]bundleMount, len(bundle.Runnables))
 
+	for i, r := range bundle.Runnables {
 		jobName := strings.Replace(r.Name, ".wasm", "", -1)
 		fqfn, err := bundle.Directive.FQFN(jobName)
 		if err != nil {
 			return errors.Wrapf(err, "failed to FQFN for %s", jobName)
 		}
 
-		// mount both the "raw" name and the fqfn in case
-		// multiple bundles with conflicting names get mounted.
+		runnable := bundle.Directive.FindRunnable(jobName)
+
+		config, err := bundle.Directive.RunnableConfig(jobName, directive.AllowEnv(rt.bundleConfigEnv...))
+		if err != nil {
+			return errors.Wrapf(err, "failed to RunnableConfig for %s", jobName)
+		}
 
-		// pre-warm so that Runnables have at least one instance active
-		// when the first request is received.
-		h.Handle(jobName, runner, hive.PreWarm())
-		h.Handle(fqfn, runner, hive.PreWarm())
+		runnableOpts, err := runnerOptsForRunnable(runnable, bundle.StaticFiles, rt.bundleWASIRoot)
+		if err != nil {
+			return errors.Wrapf(err, "failed to runnerOptsForRunnable for %s", jobName)
+		}
+
+		// the Runnable's cache keys are isolated from those of other apps and namespaces, and its KV keys from other apps
+		opts := append(
+			runnableOpts,
+			CacheScope(runnableCacheScope(bundle.Directive.Identifier, runnable)),
+			KVScope(appKVScope(bundle.Directive.Identifier)),
+			Config(config),
+			jobNames(jobName, fqfn),
+		)
+
+		mounts[i] = bundleMount{ref: &bundle.Runnables[i], jobName: jobName, fqfn: fqfn, opts: opts}
+	}
+
+	// Runnables can only invoke the other Runnables in the same Directive
+	appNames := []string{}
+	for _, m := range mounts {
+		appNames = append(appNames, m.jobName, m.fqfn)
+	}
+
+	runners := make([]*Runner, 0, len(mounts))
 
+	for _, m := range mounts {
+		runner := rt.newRunnerWithRef(m.ref, append(m.opts, InvokeAccess(appNames...))...)
+		runners = append(runners, runner)
+
+		if runner.env.configErr != nil {
+			for _, r := range runners {
+				r.Close()
+			}
+
+			return errors.Wrapf(runner.env.configErr, "invalid options for %s", m.jobName)
+		}
+	}
+
+	for i, m := range mounts {
+		// mount both the "raw" name and the fqfn in case
+		// multiple bundles with conflicting names get mounted.
+		// if the bundle was loaded before, the Runners it replaces are closed
+		rt.mount(h, runners[i], m.jobName, m.fqfn)
 	}
 
 	return nil
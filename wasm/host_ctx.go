@@ -0,0 +1,62 @@
+package wasm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/request"
+	"github.com/suborbital/hive/hive"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// HostCtx is the context in which a custom host function is invoked. It gives access to the job
+// that the calling Runnable is executing and to the Runnable's memory, with all reads and writes
+// bounds-checked so that a misbehaving Runnable cannot cause the host to access invalid memory
+type HostCtx struct {
+	inst   *wasmInstance
+	logger *vlog.Logger
+}
+
+// Request returns the CoordinatedRequest the Runnable is handling, or nil if the job is not a request
+func (c *HostCtx) Request() *request.CoordinatedRequest {
+	return c.inst.jobRequest()
+}
+
+// HiveCtx returns the hive Ctx of the job being executed
+func (c *HostCtx) HiveCtx() *hive.Ctx {
+	return c.inst.jobCtx()
+}
+
+// Logger returns the logger of the Runtime that the Runnable is running in
+func (c *HostCtx) Logger() *vlog.Logger {
+	return c.logger
+}
+
+// ReadMemory reads size bytes from the Runnable's memory, starting at pointer
+func (c *HostCtx) ReadMemory(pointer int32, size int32) ([]byte, error) {
+	data, err := c.inst.readMemory(pointer, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to readMemory")
+	}
+
+	return data, nil
+}
+
+// WriteMemory allocates memory within the Runnable, writes data into it, and returns a pointer to it.
+// The Runnable is responsible for deallocating it
+func (c *HostCtx) WriteMemory(data []byte) (int32, error) {
+	pointer, err := c.inst.writeMemory(data)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to writeMemory")
+	}
+
+	return pointer, nil
+}
+
+// WriteMemoryAtLocation writes data into the Runnable's memory starting at pointer,
+// for example into a buffer that the Runnable has passed to the host function
+func (c *HostCtx) WriteMemoryAtLocation(pointer int32, data []byte) error {
+	if err := c.inst.writeMemoryAtLocation(pointer, data); err != nil {
+		return errors.Wrap(err, "failed to writeMemoryAtLocation")
+	}
+
+	return nil
+}
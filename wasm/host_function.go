@@ -3,18 +3,72 @@ package wasm
 import (
 	"fmt"
 
+	"github.com/pkg/errors"
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
+// errCodeMemoryAccess is returned to a Runnable by host functions that are
+// passed a pointer and size that fall outside of the Runnable's memory
+const errCodeMemoryAccess = int32(-5)
+
+// errCodeEgressDenied is returned to a Runnable by fetch_url when
+// the request is not permitted by the Runnable's EgressPolicy
+const errCodeEgressDenied = int32(-6)
+
+// errCodeResponseTooLarge is returned to a Runnable by fetch_url when
+// the response body is larger than the Runnable's maximum response size
+const errCodeResponseTooLarge = int32(-7)
+
+// errCodeNotFound is returned to a Runnable by host functions
+// when the key it has requested does not exist
+const errCodeNotFound = int32(-8)
+
+// errCodeUnavailable is returned to a Runnable by host functions that rely on
+// something the Runnable's Runner has not been configured with, such as a KV store
+const errCodeUnavailable = int32(-9)
+
+// errCodeAccessDenied is returned to a Runnable by get_secret and invoke_fn when
+// the Runnable has not been granted access to the secret or function
+const errCodeAccessDenied = int32(-10)
+
+// errCodeDepthExceeded is returned to a Runnable by invoke_fn when the
+// Runnable is already nested as deeply as its Runner permits
+const errCodeDepthExceeded = int32(-11)
+
+// errCodeInvokeCycle is returned to a Runnable by invoke_fn when the function it names is the Runnable
+// itself or one of the functions that invoked it, which would otherwise wait on itself
+const errCodeInvokeCycle = int32(-12)
+
 // HostFn describes a host function callable from within a Runnable module
 type HostFn struct {
 	name   string
 	args   []wasmer.ValueKind
 	ret    []wasmer.ValueKind
 	hostFn func(...wasmer.Value) (interface{}, error)
+
+	// callback is set for custom host functions created with NewHostFn
+	callback HostFnCallback
+}
+
+// HostFnCallback is the implementation of a custom host function. It receives the context of the
+// Runnable that called it, along with the arguments the Runnable passed (excluding the identifier).
+// If the host function has a single return value, the callback returns a value convertible to its
+// type (such as an int64 for wasmer.I64), and if it has several, it returns them as a []interface{}.
+// Returning an error causes the calling Runnable to trap
+type HostFnCallback func(ctx *HostCtx, args ...wasmer.Value) (interface{}, error)
+
+// NewHostFn creates a custom host function to be registered with a Runtime using RegisterHostFns.
+// Runnables call it in the module "env" with arguments of the types in args followed by their i32
+// identifier, and it returns values of the types in rets. A Swift variant (named with a "_swift"
+// suffix) is also made available, as with the built-in host functions
+func NewHostFn(name string, args []wasmer.ValueKind, rets []wasmer.ValueKind, callback HostFnCallback) *HostFn {
+	hfn := newHostFnWithTypes(name, args, rets, nil)
+	hfn.callback = callback
+
+	return hfn
 }
 
-// newHostFn creates a new host funcion
+// newHostFn creates a new host funcion whose arguments are all i32 and that optionally returns an i32
 func newHostFn(name string, argLen int, returns bool, fn func(...wasmer.Value) (interface{}, error)) *HostFn {
 	retVals := []wasmer.ValueKind{}
 	if returns {
@@ -26,16 +80,47 @@ func newHostFn(name string, argLen int, returns bool, fn func(...wasmer.Value) (
 		args[i] = wasmer.I32
 	}
 
+	return newHostFnWithTypes(name, args, retVals, fn)
+}
+
+// newHostFnWithTypes creates a new host function with arbitrary argument and return value types
+func newHostFnWithTypes(name string, args []wasmer.ValueKind, rets []wasmer.ValueKind, fn func(...wasmer.Value) (interface{}, error)) *HostFn {
 	hfn := &HostFn{
 		name:   name,
-		args:   args,
-		ret:    retVals,
+		args:   append([]wasmer.ValueKind{}, args...),
+		ret:    append([]wasmer.ValueKind{}, rets...),
 		hostFn: fn,
 	}
 
 	return hfn
 }
 
+// bind creates the host function that Runnables within the Runtime call to invoke a custom host function,
+// which appends the identifier argument and resolves it to the HostCtx that the callback receives
+func (h *HostFn) bind(rt *Runtime) *HostFn {
+	argLen := len(h.args)
+
+	fn := func(args ...wasmer.Value) (interface{}, error) {
+		// the identifier follows the custom fn's own args (and precedes any Swift args)
+		ident := args[argLen].I32()
+
+		inst, err := rt.instanceForIdentifier(ident)
+		if err != nil {
+			rt.logger.Error(errors.Wrap(err, "[hive-wasm] alert: invalid identifier used, potential malicious activity"))
+			return nil, errors.Wrap(err, "failed to instanceForIdentifier")
+		}
+
+		ctx := &HostCtx{
+			inst:   inst,
+			logger: rt.logger,
+		}
+
+		return h.callback(ctx, args[:argLen]...)
+	}
+
+	return newHostFnWithTypes(h.name, append(append([]wasmer.ValueKind{}, h.args...), wasmer.I32), h.ret, fn)
+}
+
 // addHostFns adds a list of host functions to an import object
 func addHostFns(imports *wasmer.ImportObject, store *wasmer.Store, fns ...*HostFn) {
 	externMap := map[string]wasmer.IntoExtern{}
@@ -85,7 +170,7 @@ func (h *HostFn) fnArgs() []*wasmer.ValueType {
 
 // SwiftArgs returns the argument types for the function's Swift variant
 func (h *HostFn) fnSwiftArgs() []*wasmer.ValueType {
-	swiftArgs := append(h.args, wasmer.I32, wasmer.I32)
+	swiftArgs := append(append([]wasmer.ValueKind{}, h.args...), wasmer.I32, wasmer.I32)
 
 	return wasmer.NewValueTypes(swiftArgs...)
 }
@@ -103,11 +188,58 @@ func (h *HostFn) fn() func([]wasmer.Value) ([]wasmer.Value, error) {
 			return nil, err
 		}
 
-		retVals := []wasmer.Value{}
-		if result != nil {
-			retVals = append(retVals, wasmer.NewValue(result, wasmer.I32))
-		}
+		return h.toWasmerValues(result)
+	}
+}
+
+// toWasmerValues converts the result of a host fn into Wasm values of its return types. A single
+// return value is converted directly, and several return values must be provided as a []interface{}
+func (h *HostFn) toWasmerValues(result interface{}) ([]wasmer.Value, error) {
+	retVals := []wasmer.Value{}
 
+	switch len(h.ret) {
+	case 0:
 		return retVals, nil
+	case 1:
+		if result == nil {
+			return nil, fmt.Errorf("host function %s returned no value", h.name)
+		}
+
+		val, err := toWasmerValue(result, h.ret[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert return value of host function %s", h.name)
+		}
+
+		return append(retVals, val), nil
+	}
+
+	results, ok := result.([]interface{})
+	if !ok || len(results) != len(h.ret) {
+		return nil, fmt.Errorf("host function %s must return %d values as []interface{}", h.name, len(h.ret))
+	}
+
+	for i, r := range results {
+		val, err := toWasmerValue(r, h.ret[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert return value %d of host function %s", i, h.name)
+		}
+
+		retVals = append(retVals, val)
 	}
+
+	return retVals, nil
+}
+
+// toWasmerValue converts a Go value to a Wasm value of the given kind, returning an error
+// rather than panicking (as wasmer does) if the Go value cannot be converted to that kind
+func toWasmerValue(value interface{}, kind wasmer.ValueKind) (val wasmer.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot convert %T to %s", value, kind.String())
+		}
+	}()
+
+	val = wasmer.NewValue(value, kind)
+
+	return val, nil
 }
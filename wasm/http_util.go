@@ -1,18 +1,32 @@
 package wasm
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// outboundRequestVersion is the first byte of an encoded outbound request, allowing the format to change in future
+const outboundRequestVersion = byte(1)
+
+// outboundRequest is a request to be made on behalf of a Runnable
+type outboundRequest struct {
+	method  string
+	url     string
+	headers http.Header
+	body    []byte
+}
+
 func parseHTTPHeaders(urlParts []string) (*http.Header, error) {
 	headers := &http.Header{}
 
 	if len(urlParts) > 1 {
 		for _, p := range urlParts[1:] {
-			headerParts := strings.Split(p, ":")
+			// header values can contain colons, so only the first one separates the key
+			headerParts := strings.SplitN(p, ":", 2)
 			if len(headerParts) != 2 {
 				return nil, errors.New("header was not formatted correctly")
 			}
@@ -23,3 +37,101 @@ func parseHTTPHeaders(urlParts []string) (*http.Header, error) {
 
 	return headers, nil
 }
+
+// decodeOutboundRequest decodes a request encoded by a Runnable for fetch_request. Following the version byte, the
+// method, URL, headers and body are each encoded as fields, where a field is a little-endian uint32 length followed
+// by that many bytes. The headers are a uint32 count followed by a key field and a value field for each header,
+// so repeated headers and values containing any character are supported:
+//
+//	version | method | url | header count | (key | value)... | body
+func decodeOutboundRequest(encoded []byte) (*outboundRequest, error) {
+	if len(encoded) == 0 || encoded[0] != outboundRequestVersion {
+		return nil, errors.New("request has unknown encoding version")
+	}
+
+	d := &requestDecoder{buf: encoded[1:]}
+
+	req := &outboundRequest{
+		method:  string(d.field()),
+		url:     string(d.field()),
+		headers: http.Header{},
+	}
+
+	if d.err == nil && !isSupportedMethod(req.method) {
+		return nil, fmt.Errorf("method %s is not supported", req.method)
+	}
+
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		key, val := d.field(), d.field()
+		req.headers.Add(string(key), string(val))
+	}
+
+	req.body = d.field()
+
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "failed to decode request")
+	}
+
+	if len(d.buf) > 0 {
+		return nil, errors.New("request has unexpected trailing bytes")
+	}
+
+	return req, nil
+}
+
+// requestDecoder reads the fields of an encoded outbound request, recording the first error encountered
+type requestDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *requestDecoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+
+	if len(d.buf) < 4 {
+		d.err = errors.New("unexpected end of request")
+		return 0
+	}
+
+	val := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+
+	return val
+}
+
+func (d *requestDecoder) field() []byte {
+	size := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+
+	if uint64(size) > uint64(len(d.buf)) {
+		d.err = errors.New("field is longer than the remaining request")
+		return nil
+	}
+
+	val := d.buf[:size]
+	d.buf = d.buf[size:]
+
+	return val
+}
+
+// encodeList encodes a list of values for a Runnable as a little-endian uint32 count followed
+// by each value as a uint32 length and its bytes, in the same way as decodeOutboundRequest's fields
+func encodeList(vals []string) []byte {
+	encoded := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encoded, uint32(len(vals)))
+
+	for _, val := range vals {
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(val)))
+
+		encoded = append(encoded, size...)
+		encoded = append(encoded, val...)
+	}
+
+	return encoded
+}
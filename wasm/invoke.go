@@ -0,0 +1,147 @@
+package wasm
+
+import (
+	"time"
+
+	"github.com/suborbital/hive-wasm/request"
+)
+
+// defaultMaxInvokeDepth is the number of nested invoke_fn calls permitted by default
+const defaultMaxInvokeDepth = 8
+
+// defaultInvokeTimeout is how long invoke_fn waits for an invoked function by default, if the Runner has no Timeout
+const defaultInvokeTimeout = 30 * time.Second
+
+// Invocation is the data of a job scheduled by a Runnable with invoke_fn. Wasm Runners use Input as the Runnable's input
+// and track Depth and Chain to stop invocations from recursing. Other Runnables that may be invoked should accept it
+type Invocation struct {
+	Input []byte
+	// Depth is the number of invoke_fn calls that led to the job, starting from 1
+	Depth int
+	// Chain is the names of the functions that led to the job, including the name it was invoked with
+	Chain []string
+}
+
+// invokeJobResult is the result of a job scheduled by invoke_fn
+type invokeJobResult struct {
+	res interface{}
+	err error
+}
+
+// invokeResult holds the output of an instance's last call to invoke_fn if it did not fit in the Runnable's buffer,
+// so that the Runnable can make the same call (identified by key) again with a larger buffer without the function
+// being invoked again
+type invokeResult struct {
+	key    string
+	output []byte
+}
+
+// MaxInvokeDepth sets the number of nested invoke_fn calls permitted, counting from the job that a Runnable was
+// originally given (so that with a depth of 1, it may invoke a function, but that function cannot invoke another).
+// The default is 8, and a depth of 0 or less means the default. A Runnable cannot invoke itself or any function that
+// led to it being invoked, since it would wait on a job that may need the same worker it is running on
+func MaxInvokeDepth(depth int) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.maxInvokeDepth = depth
+	}
+}
+
+// InvokeTimeout sets the maximum time invoke_fn waits for an invoked function to complete before returning an
+// error to the Runnable. The default is the Runner's Timeout, or 30 seconds if it has none
+func InvokeTimeout(timeout time.Duration) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.invokeTimeout = timeout
+	}
+}
+
+// InvokeAccess permits the Runnable to invoke only the named functions (by job name or FQFN) with invoke_fn.
+// Runnables loaded from a bundle can only invoke the Runnables in the same Directive, and other
+// Runners may invoke any function unless they are restricted with InvokeAccess
+func InvokeAccess(names ...string) RunnerOption {
+	return func(opts *runnerOpts) {
+		if opts.invokeAccess == nil {
+			opts.invokeAccess = map[string]bool{}
+		}
+
+		for _, name := range names {
+			opts.invokeAccess[name] = true
+		}
+	}
+}
+
+// jobNames sets the names (job name and FQFN) that the Runnable is mounted as, so that
+// invoke_fn can recognise a Runnable invoking itself before it is invoked by any other
+func jobNames(names ...string) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.jobNames = append(opts.jobNames, names...)
+	}
+}
+
+// maxInvokeDepth returns the environment's invoke_fn depth limit
+func (w *wasmEnvironment) maxInvokeDepth() int {
+	if w.opts.maxInvokeDepth <= 0 {
+		return defaultMaxInvokeDepth
+	}
+
+	return w.opts.maxInvokeDepth
+}
+
+// invokeTimeout returns how long the environment's invoke_fn calls wait for the invoked function
+func (w *wasmEnvironment) invokeTimeout() time.Duration {
+	if w.opts.invokeTimeout > 0 {
+		return w.opts.invokeTimeout
+	}
+
+	if w.opts.timeout > 0 {
+		return w.opts.timeout
+	}
+
+	return defaultInvokeTimeout
+}
+
+// canInvoke returns true if the environment's Runnable is permitted to invoke the named function
+func (w *wasmEnvironment) canInvoke(name string) bool {
+	if w.opts.invokeAccess == nil {
+		return true
+	}
+
+	return w.opts.invokeAccess[name]
+}
+
+// invokeChain returns the chain of function names for a job invoked by inst with name, which
+// includes every function that led to it (the names of inst's Runnable and its callers)
+func (w *wasmInstance) invokeChain(name string) []string {
+	chain := append([]string{}, w.invokeCallers...)
+	chain = append(chain, w.env.opts.jobNames...)
+
+	return append(chain, name)
+}
+
+// invokesCycle returns true if name is inst's Runnable or any function that led to it
+func (w *wasmInstance) invokesCycle(name string) bool {
+	for _, caller := range w.invokeCallers {
+		if caller == name {
+			return true
+		}
+	}
+
+	for _, jobName := range w.env.opts.jobNames {
+		if jobName == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// invokeOutput converts the result of an invoked job into the bytes returned to the Runnable that invoked it
+func invokeOutput(res interface{}) ([]byte, error) {
+	switch r := res.(type) {
+	case *RunResult:
+		return r.Result, nil
+	case *request.CoordinatedResponse:
+		return r.Output, nil
+	}
+
+	return interfaceToBytes(res)
+}
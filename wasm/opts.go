@@ -0,0 +1,299 @@
+package wasm
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/directive"
+	"github.com/suborbital/hive-wasm/kv"
+	"github.com/suborbital/hive-wasm/secrets"
+)
+
+// RunnerOption is a function that modifies the options for a Runner
+type RunnerOption func(*runnerOpts)
+
+type runnerOpts struct {
+	timeout        time.Duration
+	maxMemoryPages uint32
+	wasiEnv        map[string]string
+	wasiArgs       []string
+	wasiDirs       []wasiDir
+	outputMode     OutputMode
+	egress         egressPolicies
+
+	httpClient      *http.Client
+	fetchTimeout    time.Duration
+	maxResponseSize int64
+	fetchRetries    int
+	fetchBackoff    time.Duration
+	cacheScope      string
+	cacheUnscoped   bool
+
+	kvStore    kv.Store
+	kvScope    string
+	kvUnscoped bool
+
+	secretProvider secrets.Provider
+	secretAccess   map[string]bool
+
+	config map[string]string
+
+	maxInvokeDepth int
+	invokeTimeout  time.Duration
+	invokeAccess   map[string]bool
+	jobNames       []string
+}
+
+// OutputMode determines what happens to the output a Runnable writes to WASI stdout and stderr
+type OutputMode int
+
+const (
+	// OutputLog captures the output of each execution and logs it, scoped with the
+	// Runnable's name and the ID of the request being handled. This is the default
+	OutputLog OutputMode = iota
+	// OutputLogAndAttach logs output as OutputLog does, and Run returns a *RunResult
+	// including the output rather than the Runnable's result alone, for debugging
+	OutputLogAndAttach
+	// OutputInherit writes output directly to the host process's stdout and stderr
+	OutputInherit
+)
+
+// wasiDir is a directory to be preopened for a Runnable, sourced
+// either from a directory on the host or from a set of files
+type wasiDir struct {
+	guestPath string
+	hostPath  string
+	files     map[string][]byte
+}
+
+// Timeout sets the maximum wall-clock time a single execution of the Runnable may take.
+// If an execution exceeds it, Run returns ErrRunnableTimeout and the instance it was using is
+// discarded and replaced. A timeout of 0 (the default) means executions are not time-limited
+func Timeout(timeout time.Duration) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.timeout = timeout
+	}
+}
+
+// MaxMemoryPages sets the maximum size (in 64KiB Wasm pages) that an instance's linear memory may reach.
+// Instances that start larger than the limit fail to be created, and instances that grow beyond it
+// cause Run to return ErrMemoryLimitExceeded and are discarded and replaced. A limit of 0 (the default) means unlimited
+func MaxMemoryPages(pages uint32) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.maxMemoryPages = pages
+	}
+}
+
+// Output sets what happens to the output a Runnable writes to WASI stdout and stderr
+func Output(mode OutputMode) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.outputMode = mode
+	}
+}
+
+// WASIEnv sets environment variables that are made available to the Runnable through WASI
+func WASIEnv(env map[string]string) RunnerOption {
+	return func(opts *runnerOpts) {
+		for k, v := range env {
+			opts.wasiEnv[k] = v
+		}
+	}
+}
+
+// WASIArgs sets arguments that are made available to the Runnable through WASI
+// (following the program name, which is the name of the Wasm module)
+func WASIArgs(args ...string) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.wasiArgs = append(opts.wasiArgs, args...)
+	}
+}
+
+// WASIDir makes a directory on the host available to the Runnable through WASI at guestPath. A snapshot of the
+// directory is taken when the Runnable's environment is built, so it does not see later changes, and each instance
+// is given its own writable copy of the snapshot. Anything the Runnable writes to it is discarded after each execution,
+// so the directory on the host is never modified and every execution sees the same files
+func WASIDir(guestPath, hostPath string) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.wasiDirs = append(opts.wasiDirs, wasiDir{guestPath: guestPath, hostPath: hostPath})
+	}
+}
+
+// HTTPClient sets the client used to make the Runnable's requests with fetch_url, in place of one using a default
+// transport. The Runnable's egress policies still apply, with the connections of an *http.Transport checked for private
+// IP addresses (and its proxy not used). Any other RoundTripper can only be used if the policy has AllowPrivateIPs set,
+// otherwise the Runner fails to run (and HandleBundle returns an error for bundles loaded with it)
+func HTTPClient(client *http.Client) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.httpClient = client
+	}
+}
+
+// FetchTimeout sets the maximum time each attempt at a request made with fetch_url may take, including
+// reading the response body. A timeout of 0 (the default) means requests are not time-limited
+func FetchTimeout(timeout time.Duration) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.fetchTimeout = timeout
+	}
+}
+
+// FetchMaxResponseSize sets the maximum size (in bytes) of a response body read by fetch_url. Larger
+// responses cause fetch_url to return an error to the Runnable. A size of 0 (the default) means unlimited
+func FetchMaxResponseSize(size int64) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.maxResponseSize = size
+	}
+}
+
+// FetchRetry sets the number of times that an idempotent request (GET, HEAD, OPTIONS, PUT or DELETE) made with
+// fetch_url is retried after failing to connect or receiving a 429, 502, 503 or 504 response. The first retry
+// waits for backoff, which doubles for each one after it. Requests are not retried by default
+func FetchRetry(retries int, backoff time.Duration) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.fetchRetries = retries
+		opts.fetchBackoff = backoff
+	}
+}
+
+// Config sets configuration values that the Runnable can read with get_config. It can be set more than
+// once, in which case later values replace earlier ones with the same key
+func Config(config map[string]string) RunnerOption {
+	return func(opts *runnerOpts) {
+		for k, v := range config {
+			opts.config[k] = v
+		}
+	}
+}
+
+// KVStore sets the Store that the Runnable uses with the kv host functions. Without one, the kv host
+// functions return an error to the Runnable. It is typically set for every Runnable with DefaultRunnerOptions
+func KVStore(store kv.Store) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.kvStore = store
+	}
+}
+
+// KVScope prefixes every key that the Runnable uses with the kv host functions with scope, isolating them from
+// Runnables in other scopes. Runnables loaded from a bundle are scoped to their app automatically. Without a scope,
+// a Runner is given one of its own (so its keys are not shared with any other Runner, including one created later
+// for the same module), and the empty scope is only used with UnscopedKV
+func KVScope(scope string) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.kvScope = scope
+		opts.kvUnscoped = false
+	}
+}
+
+// UnscopedKV gives the Runnable access to every key in its KV store, including those of every other Runnable
+func UnscopedKV() RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.kvScope = ""
+		opts.kvUnscoped = true
+	}
+}
+
+// wasiFilesDir makes a set of files (keyed by their path relative to
+// the directory) available to the Runnable through WASI at guestPath
+func wasiFilesDir(guestPath string, files map[string][]byte) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.wasiDirs = append(opts.wasiDirs, wasiDir{guestPath: guestPath, files: files})
+	}
+}
+
+func defaultRunnerOpts() runnerOpts {
+	return runnerOpts{
+		wasiEnv:  map[string]string{},
+		wasiArgs: []string{},
+		wasiDirs: []wasiDir{},
+
+		secretAccess: map[string]bool{},
+		config:       map[string]string{},
+	}
+}
+
+func newRunnerOpts(mods ...RunnerOption) runnerOpts {
+	opts := defaultRunnerOpts()
+
+	for _, mod := range mods {
+		mod(&opts)
+	}
+
+	return opts
+}
+
+// runnerOptsForRunnable converts the settings for a Runnable in a Directive into RunnerOptions, using the bundle's
+// static files for any directories sourced from the bundle. Directories on the host are resolved within wasiRoot,
+// and are not permitted if it is empty, since a bundle must not be able to read arbitrary files from the host
+func runnerOptsForRunnable(r *directive.Runnable, staticFiles map[string][]byte, wasiRoot string) ([]RunnerOption, error) {
+	opts := []RunnerOption{}
+
+	if r == nil {
+		return opts, nil
+	}
+
+	if r.TimeoutMS > 0 {
+		opts = append(opts, Timeout(time.Duration(r.TimeoutMS)*time.Millisecond))
+	}
+
+	if r.MaxMemoryPages > 0 {
+		opts = append(opts, MaxMemoryPages(r.MaxMemoryPages))
+	}
+
+	if r.Egress != nil {
+		policy := EgressPolicy{
+			Schemes:         r.Egress.Schemes,
+			AllowHosts:      r.Egress.AllowHosts,
+			DenyHosts:       r.Egress.DenyHosts,
+			AllowPrivateIPs: r.Egress.AllowPrivateIPs,
+			MaxRedirects:    r.Egress.MaxRedirects,
+		}
+
+		opts = append(opts, Egress(policy))
+	}
+
+	if len(r.Secrets) > 0 {
+		opts = append(opts, SecretAccess(r.Secrets...))
+	}
+
+	if r.WASI != nil {
+		opts = append(opts, WASIEnv(r.WASI.Env), WASIArgs(r.WASI.Args...))
+
+		for _, dir := range r.WASI.Dirs {
+			if dir.BundlePath != "" {
+				opts = append(opts, wasiFilesDir(dir.GuestPath, filesWithin(staticFiles, dir.BundlePath)))
+				continue
+			}
+
+			if wasiRoot == "" {
+				return nil, fmt.Errorf("wasi dir %s has a host path, which is not permitted without a BundleWASIRoot", dir.GuestPath)
+			}
+
+			hostPath, err := resolveWithin(wasiRoot, dir.Path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to resolveWithin for wasi dir %s", dir.GuestPath)
+			}
+
+			opts = append(opts, WASIDir(dir.GuestPath, hostPath))
+		}
+	}
+
+	return opts, nil
+}
+
+// filesWithin returns the files that are within dir, keyed by their path relative to it
+func filesWithin(files map[string][]byte, dir string) map[string][]byte {
+	prefix := path.Clean(dir) + "/"
+
+	within := map[string][]byte{}
+
+	for name, contents := range files {
+		if strings.HasPrefix(name, prefix) {
+			within[strings.TrimPrefix(name, prefix)] = contents
+		}
+	}
+
+	return within
+}
@@ -0,0 +1,76 @@
+package wasm
+
+import (
+	"strings"
+
+	"github.com/suborbital/hive-wasm/request"
+)
+
+// RunResult is returned from Run by Runners using OutputLogAndAttach, and includes
+// the output the Runnable wrote to stdout and stderr along with its result (and the
+// changes it made to the response and state, if the job was a request it changed them for)
+type RunResult struct {
+	Result   []byte                       `json:"result"`
+	Response *request.CoordinatedResponse `json:"response,omitempty"`
+	Stdout   []byte                       `json:"stdout"`
+	Stderr   []byte                       `json:"stderr"`
+}
+
+// RunnableResult returns the Runnable's output, and the response containing it if the Runnable changed the
+// response or state, allowing callers such as sequences to unwrap it without depending on this package
+func (r *RunResult) RunnableResult() ([]byte, *request.CoordinatedResponse) {
+	return r.Result, r.Response
+}
+
+type outputScope struct {
+	Runnable  string `json:"runnable"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// readOutput reads (and clears) the output captured from the instance's stdout and stderr
+func (w *wasmInstance) readOutput() ([]byte, []byte) {
+	// wasmer returns slices backed by memory it does not manage, so they are copied
+	stdout := append([]byte{}, w.wasiEnv.ReadStdout()...)
+	stderr := append([]byte{}, w.wasiEnv.ReadStderr()...)
+
+	return stdout, stderr
+}
+
+// logOutput reads the output captured from the instance and logs each line of it,
+// scoped with the Runnable's name and the ID of req (if it is set), and returns it
+func (w *wasmEnvironment) logOutput(inst *wasmInstance, req *request.CoordinatedRequest) ([]byte, []byte) {
+	if w.opts.outputMode == OutputInherit {
+		return nil, nil
+	}
+
+	stdout, stderr := inst.readOutput()
+	if len(stdout) == 0 && len(stderr) == 0 {
+		return stdout, stderr
+	}
+
+	scope := outputScope{Runnable: w.runnableName()}
+	if req != nil {
+		scope.RequestID = req.ID
+	}
+
+	l := w.rt.logger.CreateScoped(scope)
+
+	for _, line := range outputLines(stdout) {
+		l.Info(w.rt.redactor.redact(line))
+	}
+
+	for _, line := range outputLines(stderr) {
+		l.Warn(w.rt.redactor.redact(line))
+	}
+
+	return stdout, stderr
+}
+
+func outputLines(output []byte) []string {
+	trimmed := strings.TrimRight(string(output), "\n")
+	if trimmed == "" {
+		return []string{}
+	}
+
+	return strings.Split(trimmed, "\n")
+}
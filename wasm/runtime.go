@@ -0,0 +1,431 @@
+package wasm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/bundle"
+	"github.com/suborbital/hive/hive"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Runtime is an isolated set of Wasm environments, along with the identifier space, logger, host functions
+// and configuration they use. Several Runtimes can be used in one process (one per tenant, for example)
+// without sharing any state, and each can be torn down independently
+type Runtime struct {
+	// the set of Wasm environments belonging to the Runtime, accessed by UUID
+	environments map[string]*wasmEnvironment
+
+	// a lock to ensure the environments map is concurrency safe (didn't use sync.Map to prevent type coersion)
+	envLock sync.RWMutex
+
+	// the instance mapper maps a random int32 to a wasm instance to prevent malicious access to other instances via the FFI
+	instanceMapper sync.Map
+
+	// the logger used by Wasm Runnables
+	logger *vlog.Logger
+
+	// the host functions mounted into every environment's imports
+	hostFns []*HostFn
+
+	// RunnerOptions applied to every Runner created by the Runtime
+	runnerOpts []RunnerOption
+
+	// the directory on the host within which the WASI dirs of bundles' Runnables can be preopened by path
+	bundleWASIRoot string
+
+	// the environment variables that bundles' config values can interpolate
+	bundleConfigEnv []string
+
+	// compiled modules, keyed by the SHA-256 of their bytes, shared by every environment running the same module
+	// so that loading the same bundle repeatedly does not compile it again. Each is closed once no environment uses it
+	modules    map[string]*compiledModule
+	moduleLock sync.Mutex
+
+	// the Runners mounted into hive instances by HandleBundle, so that they
+	// can be closed when a bundle is re-loaded and replaces them
+	mounted   map[mountKey]*Runner
+	mountLock sync.Mutex
+
+	// the state kept for the caches used by Runnables, keyed by the cache (see cacheOps)
+	caches    map[interface{}]*cacheState
+	cacheLock sync.Mutex
+
+	// removes the secrets accessed by any Runnable from the messages and output logged by every Runnable
+	redactor *redactor
+}
+
+// mountKey identifies a job type handled by a particular hive instance
+type mountKey struct {
+	h       *hive.Hive
+	jobType string
+}
+
+// compiledModule is a Wasm module compiled into its own store, along with
+// the number of environments using it (guarded by the Runtime's moduleLock)
+type compiledModule struct {
+	key    string
+	store  *wasmer.Store
+	module *wasmer.Module
+	refs   int
+}
+
+// RuntimeOption is a function that modifies a Runtime
+type RuntimeOption func(*Runtime)
+
+// instanceReference is a "pointer" to an environment within a Runtime and the
+// wasm instance within that environment that is currently in use
+type instanceReference struct {
+	EnvUUID string
+	Inst    *wasmInstance
+}
+
+// the Runtime used by the package-level functions
+var defaultRuntime = NewRuntime()
+
+// NewRuntime creates a new Runtime
+func NewRuntime(opts ...RuntimeOption) *Runtime {
+	rt := &Runtime{
+		environments:   map[string]*wasmEnvironment{},
+		envLock:        sync.RWMutex{},
+		instanceMapper: sync.Map{},
+		logger:         vlog.Default(),
+		runnerOpts:     []RunnerOption{},
+		modules:        map[string]*compiledModule{},
+		moduleLock:     sync.Mutex{},
+		mounted:        map[mountKey]*Runner{},
+		mountLock:      sync.Mutex{},
+		caches:         map[interface{}]*cacheState{},
+		cacheLock:      sync.Mutex{},
+		redactor:       &redactor{},
+	}
+
+	rt.hostFns = []*HostFn{
+		returnResult(rt),
+		returnError(rt),
+		fetchURL(rt),
+		fetchRequest(rt),
+		fetchStatus(rt),
+		fetchHeader(rt),
+		cacheSet(rt),
+		cacheGet(rt),
+		cacheDelete(rt),
+		cacheExists(rt),
+		cacheIncr(rt),
+		cacheCAS(rt),
+		cacheKeys(rt),
+		kvGet(rt),
+		kvPut(rt),
+		kvDelete(rt),
+		kvScan(rt),
+		getSecret(rt),
+		getConfig(rt),
+		invokeFn(rt),
+		logMsg(rt),
+		requestGetField(rt),
+		responseSetStatus(rt),
+		responseSetHeader(rt),
+		responseAddHeader(rt),
+		stateSet(rt),
+		stateDelete(rt),
+	}
+
+	for _, opt := range opts {
+		opt(rt)
+	}
+
+	return rt
+}
+
+// Logger sets the logger to be used by the Runtime's Wasm Runnables
+func Logger(l *vlog.Logger) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.logger = l
+	}
+}
+
+// DefaultRunnerOptions sets RunnerOptions to be applied to every Runner created by the Runtime,
+// before any options passed to NewRunner or set in a bundle's Directive
+func DefaultRunnerOptions(opts ...RunnerOption) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.runnerOpts = append(rt.runnerOpts, opts...)
+	}
+}
+
+// BundleWASIRoot permits the Runnables of bundles loaded by the Runtime to be given directories on the host by
+// path in the Directive, which are resolved within root (so they can never refer to anything outside of it).
+// Without it, Runnables loaded from bundles can only be given directories from within their bundle
+func BundleWASIRoot(root string) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.bundleWASIRoot = root
+	}
+}
+
+// BundleConfigEnv permits the config values in the Directives of bundles loaded by the Runtime to interpolate the
+// named environment variables with ${NAME}. Without it, a bundle whose config references any environment variable
+// fails to load, so that a bundle cannot read the host's environment (such as its secrets) through its config
+func BundleConfigEnv(names ...string) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.bundleConfigEnv = append(rt.bundleConfigEnv, names...)
+	}
+}
+
+// RegisterHostFns adds custom host functions (created with NewHostFn) to the Runtime, making them
+// available to every Runnable it runs. Host functions must be registered before any Runners are
+// created or bundles are loaded, and their names must not conflict with any existing host function
+func (rt *Runtime) RegisterHostFns(fns ...*HostFn) error {
+	rt.envLock.Lock()
+	defer rt.envLock.Unlock()
+
+	if len(rt.environments) > 0 {
+		return errors.New("host functions must be registered before any Runners are created")
+	}
+
+	names := map[string]bool{}
+	for _, existing := range rt.hostFns {
+		names[existing.fnName()] = true
+		names[existing.fnSwiftName()] = true
+	}
+
+	bound := make([]*HostFn, len(fns))
+
+	for i, fn := range fns {
+		if fn.callback == nil {
+			return fmt.Errorf("host function %s was not created with NewHostFn", fn.fnName())
+		}
+
+		if names[fn.fnName()] || names[fn.fnSwiftName()] {
+			return fmt.Errorf("host function %s conflicts with an existing host function", fn.fnName())
+		}
+
+		names[fn.fnName()] = true
+		names[fn.fnSwiftName()] = true
+
+		bound[i] = fn.bind(rt)
+	}
+
+	rt.hostFns = append(rt.hostFns, bound...)
+
+	return nil
+}
+
+// UseLogger sets the logger to be used by the Runtime's Wasm Runnables
+func (rt *Runtime) UseLogger(l *vlog.Logger) {
+	rt.logger = l
+}
+
+// NewRunner returns a new *Runner that runs within the Runtime
+func (rt *Runtime) NewRunner(filepath string, opts ...RunnerOption) *Runner {
+	ref := &bundle.WasmModuleRef{
+		Filepath: filepath,
+	}
+
+	return rt.newRunnerWithRef(ref, opts...)
+}
+
+func (rt *Runtime) newRunnerWithRef(ref *bundle.WasmModuleRef, opts ...RunnerOption) *Runner {
+	allOpts := append(append([]RunnerOption{}, rt.runnerOpts...), opts...)
+
+	environment := rt.newEnvironment(ref, newRunnerOpts(allOpts...))
+
+	r := &Runner{
+		env: environment,
+	}
+
+	return r
+}
+
+// Close tears down the Runtime, removing all of its environments and closing the instances within them and its
+// compiled modules. Instances (and the modules they use) that are still running an execution that timed out are
+// closed once it returns. Runners belonging to the Runtime must not be used after it is closed
+func (rt *Runtime) Close() {
+	rt.envLock.RLock()
+	envs := make([]*wasmEnvironment, 0, len(rt.environments))
+	for _, env := range rt.environments {
+		envs = append(envs, env)
+	}
+	rt.envLock.RUnlock()
+
+	for _, env := range envs {
+		rt.removeEnvironment(env)
+	}
+
+	rt.mountLock.Lock()
+	rt.mounted = map[mountKey]*Runner{}
+	rt.mountLock.Unlock()
+
+	rt.cacheLock.Lock()
+	rt.caches = map[interface{}]*cacheState{}
+	rt.cacheLock.Unlock()
+}
+
+// mount handles each of the job types with the Runner in the hive instance, and closes any
+// Runner that the Runtime had previously mounted for them and that is no longer handling any job type
+func (rt *Runtime) mount(h *hive.Hive, runner *Runner, jobTypes ...string) {
+	rt.mountLock.Lock()
+	defer rt.mountLock.Unlock()
+
+	replaced := map[*Runner]bool{}
+
+	for _, jobType := range jobTypes {
+		// pre-warm so that Runnables have at least one instance active
+		// when the first request is received.
+		h.Handle(jobType, runner, hive.PreWarm())
+
+		key := mountKey{h: h, jobType: jobType}
+
+		if old, exists := rt.mounted[key]; exists && old != runner {
+			replaced[old] = true
+		}
+
+		rt.mounted[key] = runner
+	}
+
+	for _, r := range rt.mounted {
+		delete(replaced, r)
+	}
+
+	// hive has stopped sending jobs to the replaced Runners, so any
+	// in-flight jobs are allowed to finish before they are closed
+	for old := range replaced {
+		old.Close()
+	}
+}
+
+// compiledModule returns the compiled form of moduleBytes, compiling it only if an identical module has not already been
+// compiled by the Runtime, and counts a reference to it that must be released with releaseModule once it is no longer used
+func (rt *Runtime) compiledModule(moduleBytes []byte) (*compiledModule, error) {
+	sum := sha256.Sum256(moduleBytes)
+	key := hex.EncodeToString(sum[:])
+
+	rt.moduleLock.Lock()
+	defer rt.moduleLock.Unlock()
+
+	if compiled, exists := rt.modules[key]; exists {
+		compiled.refs++
+		return compiled, nil
+	}
+
+	store := wasmer.NewStore(wasmer.NewEngine())
+
+	mod, err := wasmer.NewModule(store, moduleBytes)
+	if err != nil {
+		store.Close()
+		return nil, errors.Wrap(err, "failed to NewModule")
+	}
+
+	compiled := &compiledModule{
+		key:    key,
+		store:  store,
+		module: mod,
+		refs:   1,
+	}
+
+	rt.modules[key] = compiled
+
+	return compiled, nil
+}
+
+// releaseModule releases a reference to a compiled module, closing it once it has none. Every
+// instance created from the module must have been closed before the last reference is released
+func (rt *Runtime) releaseModule(compiled *compiledModule) {
+	rt.moduleLock.Lock()
+	defer rt.moduleLock.Unlock()
+
+	compiled.refs--
+	if compiled.refs > 0 {
+		return
+	}
+
+	if rt.modules[compiled.key] == compiled {
+		delete(rt.modules, compiled.key)
+	}
+
+	compiled.module.Close()
+	compiled.store.Close()
+}
+
+// removeEnvironment closes an environment (allowing its in-flight jobs to
+// complete) and then removes it from the Runtime's environments map
+func (rt *Runtime) removeEnvironment(env *wasmEnvironment) {
+	env.close()
+
+	rt.envLock.Lock()
+	defer rt.envLock.Unlock()
+
+	delete(rt.environments, env.UUID)
+}
+
+// newEnvironment creates a new environment and adds it to the Runtime's environments map
+// such that Wasm instances can return data to the correct place
+func (rt *Runtime) newEnvironment(ref *bundle.WasmModuleRef, opts runnerOpts) *wasmEnvironment {
+	rt.envLock.Lock()
+	defer rt.envLock.Unlock()
+
+	e := newEnvironment(rt, ref, opts)
+
+	rt.environments[e.UUID] = e
+
+	return e
+}
+
+func (rt *Runtime) setupNewIdentifier(envUUID string, inst *wasmInstance) (int32, error) {
+	for {
+		ident, err := randomIdentifier()
+		if err != nil {
+			return -1, errors.Wrap(err, "failed to randomIdentifier")
+		}
+
+		ref := instanceReference{
+			EnvUUID: envUUID,
+			Inst:    inst,
+		}
+
+		// ensure we don't accidentally overwrite something else
+		// (however unlikely that may be)
+		if _, exists := rt.instanceMapper.LoadOrStore(ident, ref); exists {
+			continue
+		}
+
+		return ident, nil
+	}
+}
+
+func (rt *Runtime) removeIdentifier(ident int32) {
+	rt.instanceMapper.Delete(ident)
+}
+
+func (rt *Runtime) instanceForIdentifier(ident int32) (*wasmInstance, error) {
+	rawRef, exists := rt.instanceMapper.Load(ident)
+	if !exists {
+		return nil, errors.New("instance does not exist")
+	}
+
+	ref := rawRef.(instanceReference)
+
+	rt.envLock.RLock()
+	defer rt.envLock.RUnlock()
+
+	if _, exists := rt.environments[ref.EnvUUID]; !exists {
+		return nil, errors.New("environment does not exist")
+	}
+
+	return ref.Inst, nil
+}
+
+func randomIdentifier() (int32, error) {
+	// generate a random number between 0 and the largest possible int32
+	num, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to rand.Int")
+	}
+
+	return int32(num.Int64()), nil
+}
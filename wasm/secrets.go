@@ -0,0 +1,131 @@
+package wasm
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/suborbital/hive-wasm/secrets"
+)
+
+// redactedSecret replaces the value of a secret in the messages a Runnable logs
+const redactedSecret = "[REDACTED]"
+
+// Secrets sets the Provider of the secrets that the Runnable can access with get_secret.
+// It is typically set for every Runnable with DefaultRunnerOptions
+func Secrets(provider secrets.Provider) RunnerOption {
+	return func(opts *runnerOpts) {
+		opts.secretProvider = provider
+	}
+}
+
+// SecretAccess permits the Runnable to access the named secrets with get_secret. A Runnable
+// cannot access any secrets unless they are named, and Runnables loaded from a bundle
+// can access the secrets listed for them in the Directive
+func SecretAccess(names ...string) RunnerOption {
+	return func(opts *runnerOpts) {
+		for _, name := range names {
+			opts.secretAccess[name] = true
+		}
+	}
+}
+
+// secretAudit is the scope of the log line written when a Runnable is denied access to a secret
+type secretAudit struct {
+	Runnable  string `json:"runnable"`
+	RequestID string `json:"request_id,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+// redactor removes the values of the secrets that a Runtime's Runnables can access from the messages they log. It is
+// shared by every environment, since a secret accessed by one Runnable could be passed to and logged by another
+type redactor struct {
+	// secrets holds the current value of each secret, so that a rotated secret's old value is replaced
+	secrets map[redactorKey]string
+
+	// vals are the values of secrets sorted longest first, so that a secret containing another is redacted whole
+	vals []string
+	lock sync.RWMutex
+}
+
+// redactorKey identifies a secret by its name and the Provider it came from, since
+// different Runnables can be given different Providers that use the same names
+type redactorKey struct {
+	provider interface{}
+	name     string
+}
+
+// seed sets the current values of the named secrets from provider, so that they are redacted
+// before any Runnable has accessed them. Secrets that cannot be read are skipped
+func (r *redactor) seed(provider secrets.Provider, names map[string]bool) {
+	for name := range names {
+		val, err := provider.Secret(name)
+		if err != nil {
+			continue
+		}
+
+		r.set(provider, name, string(val))
+	}
+}
+
+// set sets the value of the named secret from provider to be redacted, replacing its previous value
+func (r *redactor) set(provider secrets.Provider, name, val string) {
+	// providers that can't be used as map keys (which is unusual, since they are typically
+	// pointers) share their names, in the same way as the caches in cacheOps
+	var providerKey interface{} = provider
+	if !reflect.TypeOf(provider).Comparable() {
+		providerKey = nil
+	}
+
+	key := redactorKey{provider: providerKey, name: name}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.secrets == nil {
+		r.secrets = map[redactorKey]string{}
+	}
+
+	if existing, exists := r.secrets[key]; exists && existing == val {
+		return
+	}
+
+	if val == "" {
+		delete(r.secrets, key)
+	} else {
+		r.secrets[key] = val
+	}
+
+	unique := map[string]bool{}
+	vals := []string{}
+
+	for _, v := range r.secrets {
+		if !unique[v] {
+			unique[v] = true
+			vals = append(vals, v)
+		}
+	}
+
+	sort.Slice(vals, func(i, j int) bool {
+		if len(vals[i]) != len(vals[j]) {
+			return len(vals[i]) > len(vals[j])
+		}
+
+		return vals[i] < vals[j]
+	})
+
+	r.vals = vals
+}
+
+// redact replaces each secret value in msg
+func (r *redactor) redact(msg string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, val := range r.vals {
+		msg = strings.ReplaceAll(msg, val, redactedSecret)
+	}
+
+	return msg
+}
@@ -0,0 +1,37 @@
+;; badptr is a Runnable that passes out-of-bounds pointers to host functions, returning its
+;; input only if the host rejected them with the memory access error code (-5), used to test
+;; FFI bounds checking (it is written in WAT because well-behaved SDKs cannot produce bad pointers)
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "log_msg" (func $log_msg (param i32 i32 i32 i32)))
+  (import "env" "cache_get" (func $cache_get (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    ;; log_msg has no return value, it must simply not crash the host
+    (call $log_msg (i32.const 0x7ffffff0) (i32.const 64) (i32.const 3) (local.get $ident))
+
+    ;; a key pointer beyond the end of memory
+    (if (i32.ne (call $cache_get (i32.const 0x7ffffff0) (i32.const 16) (i32.const 0) (i32.const 16) (local.get $ident)) (i32.const -5))
+      (then unreachable))
+
+    ;; a negative size
+    (if (i32.ne (call $cache_get (i32.const 0) (i32.const -1) (i32.const 0) (i32.const 16) (local.get $ident)) (i32.const -5))
+      (then unreachable))
+
+    (call $return_result (local.get $ptr) (local.get $size) (local.get $ident)))
+)
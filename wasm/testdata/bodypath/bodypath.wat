@@ -0,0 +1,45 @@
+;; bodypath is a Runnable that returns the value in the request body at the path given in its X-Path header, used
+;; to test body path lookups. If getting the header or the value fails, it returns the value returned by
+;; request_get_field as 4 little-endian bytes
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "request_get_field" (func $request_get_field (param i32 i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 512) "X-Path")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $ret i32)
+
+    ;; the path is read into 1024 (field type 2 is a header)
+    (local.set $ret (call $request_get_field (i32.const 2) (i32.const 512) (i32.const 6) (i32.const 1024) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 256) (local.get $ret))
+        (call $return_result (i32.const 256) (i32.const 4) (local.get $ident))
+        (return)))
+
+    ;; and the value into 4096 (field type 5 is a body path)
+    (local.set $ret (call $request_get_field (i32.const 5) (i32.const 1024) (local.get $ret) (i32.const 4096) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 256) (local.get $ret))
+        (call $return_result (i32.const 256) (i32.const 4) (local.get $ident))
+        (return)))
+
+    (call $return_result (i32.const 4096) (local.get $ret) (local.get $ident)))
+)
@@ -0,0 +1,67 @@
+;; cache is a Runnable that exercises the cache host functions, trapping if any of them behaves
+;; unexpectedly, and returns the encoded list of keys beginning with "h"
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "cache_get" (func $cache_get (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "cache_delete" (func $cache_delete (param i32 i32 i32) (result i32)))
+  (import "env" "cache_exists" (func $cache_exists (param i32 i32 i32) (result i32)))
+  (import "env" "cache_incr" (func $cache_incr (param i32 i32 i64 i32 i32 i32) (result i32)))
+  (import "env" "cache_cas" (func $cache_cas (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "cache_keys" (func $cache_keys (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 256) "hits")
+  (data (i32.const 272) "lock")
+  (data (i32.const 288) "missing")
+  (data (i32.const 304) "held")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func $expect (param $actual i32) (param $expected i32)
+    (if (i32.ne (local.get $actual) (local.get $expected))
+      (then unreachable)))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $keysSize i32)
+
+    ;; hits = 0 + 5 - 2, with the result written at 512
+    (call $expect (call $cache_incr (i32.const 256) (i32.const 4) (i64.const 5) (i32.const 0) (i32.const 512) (local.get $ident)) (i32.const 0))
+    (call $expect (call $cache_incr (i32.const 256) (i32.const 4) (i64.const -2) (i32.const 0) (i32.const 512) (local.get $ident)) (i32.const 0))
+    (if (i64.ne (i64.load (i32.const 512)) (i64.const 3))
+      (then unreachable))
+
+    ;; lock can only be taken while it does not exist, then is swapped from "held" to "held"
+    (call $expect (call $cache_cas (i32.const 272) (i32.const 4) (i32.const 0) (i32.const -1) (i32.const 304) (i32.const 4) (i32.const 0) (local.get $ident)) (i32.const 1))
+    (call $expect (call $cache_cas (i32.const 272) (i32.const 4) (i32.const 0) (i32.const -1) (i32.const 304) (i32.const 4) (i32.const 0) (local.get $ident)) (i32.const 0))
+    (call $expect (call $cache_cas (i32.const 272) (i32.const 4) (i32.const 304) (i32.const 4) (i32.const 304) (i32.const 4) (i32.const 0) (local.get $ident)) (i32.const 1))
+
+    ;; incrementing a value that is not an integer fails
+    (call $expect (call $cache_incr (i32.const 272) (i32.const 4) (i64.const 1) (i32.const 0) (i32.const 512) (local.get $ident)) (i32.const -3))
+
+    ;; missing keys are reported as not found (-8)
+    (call $expect (call $cache_get (i32.const 288) (i32.const 7) (i32.const 1024) (i32.const 1024) (local.get $ident)) (i32.const -8))
+    (call $expect (call $cache_exists (i32.const 288) (i32.const 7) (local.get $ident)) (i32.const 0))
+    (call $expect (call $cache_exists (i32.const 256) (i32.const 4) (local.get $ident)) (i32.const 1))
+
+    (call $expect (call $cache_delete (i32.const 272) (i32.const 4) (local.get $ident)) (i32.const 0))
+    (call $expect (call $cache_delete (i32.const 272) (i32.const 4) (local.get $ident)) (i32.const -8))
+
+    ;; the keys are written at 1024
+    (local.set $keysSize (call $cache_keys (i32.const 256) (i32.const 1) (i32.const 1024) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $keysSize) (i32.const 0))
+      (then unreachable))
+
+    (call $return_result (i32.const 1024) (local.get $keysSize) (local.get $ident)))
+)
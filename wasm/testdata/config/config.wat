@@ -0,0 +1,34 @@
+;; config is a Runnable that returns the config value with the key it is given, or
+;; the value returned by get_config as 4 little-endian bytes if getting it fails
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "get_config" (func $get_config (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $ret i32)
+
+    ;; the value is written at 1024
+    (local.set $ret (call $get_config (local.get $ptr) (local.get $size) (i32.const 1024) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 256) (local.get $ret))
+        (call $return_result (i32.const 256) (i32.const 4) (local.get $ident))
+        (return)))
+
+    (call $return_result (i32.const 1024) (local.get $ret) (local.get $ident)))
+)
@@ -0,0 +1,27 @@
+;; egress is a Runnable that makes a GET request to the URL it is given and returns the
+;; value returned by fetch_url as 4 little-endian bytes, used to test egress policies
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "fetch_url" (func $fetch_url (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    ;; method 1 is GET, and the response body is written at 1024
+    (i32.store (i32.const 256) (call $fetch_url (i32.const 1) (local.get $ptr) (local.get $size) (i32.const 0) (i32.const 0) (i32.const 1024) (i32.const 1024) (local.get $ident)))
+
+    (call $return_result (i32.const 256) (i32.const 4) (local.get $ident)))
+)
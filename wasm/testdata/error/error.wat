@@ -0,0 +1,23 @@
+;; error is a Runnable that reports a failure with code 404, using its input as
+;; the error message, used to test Runnables returning errors with return_error
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_error" (func $return_error (param i32 i32 i32 i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (call $return_error (i32.const 404) (local.get $ptr) (local.get $size) (local.get $ident)))
+)
@@ -0,0 +1,35 @@
+;; fetchgrow is a Runnable that fetches the URL it is given into a buffer that is too small, and then
+;; again into one of the size returned, as the SDKs do, returning the response. Used to test that the
+;; response is buffered rather than fetched twice
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "fetch_url" (func $fetch_url (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $respSize i32)
+
+    ;; method 1 is GET, with a buffer of only 1 byte at 1024
+    (local.set $respSize (call $fetch_url (i32.const 1) (local.get $ptr) (local.get $size) (i32.const 0) (i32.const 0) (i32.const 1024) (i32.const 1) (local.get $ident)))
+    (if (i32.le_s (local.get $respSize) (i32.const 1))
+      (then unreachable))
+
+    (if (i32.ne (call $fetch_url (i32.const 1) (local.get $ptr) (local.get $size) (i32.const 0) (i32.const 0) (i32.const 1024) (local.get $respSize) (local.get $ident)) (local.get $respSize))
+      (then unreachable))
+
+    (call $return_result (i32.const 1024) (local.get $respSize) (local.get $ident)))
+)
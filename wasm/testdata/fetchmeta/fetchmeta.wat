@@ -0,0 +1,43 @@
+;; fetchmeta is a Runnable that makes a PUT request to the URL it is given and returns the value of the
+;; response's X-Test header, trapping if the response status is not 201. Used to test fetch_status and fetch_header
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "fetch_url" (func $fetch_url (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "fetch_status" (func $fetch_status (param i32) (result i32)))
+  (import "env" "fetch_header" (func $fetch_header (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 256) "x-test")
+  (data (i32.const 288) "body")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $headerSize i32)
+
+    ;; method 5 is PUT, and the response body is written at 1024
+    (if (i32.lt_s (call $fetch_url (i32.const 5) (local.get $ptr) (local.get $size) (i32.const 288) (i32.const 4) (i32.const 1024) (i32.const 1024) (local.get $ident)) (i32.const 0))
+      (then unreachable))
+
+    (if (i32.ne (call $fetch_status (local.get $ident)) (i32.const 201))
+      (then unreachable))
+
+    ;; the header value is written at 4096
+    (local.set $headerSize (call $fetch_header (i32.const 256) (i32.const 6) (i32.const 4096) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $headerSize) (i32.const 0))
+      (then unreachable))
+
+    (call $return_result (i32.const 4096) (local.get $headerSize) (local.get $ident)))
+)
@@ -0,0 +1,31 @@
+;; fetchrequest is a Runnable that passes the encoded request it is given to fetch_request
+;; and returns the response body, used to test the structured request encoding
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "fetch_request" (func $fetch_request (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $respSize i32)
+
+    ;; the response body is written at 1024
+    (local.set $respSize (call $fetch_request (local.get $ptr) (local.get $size) (i32.const 1024) (i32.const 4096) (local.get $ident)))
+    (if (i32.lt_s (local.get $respSize) (i32.const 0))
+      (then unreachable))
+
+    (call $return_result (i32.const 1024) (local.get $respSize) (local.get $ident)))
+)
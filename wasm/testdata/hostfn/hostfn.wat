@@ -0,0 +1,32 @@
+;; hostfn is a Runnable that calls the custom host function get_flag with its input as
+;; the flag name, and returns the flag's value, used to test custom host function registration
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "get_flag" (func $get_flag (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $len i32)
+
+    ;; the flag value is written into a 64 byte buffer at offset 512
+    (local.set $len (call $get_flag (local.get $ptr) (local.get $size) (i32.const 512) (i32.const 64) (local.get $ident)))
+
+    (if (i32.lt_s (local.get $len) (i32.const 0))
+      (then unreachable))
+
+    (call $return_result (i32.const 512) (local.get $len) (local.get $ident)))
+)
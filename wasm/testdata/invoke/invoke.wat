@@ -0,0 +1,40 @@
+;; invoke is a Runnable that invokes the function named by its input, passing it the same input, and returns its output.
+;; It first offers a 16 byte buffer, making the call again if the output is larger. If invoking the function fails, it
+;; returns the value returned by invoke_fn as 4 little-endian bytes
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "invoke_fn" (func $invoke_fn (param i32 i32 i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $ret i32)
+
+    ;; the output is written at 1024
+    (local.set $ret (call $invoke_fn (local.get $ptr) (local.get $size) (local.get $ptr) (local.get $size) (i32.const 1024) (i32.const 16) (local.get $ident)))
+
+    (if (i32.gt_s (local.get $ret) (i32.const 16))
+      (then
+        (local.set $ret (call $invoke_fn (local.get $ptr) (local.get $size) (local.get $ptr) (local.get $size) (i32.const 1024) (local.get $ret) (local.get $ident)))))
+
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 256) (local.get $ret))
+        (call $return_result (i32.const 256) (i32.const 4) (local.get $ident))
+        (return)))
+
+    (call $return_result (i32.const 1024) (local.get $ret) (local.get $ident)))
+)
@@ -0,0 +1,60 @@
+;; kv is a Runnable that stores its input at "greeting" with the kv host functions, trapping if any of them behaves
+;; unexpectedly, and returns the encoded list of its keys. If storing the input fails, it returns the value returned
+;; by kv_put as 4 little-endian bytes instead
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "kv_get" (func $kv_get (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "kv_put" (func $kv_put (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "kv_delete" (func $kv_delete (param i32 i32 i32) (result i32)))
+  (import "env" "kv_scan" (func $kv_scan (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 256) "greeting")
+  (data (i32.const 272) "temp")
+  (data (i32.const 288) "missing")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func $expect (param $actual i32) (param $expected i32)
+    (if (i32.ne (local.get $actual) (local.get $expected))
+      (then unreachable)))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $ret i32)
+
+    (local.set $ret (call $kv_put (i32.const 256) (i32.const 8) (local.get $ptr) (local.get $size) (local.get $ident)))
+    (if (i32.ne (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 512) (local.get $ret))
+        (call $return_result (i32.const 512) (i32.const 4) (local.get $ident))
+        (return)))
+
+    ;; the value stored is read back into 1024
+    (call $expect (call $kv_get (i32.const 256) (i32.const 8) (i32.const 1024) (i32.const 1024) (local.get $ident)) (local.get $size))
+
+    (call $expect (call $kv_put (i32.const 272) (i32.const 4) (i32.const 272) (i32.const 4) (local.get $ident)) (i32.const 0))
+    (call $expect (call $kv_delete (i32.const 272) (i32.const 4) (local.get $ident)) (i32.const 0))
+
+    ;; missing keys are reported as not found (-8)
+    (call $expect (call $kv_delete (i32.const 272) (i32.const 4) (local.get $ident)) (i32.const -8))
+    (call $expect (call $kv_get (i32.const 288) (i32.const 7) (i32.const 1024) (i32.const 1024) (local.get $ident)) (i32.const -8))
+
+    ;; the keys are written at 2048
+    (local.set $ret (call $kv_scan (i32.const 0) (i32.const 0) (i32.const 2048) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then unreachable))
+
+    (call $return_result (i32.const 2048) (local.get $ret) (local.get $ident)))
+)
@@ -0,0 +1,28 @@
+;; loop is a Runnable that busy-loops for a long time before returning its input,
+;; used to test execution timeouts (it is written in WAT to keep its behaviour exact)
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $count i32)
+    (local.set $count (i32.const 0x7fffffff))
+    (loop $spin
+      (local.set $count (i32.sub (local.get $count) (i32.const 1)))
+      (br_if $spin (i32.gt_s (local.get $count) (i32.const 0))))
+    (call $return_result (local.get $ptr) (local.get $size) (local.get $ident)))
+)
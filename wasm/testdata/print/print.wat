@@ -0,0 +1,37 @@
+;; print is a Runnable that writes its input to WASI stdout and a fixed line to stderr,
+;; and then returns its input, used to test capturing the output of each execution
+(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 256) "\n")
+  (data (i32.const 512) "something went wrong\n")
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    ;; two iovecs at offset 16 (the input followed by a newline) written to stdout (fd 1)
+    (i32.store (i32.const 16) (local.get $ptr))
+    (i32.store (i32.const 20) (local.get $size))
+    (i32.store (i32.const 24) (i32.const 256))
+    (i32.store (i32.const 28) (i32.const 1))
+    (drop (call $fd_write (i32.const 1) (i32.const 16) (i32.const 2) (i32.const 8)))
+
+    ;; one iovec at offset 32 written to stderr (fd 2)
+    (i32.store (i32.const 32) (i32.const 512))
+    (i32.store (i32.const 36) (i32.const 21))
+    (drop (call $fd_write (i32.const 2) (i32.const 32) (i32.const 1) (i32.const 8)))
+
+    (call $return_result (local.get $ptr) (local.get $size) (local.get $ident)))
+)
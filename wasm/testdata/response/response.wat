@@ -0,0 +1,45 @@
+;; response is a Runnable that redirects requests to /login by setting the response
+;; status and Location header and adding two session cookies, used to test the response host functions
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "response_set_status" (func $response_set_status (param i32 i32) (result i32)))
+  (import "env" "response_set_header" (func $response_set_header (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "response_add_header" (func $response_add_header (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 256) "Location")
+  (data (i32.const 288) "/login")
+  (data (i32.const 320) "redirecting")
+  (data (i32.const 352) "Set-Cookie")
+  (data (i32.const 384) "session=1")
+  (data (i32.const 416) "theme=dark")
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (if (call $response_set_status (i32.const 302) (local.get $ident))
+      (then unreachable))
+
+    (if (call $response_set_header (i32.const 256) (i32.const 8) (i32.const 288) (i32.const 6) (local.get $ident))
+      (then unreachable))
+
+    (if (call $response_add_header (i32.const 352) (i32.const 10) (i32.const 384) (i32.const 9) (local.get $ident))
+      (then unreachable))
+
+    (if (call $response_add_header (i32.const 352) (i32.const 10) (i32.const 416) (i32.const 10) (local.get $ident))
+      (then unreachable))
+
+    (call $return_result (i32.const 320) (i32.const 11) (local.get $ident)))
+)
@@ -0,0 +1,40 @@
+;; secret is a Runnable that gets the secret named by its input, logs "secret: " followed by its value, and
+;; returns the value. If getting the secret fails, it returns the value returned by get_secret as 4 little-endian bytes
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "log_msg" (func $log_msg (param i32 i32 i32 i32)))
+  (import "env" "get_secret" (func $get_secret (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  ;; the prefix immediately precedes the secret's value, which is written at 1024
+  (data (i32.const 1016) "secret: ")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $ret i32)
+
+    (local.set $ret (call $get_secret (local.get $ptr) (local.get $size) (i32.const 1024) (i32.const 1024) (local.get $ident)))
+    (if (i32.lt_s (local.get $ret) (i32.const 0))
+      (then
+        (i32.store (i32.const 256) (local.get $ret))
+        (call $return_result (i32.const 256) (i32.const 4) (local.get $ident))
+        (return)))
+
+    ;; log at info level (3)
+    (call $log_msg (i32.const 1016) (i32.add (local.get $ret) (i32.const 8)) (i32.const 3) (local.get $ident))
+
+    (call $return_result (i32.const 1024) (local.get $ret) (local.get $ident)))
+)
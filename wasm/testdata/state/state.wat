@@ -0,0 +1,32 @@
+;; state is a Runnable that sets the state key "greeting" to "hello" and deletes the key "old", used to test
+;; the state host functions. It returns the values returned by state_set and state_delete as 4 little-endian bytes each
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "state_set" (func $state_set (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "state_delete" (func $state_delete (param i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 512) "greeting")
+  (data (i32.const 544) "hello")
+  (data (i32.const 576) "old")
+
+  (global $next (mut i32) (i32.const 8192))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (i32.store (i32.const 256) (call $state_set (i32.const 512) (i32.const 8) (i32.const 544) (i32.const 5) (local.get $ident)))
+    (i32.store (i32.const 260) (call $state_delete (i32.const 576) (i32.const 3) (local.get $ident)))
+
+    (call $return_result (i32.const 256) (i32.const 8) (local.get $ident)))
+)
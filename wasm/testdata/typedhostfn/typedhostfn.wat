@@ -0,0 +1,37 @@
+;; typedhostfn is a Runnable that calls the custom host function add_mixed, which takes and returns
+;; an i64 and an f64, and returns its input only if the host returned the expected values, used to
+;; test host functions with non-i32 and multi-value signatures
+(module
+  ;; hive-wasm expects Runnables to be WASI modules
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+  (import "env" "add_mixed" (func $add_mixed (param i64 f64 i32) (result i64 f64)))
+
+  (memory (export "memory") 1)
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $f f64)
+
+    ;; 2^40 does not fit in an i32, so it must be passed as a full i64
+    (call $add_mixed (i64.const 1099511627776) (f64.const 0.5) (local.get $ident))
+
+    (local.set $f)
+    (if (f64.ne (local.get $f) (f64.const 2.5))
+      (then unreachable))
+
+    (if (i64.ne (i64.const 1099511627778))
+      (then unreachable))
+
+    (call $return_result (local.get $ptr) (local.get $size) (local.get $ident)))
+)
@@ -0,0 +1,66 @@
+;; wasi is a Runnable that returns its WASI environment variables and arguments, followed by the
+;; contents of the file named by its input within the first preopened directory, each separated by
+;; '|'. It also attempts to create a file in that directory, used to test WASI configuration
+(module
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $environ_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $environ_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_get" (func $args_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "path_open" (func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 512) "written.txt")
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    (local $pos i32)
+
+    ;; the result is built up starting at offset 8192, with $pos tracking its end.
+    ;; sizes are written at offset 0 and 4, pointer arrays at offset 64
+    (local.set $pos (i32.const 8192))
+
+    (if (call $environ_sizes_get (i32.const 0) (i32.const 4))
+      (then unreachable))
+    (if (call $environ_get (i32.const 64) (local.get $pos))
+      (then unreachable))
+    (local.set $pos (i32.add (local.get $pos) (i32.load (i32.const 4))))
+    (i32.store8 (local.get $pos) (i32.const 124))
+    (local.set $pos (i32.add (local.get $pos) (i32.const 1)))
+
+    (if (call $args_sizes_get (i32.const 0) (i32.const 4))
+      (then unreachable))
+    (if (call $args_get (i32.const 64) (local.get $pos))
+      (then unreachable))
+    (local.set $pos (i32.add (local.get $pos) (i32.load (i32.const 4))))
+    (i32.store8 (local.get $pos) (i32.const 124))
+    (local.set $pos (i32.add (local.get $pos) (i32.const 1)))
+
+    ;; open the file named by the input in fd 4 (wasmer reserves fd 3 for its root, so this is the first preopen) with the fd_read right, placing the new fd at offset 8
+    (if (call $path_open (i32.const 4) (i32.const 0) (local.get $ptr) (local.get $size) (i32.const 0) (i64.const 2) (i64.const 0) (i32.const 0) (i32.const 8))
+      (then unreachable))
+
+    ;; a single iovec at offset 16 pointing at the end of the result, with the number of bytes read written at offset 12
+    (i32.store (i32.const 16) (local.get $pos))
+    (i32.store (i32.const 20) (i32.const 1024))
+    (if (call $fd_read (i32.load (i32.const 8)) (i32.const 16) (i32.const 1) (i32.const 12))
+      (then unreachable))
+    (local.set $pos (i32.add (local.get $pos) (i32.load (i32.const 12))))
+
+    ;; attempt to create written.txt in the same directory with the fd_write right, ignoring whether it succeeds
+    (drop (call $path_open (i32.const 4) (i32.const 0) (i32.const 512) (i32.const 11) (i32.const 1) (i64.const 64) (i64.const 0) (i32.const 0) (i32.const 8)))
+
+    (call $return_result (i32.const 8192) (i32.sub (local.get $pos) (i32.const 8192)) (local.get $ident)))
+)
@@ -0,0 +1,45 @@
+;; wasiwrite is a Runnable that returns the contents of the file named by its input within the first preopened
+;; directory, and then overwrites the file, used to test that writes to preopened directories do not persist
+(module
+  (import "wasi_snapshot_preview1" "path_open" (func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "env" "return_result" (func $return_result (param i32 i32 i32)))
+
+  (memory (export "memory") 1)
+
+  (data (i32.const 512) "overwritten")
+
+  (global $next (mut i32) (i32.const 1024))
+
+  ;; a bump allocator is sufficient for the short lifetime of a test
+  (func (export "allocate") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "deallocate") (param i32 i32))
+
+  (func (export "run_e") (param $ptr i32) (param $size i32) (param $ident i32)
+    ;; open the file named by the input in fd 4 (the first preopen) with the fd_read right, placing the new fd at offset 8
+    (if (call $path_open (i32.const 4) (i32.const 0) (local.get $ptr) (local.get $size) (i32.const 0) (i64.const 2) (i64.const 0) (i32.const 0) (i32.const 8))
+      (then unreachable))
+
+    ;; a single iovec at offset 16 pointing at offset 8192, with the number of bytes read written at offset 12
+    (i32.store (i32.const 16) (i32.const 8192))
+    (i32.store (i32.const 20) (i32.const 1024))
+    (if (call $fd_read (i32.load (i32.const 8)) (i32.const 16) (i32.const 1) (i32.const 12))
+      (then unreachable))
+
+    ;; open the file again, truncated (oflags 8) with the fd_write right, and overwrite it
+    (if (call $path_open (i32.const 4) (i32.const 0) (local.get $ptr) (local.get $size) (i32.const 8) (i64.const 64) (i64.const 0) (i32.const 0) (i32.const 8))
+      (then unreachable))
+
+    (i32.store (i32.const 32) (i32.const 512))
+    (i32.store (i32.const 36) (i32.const 11))
+    (if (call $fd_write (i32.load (i32.const 8)) (i32.const 32) (i32.const 1) (i32.const 40))
+      (then unreachable))
+
+    (call $return_result (i32.const 8192) (i32.load (i32.const 12)) (local.get $ident)))
+)
@@ -0,0 +1,247 @@
+package wasm
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// wasiEnvironment builds the WASI environment for a Runnable from its options, mapping each of its
+// directories to the instance's copy of it (created by copySnapshots) at the same index in dirs
+func wasiEnvironment(programName string, opts runnerOpts, dirs []string) (*wasmer.WasiEnvironment, error) {
+	builder := wasmer.NewWasiStateBuilder(programName)
+
+	if opts.outputMode == OutputInherit {
+		builder.InheritStdout().InheritStderr()
+	} else {
+		builder.CaptureStdout().CaptureStderr()
+	}
+
+	for _, arg := range opts.wasiArgs {
+		builder.Argument(arg)
+	}
+
+	// sorted so that the environment is the same every time it's built
+	keys := make([]string, 0, len(opts.wasiEnv))
+	for k := range opts.wasiEnv {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		builder.Environment(k, opts.wasiEnv[k])
+	}
+
+	for i, dir := range opts.wasiDirs {
+		builder.MapDirectory(dir.guestPath, dirs[i])
+	}
+
+	env, err := builder.Finalize()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to NewWasiStateBuilder.Finalize")
+	}
+
+	return env, nil
+}
+
+// resolveWithin resolves dirPath (a relative path, or an absolute one treated as relative) within root, returning
+// an error if it would be outside of root once symlinks are followed, or if it is not a directory
+func resolveWithin(root, dirPath string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to EvalSymlinks for root")
+	}
+
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to Abs")
+	}
+
+	// cleaning the path as if it were absolute removes any ../ that would escape the root
+	joined := filepath.Join(realRoot, filepath.FromSlash(path.Clean("/"+dirPath)))
+
+	resolved, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to EvalSymlinks")
+	}
+
+	if resolved != realRoot && !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+		return "", errors.Errorf("%s is outside of the root", dirPath)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to Stat")
+	} else if !info.IsDir() {
+		return "", errors.Errorf("%s is not a directory", dirPath)
+	}
+
+	return resolved, nil
+}
+
+// snapshotDirs creates a snapshot of each directory, returning the
+// temporary directories that hold them in the same order as dirs
+func snapshotDirs(dirs []wasiDir) ([]string, error) {
+	snapshots := []string{}
+
+	for _, dir := range dirs {
+		snapshot, err := snapshotDir(dir)
+		if err != nil {
+			removeSnapshots(snapshots)
+			return nil, errors.Wrapf(err, "failed to snapshotDir for %s", dir.guestPath)
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// snapshotDir copies the contents of a wasiDir into a new temporary directory. The snapshot is never preopened
+// itself, each instance is given its own copy of it (see copySnapshots) so that the original is never modified
+func snapshotDir(dir wasiDir) (string, error) {
+	snapshot, err := ioutil.TempDir("", "hive-wasm-dir-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to TempDir")
+	}
+
+	if dir.files != nil {
+		err = writeFiles(snapshot, dir.files)
+	} else {
+		err = copyDir(dir.hostPath, snapshot)
+	}
+
+	if err != nil {
+		removeSnapshots([]string{snapshot})
+		return "", err
+	}
+
+	return snapshot, nil
+}
+
+// copySnapshots copies each snapshot into a new temporary directory for an instance to preopen. WASI in wasmer cannot
+// preopen a directory as read-only (and file permissions do not restrict a process running as root), so the copies
+// are writable, and are restored with restoreSnapshots after each execution so that writes never outlast it
+func copySnapshots(snapshots []string) ([]string, error) {
+	dirs := []string{}
+
+	for _, snapshot := range snapshots {
+		dir, err := ioutil.TempDir("", "hive-wasm-dir-")
+		if err != nil {
+			removeSnapshots(dirs)
+			return nil, errors.Wrap(err, "failed to TempDir")
+		}
+
+		dirs = append(dirs, dir)
+
+		if err := copyDir(snapshot, dir); err != nil {
+			removeSnapshots(dirs)
+			return nil, errors.Wrapf(err, "failed to copyDir for %s", snapshot)
+		}
+	}
+
+	return dirs, nil
+}
+
+// restoreSnapshots replaces the contents of each of an instance's directories with the snapshot it was copied from
+func restoreSnapshots(snapshots, dirs []string) error {
+	for i, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "failed to RemoveAll for %s", dir)
+		}
+
+		if err := copyDir(snapshots[i], dir); err != nil {
+			return errors.Wrapf(err, "failed to copyDir for %s", snapshots[i])
+		}
+	}
+
+	return nil
+}
+
+// writeFiles writes files (keyed by their relative path) into dest
+func writeFiles(dest string, files map[string][]byte) error {
+	for name, contents := range files {
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		// filepath.Join cleans the path, so this ensures ../ cannot escape dest
+		if !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+			return errors.Errorf("file %s is outside of its directory", name)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return errors.Wrap(err, "failed to MkdirAll")
+		}
+
+		if err := ioutil.WriteFile(target, contents, 0600); err != nil {
+			return errors.Wrapf(err, "failed to WriteFile for %s", name)
+		}
+	}
+
+	return nil
+}
+
+// copyDir recursively copies the directories and regular files within src into dest
+func copyDir(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrap(err, "failed to Rel")
+		}
+
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		} else if !info.Mode().IsRegular() {
+			// symlinks and other special files could be used to escape the directory
+			return nil
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to Open")
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to OpenFile")
+	}
+
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Wrap(err, "failed to Copy")
+	}
+
+	return nil
+}
+
+// removeSnapshots removes snapshot directories (or an instance's copies of them)
+func removeSnapshots(snapshots []string) error {
+	for _, snapshot := range snapshots {
+		if err := os.RemoveAll(snapshot); err != nil {
+			return errors.Wrapf(err, "failed to RemoveAll for %s", snapshot)
+		}
+	}
+
+	return nil
+}
@@ -1,15 +1,34 @@
 package wasm
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/suborbital/hive-wasm/bundle"
+	"github.com/suborbital/hive-wasm/directive"
+	"github.com/suborbital/hive-wasm/kv"
 	"github.com/suborbital/hive-wasm/request"
+	"github.com/suborbital/hive-wasm/secrets"
 	"github.com/suborbital/hive/hive"
 	"github.com/suborbital/vektor/vlog"
+	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
 type testBody struct {
@@ -477,3 +496,1841 @@ func TestWasmCacheGetSetSwiftToRust(t *testing.T) {
 		t.Error(fmt.Errorf("did not get expected output"))
 	}
 }
+
+func TestWasmRunnerTimeout(t *testing.T) {
+	h := hive.New()
+
+	runner := NewRunner("./testdata/loop/loop.wat", Timeout(time.Millisecond*50))
+	doWasm := h.Handle("wasm", runner)
+
+	for i := 0; i < 2; i++ {
+		_, err := doWasm("hello").Then()
+		if err == nil {
+			t.Error("expected timeout error, got none")
+			return
+		}
+
+		if !errors.Is(err, ErrRunnableTimeout) {
+			t.Errorf("expected ErrRunnableTimeout, got %s", err)
+		}
+	}
+
+	// the timed out instances should be replaced in the pool
+	<-time.After(time.Millisecond * 100)
+
+	runner.env.lock.Lock()
+	defer runner.env.lock.Unlock()
+
+	if len(runner.env.instances) != 1 {
+		t.Errorf("expected 1 instance in pool, got %d", len(runner.env.instances))
+	}
+}
+
+func TestWasmRunnerMemoryLimit(t *testing.T) {
+	h := hive.New()
+
+	runner := NewRunner("./testdata/grow/grow.wat", MaxMemoryPages(24))
+	doWasm := h.Handle("wasm", runner)
+
+	// the first run grows the instance to 17 pages, which is within the limit
+	res, err := doWasm("hello").Then()
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Then"))
+		return
+	}
+
+	if string(res.([]byte)) != "hello" {
+		t.Errorf("expected 'hello', got %q", string(res.([]byte)))
+	}
+
+	// the second run grows it to 33 pages, exceeding the limit
+	if _, err := doWasm("hello").Then(); !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("expected ErrMemoryLimitExceeded, got %v", err)
+		return
+	}
+
+	// and the instance should have been replaced with a fresh one
+	if _, err := doWasm("hello").Then(); err != nil {
+		t.Error(errors.Wrap(err, "expected replaced instance to succeed"))
+	}
+}
+
+func TestWasmRunnerTrap(t *testing.T) {
+	h := hive.New()
+
+	runner := NewRunner("./testdata/trap/trap.wat")
+	doWasm := h.Handle("wasm", runner)
+
+	// warm up the pool
+	if _, err := doWasm("hello").Then(); err != nil {
+		t.Error(errors.Wrap(err, "failed to Then"))
+		return
+	}
+
+	runner.env.lock.Lock()
+	trappedInst := runner.env.instances[0]
+	runner.env.lock.Unlock()
+
+	_, err := doWasm("").Then()
+
+	var trapErr *TrapError
+	if !errors.As(err, &trapErr) {
+		t.Errorf("expected TrapError, got %v", err)
+		return
+	}
+
+	if !strings.Contains(trapErr.Message, "unreachable") {
+		t.Errorf("expected trap message to mention 'unreachable', got %q", trapErr.Message)
+	}
+
+	// the trapped instance should have been replaced, and the replacement should work
+	res, err := doWasm("hello again").Then()
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Then after trap"))
+		return
+	}
+
+	if string(res.([]byte)) != "hello again" {
+		t.Errorf("expected 'hello again', got %q", string(res.([]byte)))
+	}
+
+	runner.env.lock.Lock()
+	defer runner.env.lock.Unlock()
+
+	for _, inst := range runner.env.instances {
+		if inst == trappedInst {
+			t.Error("trapped instance is still in the pool")
+		}
+	}
+}
+
+func TestWasmRunnerBadPointers(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/badptr/badptr.wat"))
+
+	res, err := doWasm("still alive").Then()
+	if err != nil {
+		t.Error(errors.Wrap(err, "failed to Then"))
+		return
+	}
+
+	if string(res.([]byte)) != "still alive" {
+		t.Errorf("expected 'still alive', got %q", string(res.([]byte)))
+	}
+}
+
+func TestRuntimeIsolation(t *testing.T) {
+	rt1 := NewRuntime()
+	rt2 := NewRuntime()
+
+	h := hive.New()
+
+	doWasm1 := h.Handle("wasm1", rt1.NewRunner("./testdata/hello-echo/hello-echo.wasm"))
+	doWasm2 := h.Handle("wasm2", rt2.NewRunner("./testdata/hello-echo/hello-echo.wasm"))
+
+	for _, do := range []hive.JobFunc{doWasm1, doWasm2} {
+		res, err := do("runtime").Then()
+		if err != nil {
+			t.Error(errors.Wrap(err, "failed to Then"))
+			return
+		}
+
+		if string(res.([]byte)) != "hello runtime" {
+			t.Errorf("expected 'hello runtime', got %q", string(res.([]byte)))
+		}
+	}
+
+	rt1.Close()
+
+	if len(rt1.environments) != 0 {
+		t.Errorf("expected closed runtime to have 0 environments, got %d", len(rt1.environments))
+	}
+
+	if _, err := doWasm1("runtime").Then(); err == nil {
+		t.Error("expected job on closed runtime to fail")
+	}
+
+	// the other runtime should be unaffected
+	if _, err := doWasm2("runtime").Then(); err != nil {
+		t.Error(errors.Wrap(err, "failed to Then on open runtime"))
+	}
+}
+
+func TestWasmBundleReload(t *testing.T) {
+	rt := NewRuntime()
+	defer rt.Close()
+
+	h := hive.New()
+
+	b := &bundle.Bundle{
+		Directive: &directive.Directive{
+			Identifier:  "com.suborbital.test",
+			AppVersion:  "v0.0.1",
+			AtmoVersion: "v0.0.6",
+			Runnables: []directive.Runnable{
+				{
+					Name:      "hello-echo",
+					Namespace: directive.NamespaceDefault,
+				},
+			},
+		},
+		Runnables: []bundle.WasmModuleRef{
+			{
+				Filepath: "./testdata/hello-echo/hello-echo.wasm",
+				Name:     "hello-echo.wasm",
+			},
+		},
+	}
+
+	load := func() {
+		if err := rt.HandleBundle(h, b); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to HandleBundle"))
+		}
+
+		res, err := h.Do(hive.NewJob("hello-echo", "reload")).Then()
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to Then"))
+		}
+
+		if string(res.([]byte)) != "hello reload" {
+			t.Fatalf("expected 'hello reload', got %q", string(res.([]byte)))
+		}
+	}
+
+	// warm up before measuring, so that one-time allocations aren't counted
+	for i := 0; i < 5; i++ {
+		load()
+	}
+
+	before := residentMemory()
+
+	for i := 0; i < 30; i++ {
+		load()
+	}
+
+	if len(rt.environments) != 1 {
+		t.Errorf("expected 1 environment after reloading, got %d", len(rt.environments))
+	}
+
+	after := residentMemory()
+
+	// compiling hello-echo takes several MB, so 30 reloads
+	// would take far more than this if each were compiled again
+	if before > 0 && after-before > 32<<20 {
+		t.Errorf("resident memory grew by %d bytes after reloading bundle", after-before)
+	}
+
+	rt.moduleLock.Lock()
+	var old *compiledModule
+	for _, compiled := range rt.modules {
+		old = compiled
+	}
+	rt.moduleLock.Unlock()
+
+	if old == nil {
+		t.Fatal("expected the Runtime to hold the compiled module")
+	}
+
+	// reloading the bundle with a different module releases the old one
+	b.Runnables[0] = bundle.WasmModuleRef{
+		Filepath: "./testdata/print/print.wat",
+		Name:     "hello-echo.wasm",
+	}
+
+	if err := rt.HandleBundle(h, b); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to HandleBundle with a different module"))
+	}
+
+	res, err := h.Do(hive.NewJob("hello-echo", "reload")).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then with a different module"))
+	}
+
+	if string(res.([]byte)) != "reload" {
+		t.Errorf("expected 'reload' from the new module, got %q", string(res.([]byte)))
+	}
+
+	rt.moduleLock.Lock()
+	defer rt.moduleLock.Unlock()
+
+	if len(rt.modules) != 1 {
+		t.Errorf("expected 1 compiled module after reloading with a different module, got %d", len(rt.modules))
+	}
+
+	if _, exists := rt.modules[old.key]; exists || old.refs != 0 {
+		t.Errorf("expected the old module to be released, it has %d references", old.refs)
+	}
+}
+
+// residentMemory returns the resident set size of the process, or 0 if it is unavailable
+func residentMemory() int64 {
+	runtime.GC()
+
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return pages * int64(os.Getpagesize())
+}
+
+func TestRuntimeCustomHostFn(t *testing.T) {
+	flags := map[string]string{
+		"new-ui": "enabled",
+	}
+
+	getFlag := NewHostFn("get_flag", i32Args(4), i32Args(1), func(ctx *HostCtx, args ...wasmer.Value) (interface{}, error) {
+		name, err := ctx.ReadMemory(args[0].I32(), args[1].I32())
+		if err != nil {
+			return int32(-1), nil
+		}
+
+		if ctx.HiveCtx() == nil {
+			return nil, errors.New("missing hive Ctx")
+		}
+
+		val := []byte(flags[string(name)])
+		if len(val) > int(args[3].I32()) {
+			return int32(-1), nil
+		}
+
+		if err := ctx.WriteMemoryAtLocation(args[2].I32(), val); err != nil {
+			return int32(-1), nil
+		}
+
+		return int32(len(val)), nil
+	})
+
+	noop := func(ctx *HostCtx, args ...wasmer.Value) (interface{}, error) { return nil, nil }
+
+	rt := NewRuntime()
+	defer rt.Close()
+
+	if err := rt.RegisterHostFns(getFlag); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to RegisterHostFns"))
+	}
+
+	if err := rt.RegisterHostFns(NewHostFn("cache_get", nil, nil, noop)); err == nil {
+		t.Error("expected host fn with conflicting name to fail to register")
+	}
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", rt.NewRunner("./testdata/hostfn/hostfn.wat"))
+
+	res, err := doWasm("new-ui").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "enabled" {
+		t.Errorf("expected 'enabled', got %q", string(res.([]byte)))
+	}
+
+	if err := rt.RegisterHostFns(NewHostFn("late", nil, nil, noop)); err == nil {
+		t.Error("expected host fn registered after Runner creation to fail")
+	}
+}
+
+func TestRuntimeTypedHostFn(t *testing.T) {
+	// add_mixed takes an i64 and an f64, and returns both with 2 added to them
+	addMixed := NewHostFn(
+		"add_mixed",
+		[]wasmer.ValueKind{wasmer.I64, wasmer.F64},
+		[]wasmer.ValueKind{wasmer.I64, wasmer.F64},
+		func(ctx *HostCtx, args ...wasmer.Value) (interface{}, error) {
+			return []interface{}{args[0].I64() + 2, args[1].F64() + 2}, nil
+		},
+	)
+
+	rt := NewRuntime()
+	defer rt.Close()
+
+	if err := rt.RegisterHostFns(addMixed); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to RegisterHostFns"))
+	}
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", rt.NewRunner("./testdata/typedhostfn/typedhostfn.wat"))
+
+	// the Runnable traps if the values returned by add_mixed are incorrect
+	res, err := doWasm("typed").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "typed" {
+		t.Errorf("expected 'typed', got %q", string(res.([]byte)))
+	}
+}
+
+func i32Args(count int) []wasmer.ValueKind {
+	kinds := make([]wasmer.ValueKind, count)
+	for i := range kinds {
+		kinds[i] = wasmer.I32
+	}
+
+	return kinds
+}
+
+func TestWasmRunnerWASI(t *testing.T) {
+	rt := NewRuntime()
+	defer rt.Close()
+
+	h := hive.New()
+
+	runner := rt.NewRunner("./testdata/wasi/wasi.wat",
+		WASIEnv(map[string]string{"GREETING": "hello"}),
+		WASIArgs("--verbose"),
+		WASIDir("/data", "./testdata/wasi/files"),
+	)
+
+	doWasm := h.Handle("wasm", runner)
+
+	res, err := doWasm("hello.txt").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	parts := strings.Split(string(res.([]byte)), "|")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 sections in result, got %q", string(res.([]byte)))
+	}
+
+	if parts[0] != "GREETING=hello\x00" {
+		t.Errorf("expected env 'GREETING=hello', got %q", parts[0])
+	}
+
+	if !strings.HasSuffix(parts[1], "\x00--verbose\x00") {
+		t.Errorf("expected args to end with '--verbose', got %q", parts[1])
+	}
+
+	if parts[2] != "file contents" {
+		t.Errorf("expected 'file contents', got %q", parts[2])
+	}
+
+	if _, err := os.Stat("./testdata/wasi/files/written.txt"); err == nil {
+		os.Remove("./testdata/wasi/files/written.txt")
+		t.Error("Runnable was able to write to preopened directory")
+	}
+}
+
+func TestWasmRunnerWASIWrite(t *testing.T) {
+	rt := NewRuntime()
+	defer rt.Close()
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", rt.NewRunner("./testdata/wasiwrite/wasiwrite.wat", WASIDir("/data", "./testdata/wasi/files")))
+
+	// each execution overwrites the file, which must not be seen by the next
+	for i := 0; i < 3; i++ {
+		res, err := doWasm("hello.txt").Then()
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to Then"))
+		}
+
+		if string(res.([]byte)) != "file contents" {
+			t.Errorf("expected original contents on execution %d, got %q", i, string(res.([]byte)))
+		}
+	}
+
+	contents, err := ioutil.ReadFile("./testdata/wasi/files/hello.txt")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ReadFile"))
+	}
+
+	if string(contents) != "file contents" {
+		ioutil.WriteFile("./testdata/wasi/files/hello.txt", []byte("file contents"), 0644)
+		t.Errorf("Runnable modified the file on the host: %q", string(contents))
+	}
+}
+
+func TestWasmBundleWASI(t *testing.T) {
+	rt := NewRuntime()
+	defer rt.Close()
+
+	h := hive.New()
+
+	b := &bundle.Bundle{
+		Directive: &directive.Directive{
+			Identifier:  "com.suborbital.test",
+			AppVersion:  "v0.0.1",
+			AtmoVersion: "v0.0.6",
+			Runnables: []directive.Runnable{
+				{
+					Name:      "wasi",
+					Namespace: directive.NamespaceDefault,
+					WASI: &directive.WASI{
+						Env: map[string]string{"MODE": "bundle"},
+						Dirs: []directive.WASIDir{
+							{
+								BundlePath: "static/assets",
+								GuestPath:  "/assets",
+							},
+						},
+					},
+				},
+			},
+		},
+		Runnables: []bundle.WasmModuleRef{
+			{
+				Filepath: "./testdata/wasi/wasi.wat",
+				Name:     "wasi.wasm",
+			},
+		},
+		StaticFiles: map[string][]byte{
+			"static/assets/nested/page.html": []byte("<p>from the bundle</p>"),
+			"static/other.txt":               []byte("not included"),
+		},
+	}
+
+	if err := rt.HandleBundle(h, b); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to HandleBundle"))
+	}
+
+	res, err := h.Do(hive.NewJob("wasi", "nested/page.html")).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	parts := strings.Split(string(res.([]byte)), "|")
+	if len(parts) != 3 || parts[0] != "MODE=bundle\x00" || parts[2] != "<p>from the bundle</p>" {
+		t.Errorf("unexpected result %q", string(res.([]byte)))
+	}
+}
+
+func TestWasmBundleWASIHostDir(t *testing.T) {
+	b := &bundle.Bundle{
+		Directive: &directive.Directive{
+			Identifier:  "com.suborbital.test",
+			AppVersion:  "v0.0.1",
+			AtmoVersion: "v0.0.6",
+			Runnables: []directive.Runnable{
+				{
+					Name:      "wasi",
+					Namespace: directive.NamespaceDefault,
+					WASI: &directive.WASI{
+						Dirs: []directive.WASIDir{
+							{
+								Path:      "../../files",
+								GuestPath: "/data",
+							},
+						},
+					},
+				},
+			},
+		},
+		Runnables: []bundle.WasmModuleRef{
+			{
+				Filepath: "./testdata/wasi/wasi.wat",
+				Name:     "wasi.wasm",
+			},
+		},
+	}
+
+	// a bundle cannot preopen a directory on the host unless the Runtime permits a root for it
+	rt := NewRuntime()
+	defer rt.Close()
+
+	if err := rt.HandleBundle(hive.New(), b); err == nil {
+		t.Error("expected HandleBundle to fail for a host dir without a BundleWASIRoot")
+	}
+
+	rootRt := NewRuntime(BundleWASIRoot("./testdata/wasi"))
+	defer rootRt.Close()
+
+	h := hive.New()
+
+	if err := rootRt.HandleBundle(h, b); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to HandleBundle"))
+	}
+
+	// the ../ cannot escape the root, so the path resolves to ./testdata/wasi/files
+	res, err := h.Do(hive.NewJob("wasi", "hello.txt")).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if parts := strings.Split(string(res.([]byte)), "|"); len(parts) != 3 || parts[2] != "file contents" {
+		t.Errorf("unexpected result %q", string(res.([]byte)))
+	}
+}
+
+func TestWasmBundleConfig(t *testing.T) {
+	os.Setenv("HIVE_WASM_TEST_REGION", "ca-central-1")
+	defer os.Unsetenv("HIVE_WASM_TEST_REGION")
+
+	os.Setenv("HIVE_WASM_TEST_PRIVATE", "hunter2")
+	defer os.Unsetenv("HIVE_WASM_TEST_PRIVATE")
+
+	configEnv := BundleConfigEnv("HIVE_WASM_TEST_REGION", "HIVE_WASM_TEST_UNSET")
+
+	rt := NewRuntime(configEnv)
+	defer rt.Close()
+
+	h := hive.New()
+
+	b := &bundle.Bundle{
+		Directive: &directive.Directive{
+			Identifier:  "com.suborbital.test",
+			AppVersion:  "v0.0.1",
+			AtmoVersion: "v0.0.6",
+			Config: map[string]string{
+				"region":   "${HIVE_WASM_TEST_REGION}",
+				"pageSize": "10",
+			},
+			Runnables: []directive.Runnable{
+				{
+					Name:      "config",
+					Namespace: directive.NamespaceDefault,
+					Config: map[string]string{
+						"pageSize": "25",
+					},
+				},
+			},
+		},
+		Runnables: []bundle.WasmModuleRef{
+			{
+				Filepath: "./testdata/config/config.wat",
+				Name:     "config.wasm",
+			},
+		},
+	}
+
+	if err := rt.HandleBundle(h, b); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to HandleBundle"))
+	}
+
+	for key, expected := range map[string]string{"region": "ca-central-1", "pageSize": "25"} {
+		res, err := h.Do(hive.NewJob("config", key)).Then()
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to Then"))
+		}
+
+		if string(res.([]byte)) != expected {
+			t.Errorf("expected %s to be %q, got %q", key, expected, string(res.([]byte)))
+		}
+	}
+
+	res, err := h.Do(hive.NewJob("config", "missing")).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != errCodeNotFound {
+		t.Errorf("expected %d for missing key, got %d", errCodeNotFound, code)
+	}
+
+	// a bundle referencing an environment variable that is not set fails to load
+	b.Directive.Config["token"] = "${HIVE_WASM_TEST_UNSET}"
+
+	if err := rt.HandleBundle(h, b); err == nil {
+		t.Error("expected HandleBundle to fail with an unset environment variable")
+	}
+
+	// a bundle cannot read an environment variable that the Runtime has not permitted, even when it is set
+	b.Directive.Config["token"] = "${HIVE_WASM_TEST_PRIVATE}"
+
+	if err := rt.HandleBundle(h, b); err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected HandleBundle to fail with an environment variable that is not permitted, got %v", err)
+	}
+
+	// a bundle whose later Runnable has invalid config does not mount any of its Runnables
+	partialRt := NewRuntime(configEnv)
+	defer partialRt.Close()
+
+	delete(b.Directive.Config, "token")
+	b.Directive.Runnables = append(b.Directive.Runnables, directive.Runnable{
+		Name:      "secret",
+		Namespace: directive.NamespaceDefault,
+		Config: map[string]string{
+			"token": "${HIVE_WASM_TEST_UNSET}",
+		},
+	})
+	b.Runnables = append(b.Runnables, bundle.WasmModuleRef{
+		Filepath: "./testdata/secret/secret.wat",
+		Name:     "secret.wasm",
+	})
+
+	if err := partialRt.HandleBundle(hive.New(), b); err == nil {
+		t.Error("expected HandleBundle to fail with an unset environment variable for a later Runnable")
+	}
+
+	if len(partialRt.mounted) != 0 {
+		t.Errorf("expected no Runnables to be mounted, got %d", len(partialRt.mounted))
+	}
+}
+
+// greeter is a Go Runnable that greets the input it is invoked with, counting its invocations
+type greeter struct {
+	count int32
+}
+
+func (g *greeter) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
+	atomic.AddInt32(&g.count, 1)
+
+	invocation, ok := job.Data().(*Invocation)
+	if !ok {
+		return nil, fmt.Errorf("expected *Invocation, got %T", job.Data())
+	}
+
+	return []byte(fmt.Sprintf("hello %s from depth %d", string(invocation.Input), invocation.Depth)), nil
+}
+
+func (g *greeter) OnChange(_ hive.ChangeEvent) error { return nil }
+
+func TestWasmRunnerInvoke(t *testing.T) {
+	h := hive.New()
+
+	g := &greeter{}
+	h.Handle("greeter", g)
+
+	doWasm := h.Handle("invoke", NewRunner("./testdata/invoke/invoke.wat", MaxInvokeDepth(2)), hive.PoolSize(3))
+
+	// the output is larger than the Runnable's first buffer, so the
+	// result is kept for its second call rather than invoking again
+	res, err := doWasm("greeter").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "hello greeter from depth 1" {
+		t.Errorf("unexpected result %q", string(res.([]byte)))
+	}
+
+	if count := atomic.LoadInt32(&g.count); count != 1 {
+		t.Errorf("expected greeter to be invoked once, was invoked %d times", count)
+	}
+
+	// the Runnable invoking itself is stopped once it knows its own name (from being invoked by it),
+	// and the code is passed back up through each invocation
+	res, err = doWasm("invoke").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then recursive"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != errCodeInvokeCycle {
+		t.Errorf("expected %d for recursion, got %d", errCodeInvokeCycle, code)
+	}
+
+	// the depth limit is checked before the cycle
+	doShallow := h.Handle("shallow", NewRunner("./testdata/invoke/invoke.wat", MaxInvokeDepth(1)), hive.PoolSize(2))
+
+	res, err = doShallow("shallow").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then shallow"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != errCodeDepthExceeded {
+		t.Errorf("expected %d for depth, got %d", errCodeDepthExceeded, code)
+	}
+
+	// a Runnable restricted with InvokeAccess cannot invoke other functions
+	doRestricted := h.Handle("restricted", NewRunner("./testdata/invoke/invoke.wat", InvokeAccess("invoke")))
+
+	res, err = doRestricted("greeter").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then restricted"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != errCodeAccessDenied {
+		t.Errorf("expected %d for restricted, got %d", errCodeAccessDenied, code)
+	}
+
+	res, err = doWasm("missing").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then missing"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != -3 {
+		t.Errorf("expected -3 for missing function, got %d", code)
+	}
+}
+
+func TestWasmRunnerInvokeTimeout(t *testing.T) {
+	h := hive.New()
+
+	// with a single worker, the Runnable invoking itself waits on a job that cannot run until it returns
+	doWasm := h.Handle("wait", NewRunner("./testdata/invoke/invoke.wat", InvokeTimeout(100*time.Millisecond)))
+
+	start := time.Now()
+
+	res, err := doWasm("wait").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != -3 {
+		t.Errorf("expected -3 for timed out invocation, got %d", code)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected invocation to time out after 100ms, took %s", elapsed)
+	}
+}
+
+func TestWasmBundleInvoke(t *testing.T) {
+	rt := NewRuntime()
+	defer rt.Close()
+
+	h := hive.New()
+
+	g := &greeter{}
+	h.Handle("greeter", g)
+
+	b := &bundle.Bundle{
+		Directive: &directive.Directive{
+			Identifier:  "com.suborbital.test",
+			AppVersion:  "v0.0.1",
+			AtmoVersion: "v0.0.6",
+			Runnables: []directive.Runnable{
+				{
+					Name:      "invoke",
+					Namespace: directive.NamespaceDefault,
+				},
+			},
+		},
+		Runnables: []bundle.WasmModuleRef{
+			{
+				Filepath: "./testdata/invoke/invoke.wat",
+				Name:     "invoke.wasm",
+			},
+		},
+	}
+
+	if err := rt.HandleBundle(h, b); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to HandleBundle"))
+	}
+
+	fqfn, err := b.Directive.FQFN("invoke")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to FQFN"))
+	}
+
+	// a bundle's Runnable knows its own names, so invoking itself fails before waiting on its only worker,
+	// and it cannot invoke functions outside of its Directive
+	cases := []struct {
+		name     string
+		expected int32
+	}{
+		{"invoke", errCodeInvokeCycle},
+		{fqfn, errCodeInvokeCycle},
+		{"greeter", errCodeAccessDenied},
+	}
+
+	for _, c := range cases {
+		res, err := h.Do(hive.NewJob("invoke", c.name)).Then()
+		if err != nil {
+			t.Fatal(errors.Wrapf(err, "failed to Then for %s", c.name))
+		}
+
+		if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != c.expected {
+			t.Errorf("expected %d for %s, got %d", c.expected, c.name, code)
+		}
+	}
+
+	if count := atomic.LoadInt32(&g.count); count != 0 {
+		t.Errorf("expected greeter not to be invoked, was invoked %d times", count)
+	}
+}
+
+func TestWasmRunnerOutput(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "hive-wasm-log-")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempFile"))
+	}
+
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	rt := NewRuntime(Logger(vlog.Default(vlog.ToFile(logFile.Name()))))
+	defer rt.Close()
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", rt.NewRunner("./testdata/print/print.wat", Output(OutputLogAndAttach)))
+
+	// output is captured per execution, so the second must not include the first's
+	for _, input := range []string{"first", "second"} {
+		res, err := doWasm(input).Then()
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to Then"))
+		}
+
+		result, ok := res.(*RunResult)
+		if !ok {
+			t.Fatalf("expected *RunResult, got %T", res)
+		}
+
+		if string(result.Result) != input {
+			t.Errorf("expected result %q, got %q", input, string(result.Result))
+		}
+
+		if string(result.Stdout) != input+"\n" {
+			t.Errorf("expected stdout %q, got %q", input+"\n", string(result.Stdout))
+		}
+
+		if string(result.Stderr) != "something went wrong\n" {
+			t.Errorf("expected stderr 'something went wrong', got %q", string(result.Stderr))
+		}
+	}
+
+	logs, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ReadFile"))
+	}
+
+	for _, expected := range []string{"second", "something went wrong", `"runnable":"print.wat"`} {
+		if !strings.Contains(string(logs), expected) {
+			t.Errorf("expected logs to contain %q, got %s", expected, string(logs))
+		}
+	}
+}
+
+func TestWasmRunnerSecrets(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "hive-wasm-log-")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempFile"))
+	}
+
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	rt := NewRuntime(Logger(vlog.Default(vlog.ToFile(logFile.Name()))))
+	defer rt.Close()
+
+	provider := secrets.NewMemoryProvider(map[string]string{"db.password": "hunter2", "api.key": "abc123"})
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", rt.NewRunner("./testdata/secret/secret.wat", Secrets(provider), SecretAccess("db.password", "missing")))
+	doNone := h.Handle("none", rt.NewRunner("./testdata/secret/secret.wat", SecretAccess("db.password")))
+	doPrint := h.Handle("print", rt.NewRunner("./testdata/print/print.wat", Output(OutputLog)))
+
+	res, err := doWasm("db.password").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "hunter2" {
+		t.Errorf("expected hunter2, got %s", string(res.([]byte)))
+	}
+
+	cases := []struct {
+		job      func(interface{}) *hive.Result
+		name     string
+		expected int32
+	}{
+		{doWasm, "api.key", errCodeAccessDenied},
+		{doWasm, "missing", errCodeNotFound},
+		{doNone, "db.password", errCodeUnavailable},
+	}
+
+	for _, c := range cases {
+		res, err := c.job(c.name).Then()
+		if err != nil {
+			t.Fatal(errors.Wrapf(err, "failed to Then for %s", c.name))
+		}
+
+		if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != c.expected {
+			t.Errorf("expected %d for %s, got %d", c.expected, c.name, code)
+		}
+	}
+
+	// a secret is redacted from the output of every Runnable, not just the one that accessed it
+	if _, err := doPrint("password is hunter2").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then for print"))
+	}
+
+	logs, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ReadFile"))
+	}
+
+	if strings.Contains(string(logs), "hunter2") || !strings.Contains(string(logs), "secret: "+redactedSecret) || !strings.Contains(string(logs), "password is "+redactedSecret) {
+		t.Errorf("expected secret to be redacted from logs, got %s", string(logs))
+	}
+
+	if !strings.Contains(string(logs), `"secret":"api.key"`) {
+		t.Errorf("expected denied access to be audited, got %s", string(logs))
+	}
+}
+
+// rotatingProvider is a secrets.Provider whose secrets can be changed
+type rotatingProvider struct {
+	secrets map[string]string
+	lock    sync.Mutex
+}
+
+func (r *rotatingProvider) Secret(name string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	val, exists := r.secrets[name]
+	if !exists {
+		return nil, secrets.ErrSecretNotFound
+	}
+
+	return []byte(val), nil
+}
+
+func (r *rotatingProvider) rotate(name, val string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.secrets[name] = val
+}
+
+func TestWasmRunnerSecretRedaction(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "hive-wasm-log-")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempFile"))
+	}
+
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	rt := NewRuntime(Logger(vlog.Default(vlog.ToFile(logFile.Name()))))
+	defer rt.Close()
+
+	provider := &rotatingProvider{secrets: map[string]string{"db.password": "hunter2"}}
+
+	h := hive.New()
+
+	doSecret := h.Handle("secret", rt.NewRunner("./testdata/secret/secret.wat", Secrets(provider), SecretAccess("db.password")))
+	doPrint := h.Handle("print", rt.NewRunner("./testdata/print/print.wat", Output(OutputLog)))
+
+	// a secret that a Runnable can access is redacted before it has been accessed
+	if _, err := doPrint("password is hunter2").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then for print"))
+	}
+
+	logs, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ReadFile"))
+	}
+
+	if strings.Contains(string(logs), "hunter2") {
+		t.Errorf("expected secret to be redacted from logs, got %s", string(logs))
+	}
+
+	// a rotated secret replaces its previous value rather than accumulating
+	provider.rotate("db.password", "swordfish")
+
+	if _, err := doSecret("db.password").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then for secret"))
+	}
+
+	if vals := rt.redactor.vals; !reflect.DeepEqual(vals, []string{"swordfish"}) {
+		t.Errorf("expected only the rotated secret to be redacted, got %v", vals)
+	}
+}
+
+func TestWasmRunnerError(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/error/error.wat"))
+
+	// run twice to ensure the error from the first run isn't left behind
+	for _, msg := range []string{"user not found", "post not found"} {
+		_, err := doWasm(msg).Then()
+		if err == nil {
+			t.Fatal("expected Runnable to return an error")
+		}
+
+		runErr := &RunnableError{}
+		if !errors.As(err, &runErr) {
+			t.Fatalf("expected RunnableError, got %T: %s", err, err.Error())
+		}
+
+		if runErr.Code != 404 || runErr.Message != msg {
+			t.Errorf("expected code 404 and message %q, got %d and %q", msg, runErr.Code, runErr.Message)
+		}
+	}
+}
+
+func TestWasmRunnerResponse(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/response/response.wat"))
+
+	req := &request.CoordinatedRequest{
+		Method: "GET",
+		URL:    "/account",
+		ID:     uuid.New().String(),
+	}
+
+	// a header set by an earlier Runnable should be preserved
+	req.SetHeader("Content-Type", "text/plain")
+
+	reqJSON, err := req.ToJSON()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ToJSON"))
+	}
+
+	res, err := doWasm(reqJSON).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	resp, ok := res.(*request.CoordinatedResponse)
+	if !ok {
+		t.Fatalf("expected *request.CoordinatedResponse, got %T", res)
+	}
+
+	if string(resp.Output) != "redirecting" {
+		t.Errorf("expected 'redirecting', got %q", string(resp.Output))
+	}
+
+	if resp.Status != 302 {
+		t.Errorf("expected status 302, got %d", resp.Status)
+	}
+
+	expected := map[string][]string{
+		"Location":     {"/login"},
+		"Content-Type": {"text/plain"},
+		"Set-Cookie":   {"session=1", "theme=dark"},
+	}
+
+	if !reflect.DeepEqual(resp.Headers, expected) {
+		t.Errorf("unexpected response headers %v", resp.Headers)
+	}
+
+	// without a request, the response host functions fail and the Runnable traps
+	if _, err := doWasm("not a request").Then(); err == nil {
+		t.Error("expected Runnable to fail without a request")
+	}
+}
+
+func TestWasmRunnerState(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/state/state.wat"))
+
+	req := &request.CoordinatedRequest{
+		Method: "GET",
+		URL:    "/account",
+		ID:     uuid.New().String(),
+		State: map[string][]byte{
+			"old": []byte("stale"),
+		},
+	}
+
+	reqJSON, err := req.ToJSON()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ToJSON"))
+	}
+
+	res, err := doWasm(reqJSON).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	resp, ok := res.(*request.CoordinatedResponse)
+	if !ok {
+		t.Fatalf("expected *request.CoordinatedResponse, got %T", res)
+	}
+
+	if setCode, deleteCode := binary.LittleEndian.Uint32(resp.Output), binary.LittleEndian.Uint32(resp.Output[4:]); setCode != 0 || deleteCode != 0 {
+		t.Fatalf("expected state_set and state_delete to succeed, got %d and %d", int32(setCode), int32(deleteCode))
+	}
+
+	if string(resp.StateChanges.Set["greeting"]) != "hello" {
+		t.Errorf("expected greeting to be set, got %v", resp.StateChanges.Set)
+	}
+
+	if len(resp.StateChanges.Deleted) != 1 || resp.StateChanges.Deleted[0] != "old" {
+		t.Errorf("expected old to be deleted, got %v", resp.StateChanges.Deleted)
+	}
+
+	// without a request, there is no state to change
+	res, err = doWasm("not a request").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != -2 {
+		t.Errorf("expected -2 without a request, got %d", code)
+	}
+}
+
+func TestWasmRunnerBodyPath(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/bodypath/bodypath.wat"))
+
+	body := `{"user":{"name":"cohix","age":30,"admin":false,"emails":["a@example.com","b@example.com"],"a/b":{"~c":1.50}}}`
+
+	cases := []struct {
+		path     string
+		expected string
+		code     int32
+	}{
+		{"user.name", "cohix", 0},
+		{"/user/name", "cohix", 0},
+		{"user.age", "30", 0},
+		{"user.admin", "false", 0},
+		{"user.emails.1", "b@example.com", 0},
+		{"/user/emails", `["a@example.com","b@example.com"]`, 0},
+		{"/user/a~1b/~0c", "1.50", 0},
+		{"user.emails.2", "", -3},
+		{"user.name.first", "", -3},
+		{"user.missing", "", -3},
+	}
+
+	for _, c := range cases {
+		req := &request.CoordinatedRequest{
+			Method:  "POST",
+			URL:     "/user",
+			ID:      uuid.New().String(),
+			Body:    []byte(body),
+			Headers: map[string]string{"X-Path": c.path},
+		}
+
+		reqJSON, err := req.ToJSON()
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "failed to ToJSON"))
+		}
+
+		res, err := doWasm(reqJSON).Then()
+		if err != nil {
+			t.Fatal(errors.Wrapf(err, "failed to Then for %s", c.path))
+		}
+
+		output := res.([]byte)
+
+		if c.code != 0 {
+			if code := int32(binary.LittleEndian.Uint32(output)); code != c.code {
+				t.Errorf("expected %d for %s, got %d", c.code, c.path, code)
+			}
+
+			continue
+		}
+
+		if string(output) != c.expected {
+			t.Errorf("expected %q for %s, got %q", c.expected, c.path, string(output))
+		}
+	}
+
+	// a request without a body has no value at any path
+	req := &request.CoordinatedRequest{
+		Method:  "GET",
+		URL:     "/user",
+		ID:      uuid.New().String(),
+		Body:    []byte{},
+		Headers: map[string]string{"X-Path": "user.name"},
+	}
+
+	reqJSON, err := req.ToJSON()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to ToJSON"))
+	}
+
+	res, err := doWasm(reqJSON).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then for empty body"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != -3 {
+		t.Errorf("expected -3 for empty body, got %d", code)
+	}
+}
+
+func TestWasmRunnerHTTPMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("X-Test", "hello")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	defer server.Close()
+
+	h := hive.New()
+
+	// the test server is on the loopback address, which is blocked by default
+	doWasm := h.Handle("wasm", NewRunner("./testdata/fetchmeta/fetchmeta.wat", Egress(EgressPolicy{AllowPrivateIPs: true})))
+
+	res, err := doWasm(server.URL).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "hello" {
+		t.Errorf("expected 'hello', got %q", string(res.([]byte)))
+	}
+}
+
+func TestWasmRunnerEgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+
+	defer server.Close()
+
+	private := EgressPolicy{AllowPrivateIPs: true}
+
+	tests := []struct {
+		name     string
+		url      string
+		policies []EgressPolicy
+		allowed  bool
+	}{
+		{"private IPs blocked by default", server.URL, nil, false},
+		{"private IPs allowed", server.URL, []EgressPolicy{private}, true},
+		{"private IPs blocked by one of several policies", server.URL, []EgressPolicy{private, {}}, false},
+		{"host not in allowlist", server.URL, []EgressPolicy{{AllowPrivateIPs: true, AllowHosts: []string{"*.example.com"}}}, false},
+		{"host in allowlist", server.URL, []EgressPolicy{{AllowPrivateIPs: true, AllowHosts: []string{"*"}}}, true},
+		{"host in denylist", server.URL, []EgressPolicy{{AllowPrivateIPs: true, DenyHosts: []string{"127.0.0.1"}}}, false},
+		{"scheme not allowed", server.URL, []EgressPolicy{{AllowPrivateIPs: true, Schemes: []string{"https"}}}, false},
+		{"redirect followed", server.URL + "/redirect", []EgressPolicy{private}, true},
+		{"redirects disabled", server.URL + "/redirect", []EgressPolicy{{AllowPrivateIPs: true, MaxRedirects: -1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []RunnerOption{}
+			for _, p := range tt.policies {
+				opts = append(opts, Egress(p))
+			}
+
+			runner := NewRunner("./testdata/egress/egress.wat", opts...)
+			defer runner.Close()
+
+			h := hive.New()
+			doWasm := h.Handle("wasm", runner)
+
+			res, err := doWasm(tt.url).Then()
+			if err != nil {
+				t.Fatal(errors.Wrap(err, "failed to Then"))
+			}
+
+			code := int32(binary.LittleEndian.Uint32(res.([]byte)))
+
+			if tt.allowed && code != 2 {
+				t.Errorf("expected request to be allowed, fetch_url returned %d", code)
+			} else if !tt.allowed && code != errCodeEgressDenied {
+				t.Errorf("expected request to be denied, fetch_url returned %d", code)
+			}
+		})
+	}
+
+	// fetch_url cannot be given IPv6 literals (its headers are separated by ::), so the addresses that
+	// embed IPv4 addresses are checked directly, as they would be when a hostname resolves to them
+	for _, addr := range []string{"64:ff9b::7f00:1", "::ffff:10.0.0.1"} {
+		if err := (egressPolicies{{}}).checkIP(net.ParseIP(addr)); err == nil {
+			t.Errorf("expected connection to %s to be denied", addr)
+		}
+	}
+}
+
+func TestWasmRunnerFetchBuffering(t *testing.T) {
+	var hits int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("hello world"))
+	}))
+
+	defer server.Close()
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/fetchgrow/fetchgrow.wat", Egress(EgressPolicy{AllowPrivateIPs: true})))
+
+	res, err := doWasm(server.URL).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "hello world" {
+		t.Errorf("expected 'hello world', got %q", string(res.([]byte)))
+	}
+
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected upstream to be requested once, was requested %d times", hits)
+	}
+}
+
+// roundTripperFunc allows a func to be used as an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWasmRunnerFetchClientOptions(t *testing.T) {
+	var hits int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			// fails the first two attempts
+			if atomic.AddInt32(&hits, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/slow":
+			time.Sleep(time.Millisecond * 200)
+		case "/large":
+			w.Write([]byte("this response is too large"))
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+
+	defer server.Close()
+
+	stubClient := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("stubbed")),
+			}
+
+			return resp, nil
+		}),
+	}
+
+	private := Egress(EgressPolicy{AllowPrivateIPs: true})
+
+	tests := []struct {
+		name string
+		url  string
+		opts []RunnerOption
+		code int32
+	}{
+		{"retried until success", server.URL + "/flaky", []RunnerOption{private, FetchRetry(2, time.Millisecond)}, 2},
+		{"timed out", server.URL + "/slow", []RunnerOption{private, FetchTimeout(time.Millisecond * 20)}, -3},
+		{"response too large", server.URL + "/large", []RunnerOption{private, FetchMaxResponseSize(8)}, errCodeResponseTooLarge},
+		{"custom client", "http://stub.example.com", []RunnerOption{HTTPClient(stubClient), private}, 7},
+		{"custom client denied", "http://stub.example.com", []RunnerOption{HTTPClient(stubClient), private, Egress(EgressPolicy{DenyHosts: []string{"*.example.com"}, AllowPrivateIPs: true})}, errCodeEgressDenied},
+		{"custom client denied with trailing dot", "http://stub.example.com.", []RunnerOption{HTTPClient(stubClient), private, Egress(EgressPolicy{DenyHosts: []string{"*.example.com"}, AllowPrivateIPs: true})}, errCodeEgressDenied},
+		{"custom client allowed with trailing dot", "http://stub.example.com.", []RunnerOption{HTTPClient(stubClient), private, Egress(EgressPolicy{AllowHosts: []string{"*.example.com"}, AllowPrivateIPs: true})}, 7},
+		{"custom transport private IP", server.URL, []RunnerOption{HTTPClient(&http.Client{Transport: &http.Transport{}})}, errCodeEgressDenied},
+		{"custom transport allowed", server.URL, []RunnerOption{HTTPClient(&http.Client{Transport: &http.Transport{}}), private}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := NewRunner("./testdata/egress/egress.wat", tt.opts...)
+			defer runner.Close()
+
+			h := hive.New()
+			doWasm := h.Handle("wasm", runner)
+
+			res, err := doWasm(tt.url).Then()
+			if err != nil {
+				t.Fatal(errors.Wrap(err, "failed to Then"))
+			}
+
+			if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != tt.code {
+				t.Errorf("expected fetch_url to return %d, got %d", tt.code, code)
+			}
+		})
+	}
+
+	if atomic.LoadInt32(&hits) != 3 {
+		t.Errorf("expected flaky upstream to be requested 3 times, was requested %d times", hits)
+	}
+
+	// a client whose connections can't be checked cannot be used unless private IPs are allowed
+	runner := NewRunner("./testdata/egress/egress.wat", HTTPClient(stubClient))
+	defer runner.Close()
+
+	if _, err := hive.New().Handle("wasm", runner)("http://stub.example.com").Then(); err == nil {
+		t.Error("expected Runner with an unchecked HTTP client to fail")
+	}
+}
+
+// encodeRequest encodes a request for fetch_request in the same way as the SDKs
+func encodeRequest(method, url string, headers [][2]string, body string) []byte {
+	encoded := []byte{outboundRequestVersion}
+
+	field := func(val string) {
+		encoded = append(encoded, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(encoded[len(encoded)-4:], uint32(len(val)))
+		encoded = append(encoded, val...)
+	}
+
+	field(method)
+	field(url)
+
+	encoded = append(encoded, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(encoded[len(encoded)-4:], uint32(len(headers)))
+
+	for _, h := range headers {
+		field(h[0])
+		field(h[1])
+	}
+
+	field(body)
+
+	return encoded
+}
+
+func TestWasmRunnerFetchRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, _ := ioutil.ReadAll(r.Body)
+
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.Header.Get("X-Time"), strings.Join(r.Header.Values("X-Multi"), ","), reqBody)
+	}))
+
+	defer server.Close()
+
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/fetchrequest/fetchrequest.wat", Egress(EgressPolicy{AllowPrivateIPs: true})))
+
+	headers := [][2]string{
+		{"X-Time", "12:30:00"},
+		{"X-Multi", "one"},
+		{"X-Multi", "two"},
+	}
+
+	res, err := doWasm(encodeRequest(http.MethodPut, server.URL, headers, "hello")).Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if string(res.([]byte)) != "PUT 12:30:00 one,two hello" {
+		t.Errorf("expected 'PUT 12:30:00 one,two hello', got %q", string(res.([]byte)))
+	}
+
+	// malformed requests must fail rather than be sent
+	for _, encoded := range [][]byte{
+		{},
+		{2},
+		encodeRequest("TRACE", server.URL, nil, ""),
+		encodeRequest(http.MethodGet, server.URL, nil, "")[:10],
+		append(encodeRequest(http.MethodGet, server.URL, nil, ""), 0),
+	} {
+		if _, err := doWasm(encoded).Then(); err == nil {
+			t.Errorf("expected request %v to fail", encoded)
+		}
+	}
+}
+
+func TestParseHTTPHeaders(t *testing.T) {
+	headers, err := parseHTTPHeaders(strings.Split("https://example.com::authorization:bearer abc::x-time:12:30:00", "::"))
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to parseHTTPHeaders"))
+	}
+
+	if headers.Get("Authorization") != "bearer abc" || headers.Get("X-Time") != "12:30:00" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestWasmRunnerCache(t *testing.T) {
+	h := hive.New()
+
+	doWasm := h.Handle("wasm", NewRunner("./testdata/cache/cache.wat"))
+
+	res, err := doWasm("").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then"))
+	}
+
+	if expected := encodeList([]string{"hits"}); string(res.([]byte)) != string(expected) {
+		t.Errorf("expected keys %v, got %v", expected, res.([]byte))
+	}
+}
+
+func TestWasmRunnerCacheScope(t *testing.T) {
+	h := hive.New()
+
+	// the Runnable expects the keys it uses not to exist yet, so it only
+	// succeeds in both scopes if they are isolated from one another
+	doFoo := h.Handle("foo", NewRunner("./testdata/cache/cache.wat", CacheScope("app/foo/default/")))
+	doBar := h.Handle("bar", NewRunner("./testdata/cache/cache.wat", CacheScope("app/bar/default/")))
+
+	if _, err := doFoo("").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then foo"))
+	}
+
+	if _, err := doBar("").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then bar"))
+	}
+
+	// Runners without a scope are isolated from one another unless they opt in to the whole cache
+	doFirst := h.Handle("first", NewRunner("./testdata/cache/cache.wat"))
+	doSecond := h.Handle("second", NewRunner("./testdata/cache/cache.wat"))
+
+	if _, err := doFirst("").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then first"))
+	}
+
+	if _, err := doSecond("").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then second"))
+	}
+
+	doUnscoped := h.Handle("unscoped", NewRunner("./testdata/cache/cache.wat", UnscopedCache()))
+	doOtherUnscoped := h.Handle("other-unscoped", NewRunner("./testdata/cache/cache.wat", UnscopedCache()))
+
+	if _, err := doUnscoped("").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then unscoped"))
+	}
+
+	if _, err := doOtherUnscoped("").Then(); err == nil {
+		t.Error("expected unscoped Runners to share the cache")
+	}
+}
+
+func TestWasmRunnerKV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to TempDir"))
+	}
+
+	defer os.RemoveAll(dir)
+
+	store, err := kv.NewFileStore(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to NewFileStore"))
+	}
+
+	defer store.Close()
+
+	h := hive.New()
+
+	doFoo := h.Handle("foo", NewRunner("./testdata/kv/kv.wat", KVStore(store), KVScope(appKVScope("com.suborbital.foo"))))
+	doBar := h.Handle("bar", NewRunner("./testdata/kv/kv.wat", KVStore(store), KVScope(appKVScope("com.suborbital.bar"))))
+	doNone := h.Handle("none", NewRunner("./testdata/kv/kv.wat"))
+
+	res, err := doFoo("hello").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then foo"))
+	}
+
+	if expected := encodeList([]string{"greeting"}); string(res.([]byte)) != string(expected) {
+		t.Errorf("expected keys %v, got %v", expected, res.([]byte))
+	}
+
+	if _, err := doBar("hey").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then bar"))
+	}
+
+	keys, _ := store.Scan("")
+	if expected := []string{"app/com.suborbital.bar/greeting", "app/com.suborbital.foo/greeting"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+
+	if val, _ := store.Get("app/com.suborbital.foo/greeting"); string(val) != "hello" {
+		t.Errorf("expected foo's greeting to be hello, got %s", string(val))
+	}
+
+	// a Runner without a scope is given its own, and only uses the whole store when it opts in
+	doDefault := h.Handle("default", NewRunner("./testdata/kv/kv.wat", KVStore(store)))
+	doUnscoped := h.Handle("unscoped", NewRunner("./testdata/kv/kv.wat", KVStore(store), UnscopedKV()))
+
+	res, err = doDefault("hi").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then default"))
+	}
+
+	if expected := encodeList([]string{"greeting"}); string(res.([]byte)) != string(expected) {
+		t.Errorf("expected keys %v, got %v", expected, res.([]byte))
+	}
+
+	if keys, _ := store.Scan("runner/"); len(keys) != 1 || !strings.HasSuffix(keys[0], "/greeting") {
+		t.Errorf("expected the default Runner's greeting to be in its own scope, got %v", keys)
+	}
+
+	if _, err := doUnscoped("hey").Then(); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then unscoped"))
+	}
+
+	if val, _ := store.Get("greeting"); string(val) != "hey" {
+		t.Errorf("expected the unscoped greeting to be hey, got %s", string(val))
+	}
+
+	res, err = doNone("hello").Then()
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to Then none"))
+	}
+
+	if code := int32(binary.LittleEndian.Uint32(res.([]byte))); code != errCodeUnavailable {
+		t.Errorf("expected kv_put to return %d without a store, got %d", errCodeUnavailable, code)
+	}
+}
+
+func TestRunnableCacheScope(t *testing.T) {
+	rt := NewRuntime()
+	cache := &mapCache{vals: map[string][]byte{}}
+
+	app := runnableCacheScope("com.suborbital.app", &directive.Runnable{Name: "fn", Namespace: "db"})
+	other := runnableCacheScope("com.suborbital.other", &directive.Runnable{Name: "fn", Namespace: "db"})
+	shared := runnableCacheScope("com.suborbital.app", &directive.Runnable{Name: "fn", Namespace: "db", Cache: &directive.Cache{Shared: true}})
+	otherShared := runnableCacheScope("com.suborbital.other", &directive.Runnable{Name: "fn", Namespace: "web", Cache: &directive.Cache{Shared: true}})
+
+	if app != "app/com.suborbital.app/db/" {
+		t.Errorf("unexpected scope %s", app)
+	}
+
+	// an identifier containing a separator cannot collide with another app's namespace
+	if crafted := runnableCacheScope("com.suborbital.app/db", nil); crafted == app || strings.Count(crafted, "/") != 3 {
+		t.Errorf("unexpected scope %s for crafted identifier", crafted)
+	}
+
+	rt.cacheOps(cache, app).set("key", []byte("app"), 0)
+	rt.cacheOps(cache, shared).set("key", []byte("shared"), 0)
+
+	if _, err := rt.cacheOps(cache, other).get("key"); !errors.Is(err, hive.ErrCacheKeyNotFound) {
+		t.Errorf("expected key to be isolated from other app, got %v", err)
+	}
+
+	if val, _ := rt.cacheOps(cache, app).get("key"); string(val) != "app" {
+		t.Errorf("expected app value, got %s", string(val))
+	}
+
+	if val, _ := rt.cacheOps(cache, otherShared).get("key"); string(val) != "shared" {
+		t.Errorf("expected shared value, got %s", string(val))
+	}
+
+	keys, err := rt.cacheOps(cache, app).keys("")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to keys"))
+	}
+
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("expected keys [key], got %v", keys)
+	}
+}
+
+// mapCache is a minimal hive.Cache, since hive's own cache is not exported
+type mapCache struct {
+	vals map[string][]byte
+	lock sync.Mutex
+}
+
+func (m *mapCache) Set(key string, val []byte, ttl int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.vals[key] = val
+
+	return nil
+}
+
+func (m *mapCache) Get(key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	val, exists := m.vals[key]
+	if !exists {
+		return nil, hive.ErrCacheKeyNotFound
+	}
+
+	return val, nil
+}
+
+func (m *mapCache) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.vals, key)
+
+	return nil
+}
+
+func TestCacheOpsConcurrentIncr(t *testing.T) {
+	rt := NewRuntime()
+	cache := &mapCache{vals: map[string][]byte{}}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := rt.cacheOps(cache, "").incr("counter", 1, 0); err != nil {
+				t.Error(errors.Wrap(err, "failed to incr"))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if val, _ := cache.Get("counter"); string(val) != "100" {
+		t.Errorf("expected counter to be 100, got %s", string(val))
+	}
+
+	// keys deleted outside of the host functions are no longer listed
+	rt.cacheOps(cache, "").set("count", []byte("1"), 0)
+	cache.Delete("counter")
+
+	keys, err := rt.cacheOps(cache, "").keys("count")
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "failed to keys"))
+	}
+
+	if len(keys) != 1 || keys[0] != "count" {
+		t.Errorf("expected keys [count], got %v", keys)
+	}
+}
+
+func TestCacheOpsIndexPruned(t *testing.T) {
+	rt := NewRuntime()
+	cache := &mapCache{vals: map[string][]byte{}}
+	ops := rt.cacheOps(cache, "")
+
+	for i := 0; i < 100; i++ {
+		if err := ops.set(fmt.Sprintf("limit-%d", i), []byte("1"), 1); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to set"))
+		}
+	}
+
+	ops.set("persistent", []byte("1"), 0)
+	ops.set("deleted", []byte("1"), 0)
+
+	if err := ops.delete("deleted"); err != nil {
+		t.Fatal(errors.Wrap(err, "failed to delete"))
+	}
+
+	// once the keys set with a TTL expire, the next sweep removes them from the index
+	ops.state.indexLock.Lock()
+	for key, exp := range ops.state.keys {
+		if !exp.IsZero() {
+			ops.state.keys[key] = time.Now().Add(-time.Second)
+		}
+	}
+
+	ops.state.nextSweep = time.Time{}
+	ops.state.indexLock.Unlock()
+
+	ops.set("another", []byte("1"), 0)
+
+	ops.state.indexLock.Lock()
+	defer ops.state.indexLock.Unlock()
+
+	if len(ops.state.keys) != 2 {
+		t.Errorf("expected 2 keys in the index, got %d", len(ops.state.keys))
+	}
+}
@@ -3,59 +3,90 @@ package wasm
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/suborbital/hive-wasm/bundle"
 	"github.com/suborbital/hive-wasm/request"
 	"github.com/suborbital/hive/hive"
 	"github.com/suborbital/vektor/vlog"
+	"github.com/wasmerio/wasmer-go/wasmer"
 
 	"github.com/pkg/errors"
 )
 
-//Runner represents a wasm-based runnable
-type Runner struct {
-	env *wasmEnvironment
+// ErrRunnableTimeout is returned when a Wasm Runnable's execution exceeds its configured timeout. wasmer cannot
+// interrupt or meter a running instance, so a timed out execution is abandoned rather than stopped: it keeps using
+// CPU until it returns on its own, but its instance is discarded and any host functions it calls afterwards fail
+var ErrRunnableTimeout = errors.New("execution of Wasm Runnable timed out")
+
+// ErrMemoryLimitExceeded is returned when a Wasm Runnable's memory grows larger than its configured limit
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded by Wasm Runnable")
+
+// TrapError is returned when a Wasm Runnable traps during execution.
+// The instance that trapped is discarded and replaced with a fresh one
+type TrapError struct {
+	Message string
+	// Trace is the backtrace of Wasm frames at the time of the trap, when available
+	Trace []string
 }
 
-// UseLogger sets the logger to be used by Wasm Runnables
-func UseLogger(l *vlog.Logger) {
-	logger = l
+// RunnableError is returned when a Wasm Runnable reports that it failed by calling return_error,
+// with a code and message chosen by the Runnable (which could, for example, be an HTTP status code)
+type RunnableError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (r *RunnableError) Error() string {
+	return fmt.Sprintf("Wasm Runnable returned error %d: %s", r.Code, r.Message)
 }
 
-// NewRunner returns a new *Runner
-func NewRunner(filepath string) *Runner {
-	ref := &bundle.WasmModuleRef{
-		Filepath: filepath,
+func (t *TrapError) Error() string {
+	if len(t.Trace) == 0 {
+		return fmt.Sprintf("Wasm Runnable trapped: %s", t.Message)
 	}
 
-	return newRunnerWithRef(ref)
+	return fmt.Sprintf("Wasm Runnable trapped: %s\n\t%s", t.Message, strings.Join(t.Trace, "\n\t"))
 }
 
-func newRunnerWithRef(ref *bundle.WasmModuleRef) *Runner {
-	environment := newEnvironment(ref)
-
-	r := &Runner{
-		env: environment,
-	}
+//Runner represents a wasm-based runnable
+type Runner struct {
+	env *wasmEnvironment
+}
 
-	return r
+// UseLogger sets the logger to be used by Wasm Runnables created with the package-level functions
+func UseLogger(l *vlog.Logger) {
+	defaultRuntime.UseLogger(l)
 }
 
-func newRunnerWithEnvironment(env *wasmEnvironment) *Runner {
-	w := &Runner{
-		env: env,
-	}
+// RegisterHostFns adds custom host functions to the Runtime used by the package-level functions.
+// They must be registered before any Runners are created or bundles are loaded with those functions
+func RegisterHostFns(fns ...*HostFn) error {
+	return defaultRuntime.RegisterHostFns(fns...)
+}
 
-	return w
+// NewRunner returns a new *Runner belonging to the package's default Runtime
+func NewRunner(filepath string, opts ...RunnerOption) *Runner {
+	return defaultRuntime.NewRunner(filepath, opts...)
 }
 
-// Run runs a Runner
+// Run runs a Runner. The result is the Runnable's output as a []byte, unless the job is a CoordinatedRequest and
+// the Runnable set the response status or headers or changed the request's state, in which case it is a
+// *request.CoordinatedResponse containing the output along with those changes. When the job is an *Invocation,
+// its Input is passed to the Runnable
 func (w *Runner) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
 	var jobBytes []byte
+	var req *request.CoordinatedRequest
+	var invokeDepth int
+	var invokeCallers []string
 
-	// check if the job is a CoordinatedRequest, and set up the WasmInstance if so
-	req, err := request.FromJSON(job.Bytes())
-	if err != nil {
+	// check if the job was scheduled by another Runnable with invoke_fn, or is a
+	// CoordinatedRequest (in which case the WasmInstance is set up with it)
+	if invocation, ok := job.Data().(*Invocation); ok {
+		jobBytes = invocation.Input
+		invokeDepth = invocation.Depth
+		invokeCallers = invocation.Chain
+	} else if parsed, err := request.FromJSON(job.Bytes()); err != nil {
 		// if it's not a request, treat it as normal data
 		bytes, bytesErr := interfaceToBytes(job.Data())
 		if bytesErr != nil {
@@ -64,37 +95,108 @@ func (w *Runner) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
 
 		jobBytes = bytes
 	} else {
+		req = parsed
+
 		// if the job is a request, the input to the Runnable is the URL
 		input := fmt.Sprintf("%s %s %s", req.Method, req.URL, req.ID)
 		jobBytes = []byte(input)
 	}
 
-	var output []byte
+	var output, stdout, stderr []byte
 	var runErr error
+	var runnableErr *RunnableError
 
 	if err := w.env.useInstance(req, ctx, func(instance *wasmInstance, ident int32) {
+		instance.invokeDepth = invokeDepth
+		instance.invokeCallers = invokeCallers
+
 		inPointer, writeErr := instance.writeMemory(jobBytes)
 		if writeErr != nil {
 			runErr = errors.Wrap(writeErr, "failed to instance.writeMemory")
 			return
 		}
 
+		// allocating memory for the input may have grown the instance's memory
+		if memErr := instance.checkMemoryLimit(w.env.opts.maxMemoryPages); memErr != nil {
+			w.env.discardInstance(instance)
+			runErr = memErr
+			return
+		}
+
 		wasmRun, err := instance.wasmerInst.Exports.GetFunction("run_e")
 		if err != nil || wasmRun == nil {
 			runErr = errors.New("missing required FFI function: run_e")
 			return
 		}
 
-		// ident is a random identifier for this job run that allows for "easy" FFI function calls in both directions
-		if _, wasmErr := wasmRun(inPointer, len(jobBytes), ident); wasmErr != nil {
-			runErr = errors.Wrap(wasmErr, "failed to wasmRun")
+		var timeoutChan <-chan time.Time
+		if w.env.opts.timeout > 0 {
+			timer := time.NewTimer(w.env.opts.timeout)
+			defer timer.Stop()
+
+			timeoutChan = timer.C
+		}
+
+		wasmErrChan := make(chan error, 1)
+
+		instance.executing.Add(1)
+
+		// run in a goroutine so that the timeout can be enforced, wasmer cannot interrupt
+		// a running instance, so if it times out it is abandoned and the execution is left to finish on its own
+		go func() {
+			defer instance.executing.Done()
+
+			// ident is a random identifier for this job run that allows for "easy" FFI function calls in both directions
+			_, wasmErr := wasmRun(inPointer, len(jobBytes), ident)
+			wasmErrChan <- wasmErr
+		}()
+
+		select {
+		case wasmErr := <-wasmErrChan:
+			// output is logged even if the execution failed, as it may help explain why
+			stdout, stderr = w.env.logOutput(instance, req)
+
+			if wasmErr != nil {
+				// the instance's memory and allocator may be left in an
+				// inconsistent state after a trap, so it cannot be reused
+				w.env.discardInstance(instance)
+				runErr = trapErrorFromWasmer(wasmErr)
+				return
+			}
+		case <-timeoutChan:
+			// the instance is closed once the execution returns
+			instance.abandoned = true
+			w.env.discardInstance(instance)
+			runErr = ErrRunnableTimeout
 			return
 		}
 
-		output = <-instance.resultChan
+		// an error takes precedence over a result, and both are drained so that
+		// nothing is left behind for the next execution to receive
+		select {
+		case runnableErr = <-instance.errChan:
+		default:
+		}
+
+		select {
+		case output = <-instance.resultChan:
+		default:
+			if runnableErr == nil {
+				runErr = errors.New("run_e returned without successfully calling return_result or return_error")
+				return
+			}
+		}
+
+		if memErr := instance.checkMemoryLimit(w.env.opts.maxMemoryPages); memErr != nil {
+			w.env.discardInstance(instance)
+			runErr = memErr
+			return
+		}
 
 		// deallocate the memory used for the input
-		instance.deallocate(inPointer, len(jobBytes))
+		if err := instance.deallocate(inPointer, len(jobBytes)); err != nil {
+			w.env.rt.logger.Error(errors.Wrap(err, "[hive-wasm] failed to deallocate input"))
+		}
 	}); err != nil {
 		return nil, errors.Wrap(err, "failed to useInstance")
 	}
@@ -103,10 +205,46 @@ func (w *Runner) Run(job hive.Job, ctx *hive.Ctx) (interface{}, error) {
 		return nil, errors.Wrap(runErr, "failed to execute Wasm Runnable")
 	}
 
+	// returned as-is so that callers can inspect the Runnable's code and message
+	if runnableErr != nil {
+		return nil, runnableErr
+	}
+
+	// if the job was a request and the Runnable changed its response or state,
+	// those changes are returned along with its output
+	var resp *request.CoordinatedResponse
+	if req != nil && (req.ResponseChanged() || !req.StateChanges().Empty()) {
+		resp = &request.CoordinatedResponse{
+			Output:       output,
+			StateChanges: req.StateChanges(),
+		}
+
+		if req.Response != nil {
+			resp.Response = *req.Response
+		}
+	}
+
+	if w.env.opts.outputMode == OutputLogAndAttach {
+		result := &RunResult{
+			Result:   output,
+			Response: resp,
+			Stdout:   stdout,
+			Stderr:   stderr,
+		}
+
+		return result, nil
+	}
+
+	if resp != nil {
+		return resp, nil
+	}
+
 	return output, nil
 }
 
 // OnChange evt ChangeEventruns when a worker starts using this Runnable
+// hive does not currently send an event when a worker stops, so Close
+// must be called once the Runner is no longer needed to release its resources
 func (w *Runner) OnChange(evt hive.ChangeEvent) error {
 	if evt == hive.ChangeTypeStart {
 		if err := w.env.addInstance(); err != nil {
@@ -117,6 +255,13 @@ func (w *Runner) OnChange(evt hive.ChangeEvent) error {
 	return nil
 }
 
+// Close waits for in-flight jobs to complete, closes the Runner's instances, deregisters its environment from the
+// Runtime and releases its reference to the compiled Wasm module, which is closed once no other Runner uses it.
+// Instances running an execution that timed out are closed once it returns. Jobs run after Close will fail
+func (w *Runner) Close() {
+	w.env.rt.removeEnvironment(w.env)
+}
+
 func interfaceToBytes(data interface{}) ([]byte, error) {
 	// if data is []byte or string, return it as-is
 	if b, ok := data.([]byte); ok {
@@ -134,3 +279,20 @@ func interfaceToBytes(data interface{}) ([]byte, error) {
 
 	return dataJSON, nil
 }
+
+// trapErrorFromWasmer converts an error returned from a Wasm function call into a TrapError
+func trapErrorFromWasmer(err error) *TrapError {
+	trapErr := &TrapError{
+		Message: err.Error(),
+		Trace:   []string{},
+	}
+
+	var wasmerTrap *wasmer.TrapError
+	if errors.As(err, &wasmerTrap) {
+		for _, frame := range wasmerTrap.Trace() {
+			trapErr.Trace = append(trapErr.Trace, fmt.Sprintf("func[%d]+0x%x (module offset 0x%x)", frame.FunctionIndex(), frame.FunctionOffset(), frame.ModuleOffset()))
+		}
+	}
+
+	return trapErr
+}